@@ -0,0 +1,89 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/gnss"
+)
+
+// benchCounts are the sentences and bytes read from the device
+type benchCounts struct {
+	sentences int
+	bytes     int
+	// longest time between two sentences
+	maxGap time.Duration
+}
+
+func (c benchCounts) print(label string, elapsed time.Duration) {
+	secs := elapsed.Seconds()
+	if secs <= 0 {
+		secs = 1
+	}
+	fmt.Printf("%s: %d sentences (%.1f/s), %d bytes (%.1f B/s), longest gap %s\n",
+		label, c.sentences, float64(c.sentences)/secs, c.bytes, float64(c.bytes)/secs,
+		c.maxGap.Round(time.Millisecond))
+}
+
+// bench reads sentences from the driver for the given duration, or until
+// interrupted, printing the read throughput every interval and a summary at
+// the end. The duration is not limited if 0.
+func bench(driver gnss.GnssDriver, duration time.Duration, interval time.Duration) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	if duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+
+	sendCh := make(chan []byte)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- driver.Start(ctx, sendCh)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	periodStart := start
+	var total, period benchCounts
+	var last time.Time
+	for {
+		select {
+		case line := <-sendCh:
+			now := time.Now()
+			if !last.IsZero() {
+				gap := now.Sub(last)
+				if gap > period.maxGap {
+					period.maxGap = gap
+				}
+				if gap > total.maxGap {
+					total.maxGap = gap
+				}
+			}
+			last = now
+			total.sentences++
+			total.bytes += len(line)
+			period.sentences++
+			period.bytes += len(line)
+		case now := <-ticker.C:
+			period.print(now.Format("15:04:05"), now.Sub(periodStart))
+			period = benchCounts{}
+			periodStart = now
+		case err := <-errCh:
+			total.print("Total", time.Since(start))
+			if ctx.Err() != nil {
+				// stopped because the duration is over, or interrupted
+				return nil
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/config"
+	"gitlab.com/postmarketOS/gnss-share/internal/gnss"
+)
+
+// cacheFiles returns the AGPS data files that exist in the cache of each
+// device, and in the subdirectories of agps_directory that agps_per_device
+// uses, e.g. for devices that are no longer configured
+func cacheFiles(conf *config.Config, devices []device) (files []string, err error) {
+	found := make(map[string]bool)
+	// the data may have been stored before compress_cache was changed
+	add := func(path string) {
+		path = strings.TrimSuffix(path, gnss.CompressedExt)
+		found[path] = true
+		found[path+gnss.CompressedExt] = true
+	}
+	for _, d := range devices {
+		add(d.cache.EphemerisPath())
+		add(d.cache.AlmanacPath())
+	}
+
+	names := []string{gnss.EphemerisFile, gnss.AlmanacFile}
+	if conf.EphemerisFile != "" {
+		names[0] = conf.EphemerisFile
+	}
+	if conf.AlmanacFile != "" {
+		names[1] = conf.AlmanacFile
+	}
+	names = append(names, names[0]+gnss.CompressedExt, names[1]+gnss.CompressedExt)
+	for _, name := range names {
+		var matches []string
+		matches, err = filepath.Glob(filepath.Join(conf.CachePath, "*", name))
+		if err != nil {
+			err = fmt.Errorf("cacheFiles: %w", err)
+			return
+		}
+		for _, m := range matches {
+			add(m)
+		}
+	}
+
+	for path := range found {
+		if info, serr := os.Stat(path); serr == nil && info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+	}
+	sort.Strings(files)
+
+	return
+}
+
+// clearCache removes the files, after asking for confirmation on in unless
+// force is set
+func clearCache(files []string, force bool, in io.Reader) error {
+	if len(files) == 0 {
+		fmt.Println("No AGPS data to remove")
+		return nil
+	}
+
+	if !force {
+		fmt.Println("AGPS data files to remove:")
+		for _, f := range files {
+			fmt.Printf("  %s\n", f)
+		}
+		fmt.Print("Remove these files? [y/N] ")
+		answer, _ := bufio.NewReader(in).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			fmt.Println("Not removing anything")
+			return nil
+		}
+	}
+
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			return fmt.Errorf("clearCache: %w", err)
+		}
+		fmt.Printf("Removed %q\n", f)
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/client"
+	"gitlab.com/postmarketOS/gnss-share/internal/config"
+)
+
+// healthcheck checks that the server is sending valid sentences on the first
+// socket, and that all sockets have the configured group owner
+func healthcheck(conf *config.Config, timeout time.Duration) error {
+	for _, l := range conf.Listeners {
+		if l.Socket == "" {
+			continue
+		}
+		if err := checkSocketGroup(l.Socket, l.Group); err != nil {
+			return fmt.Errorf("healthcheck: %w", err)
+		}
+	}
+
+	if err := client.Check(conf.ClientSocket(), timeout); err != nil {
+		return fmt.Errorf("healthcheck: %w", err)
+	}
+
+	return nil
+}
+
+// checkSocketGroup returns an error if the socket is not owned by the group.
+// This is skipped if no group is given, or if the group does not exist, since
+// the server does not change the group owner in that case either.
+func checkSocketGroup(socket string, sockGroup string) error {
+	if sockGroup == "" {
+		return nil
+	}
+
+	group, err := user.LookupGroup(sockGroup)
+	if err != nil {
+		var unknownGroup user.UnknownGroupError
+		if errors.As(err, &unknownGroup) {
+			return nil
+		}
+		return err
+	}
+	gid, err := strconv.ParseUint(group.Gid, 10, 32)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Gid != uint32(gid) {
+		return fmt.Errorf("socket %q is owned by gid %d, expected group %q (%d)", socket, stat.Gid, sockGroup, gid)
+	}
+
+	return nil
+}
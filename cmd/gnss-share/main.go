@@ -4,17 +4,30 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
+	"gitlab.com/postmarketOS/gnss-share/internal/agps"
+	"gitlab.com/postmarketOS/gnss-share/internal/client"
 	"gitlab.com/postmarketOS/gnss-share/internal/config"
 	"gitlab.com/postmarketOS/gnss-share/internal/gnss"
+	"gitlab.com/postmarketOS/gnss-share/internal/nmea"
+	"gitlab.com/postmarketOS/gnss-share/internal/ntrip"
 	"gitlab.com/postmarketOS/gnss-share/internal/pool"
 	"gitlab.com/postmarketOS/gnss-share/internal/server"
+	"gitlab.com/postmarketOS/gnss-share/internal/stats"
+	"gitlab.com/postmarketOS/gnss-share/internal/systemd"
+	"gitlab.com/postmarketOS/gnss-share/internal/version"
 )
 
 func usage() {
@@ -23,16 +36,27 @@ func usage() {
 
 func main() {
 	var confFile string
-	flag.StringVar(&confFile, "c", "/etc/gnss-share.conf", "Configuration file to use.")
+	flag.StringVar(&confFile, "c", "", fmt.Sprintf("Configuration file to use. (default %q if it exists, otherwise config.toml in $XDG_CONFIG_HOME/gnss-share or ~/.config/gnss-share)", config.SystemFile))
 	var help bool
 	flag.BoolVar(&help, "h", false, "Print help and quit.")
+	var showVersion bool
+	flag.BoolVar(&showVersion, "v", false, "Print version and quit.")
 
 	flag.Usage = func() {
 		fmt.Println("usage: gnss-share COMMAND [OPTION...]")
 		fmt.Println("Commands:")
 		fmt.Printf("  %-12s\t%s\n", "[none]", "The default behavior if no command is specified is to run in \"server\" mode.")
 		fmt.Printf("  %-12s\t%s\n", "store", "Store almanac and ephemeris data and quit.")
-		fmt.Printf("  %-12s\t%s\n", "load", "Load almanac and ephemeris data and quit.")
+		fmt.Printf("  %-12s\t%s\n", "load [--force]", "Load almanac and ephemeris data and quit. Stale data is only loaded with --force.")
+		fmt.Printf("  %-12s\t%s\n", "clear-cache [--force]", "Remove stored almanac and ephemeris data, after asking for confirmation unless --force is given.")
+		fmt.Printf("  %-12s\t%s\n", "version", "Print version and quit.")
+		fmt.Printf("  %-12s\t%s\n", "healthcheck [--timeout <duration>]", "Exit successfully if the server sends a valid NMEA sentence within the timeout (default 3s).")
+		fmt.Printf("  %-12s\t%s\n", "ping", "Exit successfully if a server is listening on the socket.")
+		fmt.Printf("  %-12s\t%s\n", "pipe", "Write NMEA sentences from the device to stdout, without starting the server.")
+		fmt.Printf("  %-12s\t%s\n", "bench [--duration <duration>] [--interval <duration>]", "Report how many sentences and bytes per second are read from the device every interval (default 1s), for the duration (default 10s, 0 until interrupted), without starting the server.")
+		fmt.Printf("  %-12s\t%s\n", "track [--output <file>] [--interval <duration>]", "Write a CSV row with the time, position, satellites and HDOP of each fix to stdout or the file, at most every interval if set, until interrupted.")
+		fmt.Printf("  %-12s\t%s\n", "fetch-agps", "Download almanac and ephemeris data from agps_url, load it and quit.")
+		fmt.Printf("  %-12s\t%s\n", "debug", "Run in server mode, and also print every sentence sent to clients.")
 		fmt.Println("Options:")
 		flag.PrintDefaults()
 	}
@@ -44,33 +68,148 @@ func main() {
 		return
 	}
 
+	if showVersion || flag.Arg(0) == "version" {
+		fmt.Println(version.String("gnss-share"))
+		return
+	}
+
+	if confFile == "" {
+		confFile = config.DefaultFile()
+	}
 	conf, err := config.Parse(confFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	var driver gnss.GnssDriver
-
-	switch conf.Driver {
-	case "stm":
-		driver = gnss.NewStmGnss(conf.DevicePath)
-	case "stm_serial":
-		driver = gnss.NewStmSerial(conf.DevicePath, conf.BaudRate)
+	var devices []device
+	for _, d := range conf.Devices {
+		dconf := conf.ForDevice(d)
+		driver, err := gnss.New(dconf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		devices = append(devices, device{
+			driver: driver,
+			cache:  agpsCache(dconf),
+			tag:    d.SourceTag,
+		})
 	}
+	// the device that commands and corrections for "the device" go to
+	primary := devices[0]
 
+	var debug bool
 	switch cmd := flag.Arg(0); cmd {
 	case "store":
-		err := driver.Save(conf.CachePath)
+		// let a running server store the data, since it has the device open
+		err := client.Command(conf.ClientSocket(), "STORE")
+		if errors.Is(err, client.ErrNotRunning) {
+			err = eachDevice(devices, func(d device) error {
+				return d.driver.Save(d.cache)
+			})
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
 		return
 	case "load":
-		err := driver.Load(conf.CachePath)
+		loadFlags := flag.NewFlagSet("load", flag.ExitOnError)
+		force := loadFlags.Bool("force", false, "Load data even if it is older than the configured max age.")
+		loadFlags.Parse(flag.Args()[1:])
+
+		// let a running server load the data, since it has the device open
+		cmd := "LOAD"
+		if *force {
+			cmd = "LOAD FORCE"
+		}
+		err := client.Command(conf.ClientSocket(), cmd)
+		if errors.Is(err, client.ErrNotRunning) {
+			err = eachDevice(devices, func(d device) error {
+				return d.driver.Load(d.cache, *force)
+			})
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "clear-cache":
+		clearFlags := flag.NewFlagSet("clear-cache", flag.ExitOnError)
+		force := clearFlags.Bool("force", false, "Remove the data without asking for confirmation.")
+		clearFlags.Parse(flag.Args()[1:])
+
+		files, err := cacheFiles(conf, devices)
+		if err == nil {
+			err = clearCache(files, *force, os.Stdin)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "healthcheck":
+		checkFlags := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+		timeout := checkFlags.Duration("timeout", 3*time.Second, "How long to wait for a valid sentence.")
+		checkFlags.Parse(flag.Args()[1:])
+
+		if err := healthcheck(conf, *timeout); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("OK")
+		return
+	case "ping":
+		if err := client.Ping(conf.ClientSocket()); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("gnss-share is running, listening on %q\n", conf.ClientSocket())
+		return
+	case "pipe":
+		if err := pipe(primary.driver); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "bench":
+		benchFlags := flag.NewFlagSet("bench", flag.ExitOnError)
+		duration := benchFlags.Duration("duration", 10*time.Second, "How long to read from the device, until interrupted if 0.")
+		interval := benchFlags.Duration("interval", time.Second, "How often to report the throughput.")
+		benchFlags.Parse(flag.Args()[1:])
+		if *interval <= 0 {
+			log.Fatal("bench: --interval must be positive")
+		}
+
+		if err := bench(primary.driver, *duration, *interval); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "track":
+		trackFlags := flag.NewFlagSet("track", flag.ExitOnError)
+		output := trackFlags.String("output", "", "File to write the CSV to, instead of stdout. It is overwritten if it exists.")
+		interval := trackFlags.Duration("interval", 0, "Minimum time between rows, 0 to write a row for every fix.")
+		trackFlags.Parse(flag.Args()[1:])
+
+		out := os.Stdout
+		if *output != "" {
+			out, err = os.Create(*output)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer out.Close()
+		}
+		if err := track(conf.ClientSocket(), primary.driver, out, *interval); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "fetch-agps":
+		if conf.AgpsUrl == "" {
+			log.Fatal("agps_url is not set in the configuration file")
+		}
+		err := eachDevice(devices, func(d device) error {
+			return fetchAgps(d.driver, conf.AgpsUrl, d.cache)
+		})
 		if err != nil {
 			log.Fatal(err)
 		}
 		return
+	case "debug":
+		// server mode, printing the sentences sent to clients
+		debug = true
 	default:
 		if flag.Arg(0) != "" {
 			fmt.Printf("Unknown command: %q\n", flag.Arg(0))
@@ -82,47 +221,377 @@ func main() {
 
 	// connection broadcast pool
 	connPool := pool.New()
+	if conf.MaxFixRate > 0 {
+		connPool.LimitRate(conf.MaxFixRate)
+	}
+	ttff := stats.NewTTFF(func(ttff time.Duration) {
+		fmt.Printf("Time to first fix: %s\n", ttff.Round(time.Millisecond))
+	})
+	connPool.Observe(ttff.Observe)
+	if conf.MetricsListen != "" {
+		st := stats.New(connPool)
+		st.ReportTTFF(ttff)
+		go func() {
+			if err := st.Serve(conf.MetricsListen); err != nil {
+				// not fatal
+				fmt.Printf("error serving stats: %s\n", err)
+			}
+		}()
+	}
+	if conf.UdpBroadcast != "" {
+		udp, err := server.NewUDPBroadcaster(conf.UdpBroadcast)
+		if err != nil {
+			log.Fatal(err)
+		}
+		connPool.Observe(udp.Send)
+	}
+	if conf.LineEnding == "crlf" {
+		connPool.SetLineEnding("\r\n")
+	}
+	if len(conf.ReplaySentences) > 0 {
+		connPool.ReplayLastFix(conf.ReplaySentences)
+	}
+	if debug {
+		connPool.Observe(func(msg []byte) {
+			fmt.Printf("%s %s\n", time.Now().Format("15:04:05.000"), msg)
+		})
+	}
+	var lastActivity int64
+	if interval := systemd.WatchdogInterval(); interval > 0 {
+		connPool.Observe(func(msg []byte) {
+			atomic.StoreInt64(&lastActivity, time.Now().UnixNano())
+		})
+	}
 	go connPool.Start()
 
-	// channels for starting/stopping the driver
-	stopChan := make(chan bool)
-	startChan := make(chan bool)
-	errChan := make(chan error)
+	var idleTimeout time.Duration
+	if conf.KeepAlive {
+		idleTimeout = conf.KeepAliveTimeout
+	}
+	// The drivers are started when the first client connects, and stopped
+	// when the last client disconnects, unless they should be kept alive.
+	// They are always kept running if sentences are broadcast over UDP, since
+	// there is no way to know if anyone is listening.
+	// drivers that fail, e.g. because the device was disconnected, are
+	// restarted until they work again
+	restartPolicy := gnss.Backoff{
+		Initial:     conf.RestartDelay,
+		Max:         conf.RestartMaxDelay,
+		Jitter:      0.2,
+		MaxAttempts: conf.RestartMaxAttempts,
+	}
+	var r runners
+	for _, d := range devices {
+		dr := &runner{
+			driver:      gnss.Supervised(d.driver, restartPolicy),
+			sendCh:      connPool.Source(d.tag),
+			keepRunning: conf.UdpBroadcast != "" || (conf.KeepAlive && conf.KeepAliveTimeout == 0),
+			idleTimeout: idleTimeout,
+			// the last fix is out of date once a driver stops
+			stopped: connPool.ClearLastFix,
+		}
+		dr.companions = append(dr.companions, func(ctx context.Context) {
+			ttff.Start(time.Now())
+		})
+		if interval := systemd.WatchdogInterval(); interval > 0 {
+			// the device takes a while to send sentences after it is
+			// started
+			dr.companions = append(dr.companions, func(ctx context.Context) {
+				atomic.StoreInt64(&lastActivity, time.Now().UnixNano())
+			})
+		}
+		if conf.LoadOnStart {
+			d := d
+			dr.companions = append(dr.companions, func(ctx context.Context) {
+				loadOnStart(d)
+			})
+		}
+		r = append(r, dr)
+	}
+	if conf.RtcmSource != "" {
+		r[0].companions = append(r[0].companions, func(ctx context.Context) {
+			streamCorrections(ctx, conf.RtcmSource, primary.driver)
+		})
+	}
 
-	go func() {
-		for range startChan {
-			go driver.Start(connPool.Broadcast, stopChan, errChan)
+	if interval := systemd.WatchdogInterval(); interval > 0 {
+		go watchdog(interval, conf.WatchdogStallTimeout, r, &lastActivity)
+	}
+
+	var listeners []server.Listener
+	for _, l := range conf.Listeners {
+		listeners = append(listeners, server.Listener{
+			Socket:  l.Socket,
+			Group:   l.Group,
+			Mode:    os.FileMode(l.Mode),
+			Control: l.Control,
+			Address: l.Address,
+		})
+	}
+	s := server.New(listeners, r.Start, r.Stop, connPool)
+	if err := s.AllowOnly(conf.TcpAllowed); err != nil {
+		log.Fatal(err)
+	}
+	s.AllowPeers(conf.AllowedUids, conf.AllowedGids)
+	s.SetWriteTimeout(conf.ClientWriteTimeout)
+	format, err := pool.ParseFormat(conf.Format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.SetFormat(format)
+	s.OnListening(func() {
+		if err := systemd.Notify("READY=1"); err != nil {
+			// not fatal
+			fmt.Printf("error notifying systemd: %s\n", err)
 		}
-	}()
+	})
+	s.HandleCommand("LOAD", func(args []string) error {
+		force := len(args) > 0 && strings.EqualFold(args[0], "FORCE")
+		return eachDevice(devices, func(d device) error {
+			fmt.Printf("received LOAD command, loading data from %q\n", d.cache.Dir)
+			return d.driver.Load(d.cache, force)
+		})
+	})
+	s.HandleCommand("STORE", func(args []string) error {
+		return eachDevice(devices, func(d device) error {
+			fmt.Printf("received STORE command, storing data to %q\n", d.cache.Dir)
+			return d.driver.Save(d.cache)
+		})
+	})
+
+	s.HandleControlCommand("SEND", func(args []string) ([]string, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("expected a NMEA sentence")
+		}
+		if err := checkControlCommand(args[0], conf.ControlCommands); err != nil {
+			return nil, err
+		}
+		fmt.Printf("received SEND command, sending %q to the device\n", args[0])
+		return primary.driver.WriteCommand([]byte(args[0]))
+	})
 
 	// start signal handler
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGUSR1, syscall.SIGUSR2)
+	signal.Notify(sigChan, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		for sig := range sigChan {
 			switch sig {
 			case syscall.SIGUSR1:
-				fmt.Printf("received SIGUSR1, loading data from %q\n", conf.CachePath)
-
-				if err := driver.Load(conf.CachePath); err != nil {
+				err := eachDevice(devices, func(d device) error {
+					fmt.Printf("received SIGUSR1, loading data from %q\n", d.cache.Dir)
+					return d.driver.Load(d.cache, false)
+				})
+				if err != nil {
 					// not fatal
 					fmt.Printf("error loading data: %s\n", err)
 				}
 			case syscall.SIGUSR2:
-				fmt.Printf("received SIGUSR2, storing data to %q\n", conf.CachePath)
-
-				if err := driver.Save(conf.CachePath); err != nil {
+				err := eachDevice(devices, func(d device) error {
+					fmt.Printf("received SIGUSR2, storing data to %q\n", d.cache.Dir)
+					return d.driver.Save(d.cache)
+				})
+				if err != nil {
 					// not fatal
 					fmt.Printf("error loading data: %s\n", err)
 				}
+			case syscall.SIGINT, syscall.SIGTERM:
+				fmt.Printf("received %s, shutting down\n", sig)
+				s.Stop()
 			}
 		}
 	}()
 
-	s := server.New(conf.Socket, conf.OwnerGroup, startChan, stopChan, connPool)
+	if conf.AgpsUrl != "" && conf.AgpsRefresh > 0 {
+		go func() {
+			for range time.Tick(conf.AgpsRefresh) {
+				err := eachDevice(devices, func(d device) error {
+					return fetchAgps(d.driver, conf.AgpsUrl, d.cache)
+				})
+				if err != nil {
+					// not fatal
+					fmt.Printf("error fetching AGPS data: %s\n", err)
+				}
+			}
+		}()
+	}
+
+	if conf.UdpBroadcast != "" {
+		r.Start()
+	}
 
-	if err := s.Start(); err != nil {
+	err = s.Start()
+	connPool.Stop()
+	if err != nil {
 		log.Fatal(err)
 	}
+}
+
+// watchdog notifies the systemd watchdog, unless the device is running and no
+// sentences were received from it since stallTimeout. lastActivity is the time
+// in UnixNano that a sentence was last received or the device was started.
+func watchdog(interval time.Duration, stallTimeout time.Duration, r runners, lastActivity *int64) {
+	stalled := false
+	for range time.Tick(interval / 2) {
+		since := time.Since(time.Unix(0, atomic.LoadInt64(lastActivity)))
+		if r.Running() && since > stallTimeout {
+			if !stalled {
+				fmt.Printf("No sentences received from device for %s, not notifying watchdog\n", since.Round(time.Second))
+				stalled = true
+			}
+			continue
+		}
+		stalled = false
+
+		if err := systemd.Notify("WATCHDOG=1"); err != nil {
+			// not fatal
+			fmt.Printf("error notifying systemd watchdog: %s\n", err)
+		}
+	}
+}
+
+// checkControlCommand returns an error if the command is not a valid NMEA
+// sentence with a type starting with one of the allowed types
+func checkControlCommand(cmd string, allowed []string) error {
+	sentence, err := nmea.Parse(cmd)
+	if err != nil {
+		return err
+	}
+
+	sType := sentence.Talker + sentence.Type
+	for _, a := range allowed {
+		if strings.HasPrefix(sType, a) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("sending %q sentences is not allowed", sType)
+}
+
+// device is a configured device, with the driver for it
+type device struct {
+	driver gnss.GnssDriver
+	cache  gnss.AgpsCache
+	tag    string
+}
+
+// eachDevice calls fn for each device, even if it fails for some of them. The
+// first error is returned, and any others are printed.
+func eachDevice(devices []device, fn func(d device) error) (err error) {
+	for _, d := range devices {
+		derr := fn(d)
+		if derr == nil {
+			continue
+		}
+		if err != nil {
+			fmt.Printf("error: %s\n", derr)
+			continue
+		}
+		err = derr
+	}
 
+	return
+}
+
+// loadOnStart loads AGPS data into the device after it was started, which is
+// not fatal, e.g. if there is no data yet
+func loadOnStart(d device) {
+	fmt.Printf("Loading AGPS data from %q\n", d.cache.Dir)
+	err := d.driver.Load(d.cache, false)
+	if errors.Is(err, gnss.ErrNoAgpsData) {
+		fmt.Printf("No AGPS data in %q to load\n", d.cache.Dir)
+	} else if err != nil && !errors.Is(err, gnss.ErrUnsupported) {
+		fmt.Printf("error loading AGPS data: %s\n", err)
+	}
+}
+
+// agpsCache returns where AGPS data is stored for the device in conf
+func agpsCache(conf *config.Config) gnss.AgpsCache {
+	cache := gnss.AgpsCache{
+		Dir:             conf.CachePath,
+		EphemerisName:   conf.EphemerisFile,
+		AlmanacName:     conf.AlmanacFile,
+		EphemerisMaxAge: conf.EphemerisMaxAge,
+		AlmanacMaxAge:   conf.AlmanacMaxAge,
+		Compress:        conf.CompressCache,
+	}
+	if conf.CachePerDevice {
+		cache.Dir = filepath.Join(conf.CachePath, deviceDirName(conf.DevicePath))
+	}
+
+	return cache
+}
+
+// deviceDirName returns the name of the AGPS data directory for the device at
+// path, e.g. "dev_ttyUSB0" for "/dev/ttyUSB0"
+func deviceDirName(path string) string {
+	return strings.ReplaceAll(strings.Trim(filepath.Clean(path), "/"), "/", "_")
+}
+
+// fetchAgps downloads AGPS data to the cache directory and loads it
+func fetchAgps(driver gnss.GnssDriver, url string, cache gnss.AgpsCache) error {
+	if err := agps.Fetch(url, cache); err != nil {
+		return err
+	}
+
+	return driver.Load(cache, false)
+}
+
+// streamCorrections writes RTCM correction data from the NTRIP caster at url to
+// the driver until ctx is cancelled, reconnecting to the caster on errors.
+// Writing waits until the device is open.
+func streamCorrections(ctx context.Context, url string, driver gnss.GnssDriver) {
+	// the device is still being opened when this is started
+	write := func(data []byte) error {
+		for {
+			err := driver.WriteRaw(data)
+			if !errors.Is(err, gnss.ErrNotOpen) {
+				return err
+			}
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	for {
+		err := ntrip.Stream(ctx, url, write)
+		if ctx.Err() != nil {
+			return
+		}
+		// not fatal
+		fmt.Printf("error streaming RTCM corrections: %s\n", err)
+
+		select {
+		case <-time.After(10 * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pipe writes sentences from the driver to stdout until interrupted
+func pipe(driver gnss.GnssDriver) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	sendCh := make(chan []byte)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- driver.Start(ctx, sendCh)
+	}()
+
+	for {
+		select {
+		case line := <-sendCh:
+			if _, err := os.Stdout.Write(append(line, '\n')); err != nil {
+				cancel()
+				<-errCh
+				return err
+			}
+		case err := <-errCh:
+			return err
+		}
+	}
 }
@@ -0,0 +1,167 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/gnss"
+)
+
+// runner starts and stops the driver as clients connect and disconnect
+type runner struct {
+	driver gnss.GnssDriver
+	sendCh chan<- []byte
+	// if set, the driver is never stopped once it has been started
+	keepRunning bool
+	// if set, the driver is only stopped once Stop was called and Start was
+	// not called again for this long
+	idleTimeout time.Duration
+	// functions that are run in their own goroutine for as long as the
+	// driver is running, they should return when ctx is cancelled
+	companions []func(ctx context.Context)
+	// called after the driver has stopped, if set
+	stopped func()
+
+	mu        sync.Mutex
+	run       *run
+	idleTimer *time.Timer
+}
+
+// run is a single run of the driver
+type run struct {
+	cancel context.CancelFunc
+}
+
+// Start starts the driver, if it is not already running
+func (r *runner) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.idleTimer != nil {
+		r.idleTimer.Stop()
+		r.idleTimer = nil
+	}
+	if r.run != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	thisRun := &run{cancel: cancel}
+	r.run = thisRun
+
+	for _, fn := range r.companions {
+		go fn(ctx)
+	}
+
+	go func() {
+		r.startDriver(ctx)
+
+		r.mu.Lock()
+		if r.run == thisRun {
+			r.run = nil
+		}
+		r.mu.Unlock()
+		cancel()
+
+		if r.stopped != nil {
+			r.stopped()
+		}
+	}()
+}
+
+// startDriver runs the driver until ctx is cancelled or it fails. The driver
+// restarting itself, e.g. once a disconnected device is back, is up to the
+// driver, see gnss.Supervised. It is fatal if the driver gave up restarting.
+func (r *runner) startDriver(ctx context.Context) {
+	err := r.driver.Start(ctx, r.sendCh)
+	if errors.Is(err, gnss.ErrGaveUp) {
+		log.Fatal(err)
+	}
+	if err != nil {
+		fmt.Printf("error reading from device: %s\n", err)
+	}
+}
+
+// Running returns true if the driver has been started, and not stopped
+func (r *runner) Running() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.run != nil
+}
+
+// Stop stops the driver, unless it should be kept running, or after the idle
+// timeout if one is set
+func (r *runner) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.keepRunning || r.run == nil {
+		return
+	}
+
+	if r.idleTimeout > 0 {
+		if r.idleTimer == nil {
+			var timer *time.Timer
+			timer = time.AfterFunc(r.idleTimeout, func() {
+				r.mu.Lock()
+				defer r.mu.Unlock()
+				// Start was called in the meantime
+				if r.idleTimer != timer {
+					return
+				}
+				r.idleTimer = nil
+				r.stop()
+			})
+			r.idleTimer = timer
+		}
+		return
+	}
+
+	r.stop()
+}
+
+// stop stops the driver, r.mu must be held
+func (r *runner) stop() {
+	if r.run == nil {
+		return
+	}
+
+	fmt.Println("Stopping GNSS device")
+	r.run.cancel()
+	r.run = nil
+}
+
+// runners starts and stops multiple drivers together
+type runners []*runner
+
+// Start starts all drivers that are not already running
+func (rs runners) Start() {
+	for _, r := range rs {
+		r.Start()
+	}
+}
+
+// Stop stops all drivers, see runner.Stop
+func (rs runners) Stop() {
+	for _, r := range rs {
+		r.Stop()
+	}
+}
+
+// Running returns true if any of the drivers is running
+func (rs runners) Running() bool {
+	for _, r := range rs {
+		if r.Running() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/client"
+	"gitlab.com/postmarketOS/gnss-share/internal/gnss"
+	"gitlab.com/postmarketOS/gnss-share/internal/nmea"
+)
+
+var trackHeader = []string{"timestamp", "lat", "lon", "alt", "sats", "hdop"}
+
+// track writes a CSV row to out for each fix, until interrupted. The sentences
+// are read from the server listening on socket if it is running, since it has
+// the device open, otherwise from the driver. Rows are written at most every
+// interval, if it is not 0.
+func track(socket string, driver gnss.GnssDriver, out io.Writer, interval time.Duration) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	lines := make(chan []byte)
+	errCh := make(chan error, 1)
+	conn, err := client.Dial(socket)
+	switch {
+	case err == nil:
+		defer conn.Close()
+		go func() {
+			errCh <- readSentences(conn, lines)
+		}()
+		go func() {
+			// interrupts readSentences
+			<-ctx.Done()
+			conn.Close()
+		}()
+	case errors.Is(err, client.ErrNotRunning):
+		go func() {
+			errCh <- driver.Start(ctx, lines)
+		}()
+	default:
+		return fmt.Errorf("track: %w", err)
+	}
+
+	w := newTrackWriter(out, interval)
+	if err := w.header(); err != nil {
+		return fmt.Errorf("track: %w", err)
+	}
+	for {
+		select {
+		case line := <-lines:
+			if err := w.add(line, time.Now()); err != nil {
+				return fmt.Errorf("track: %w", err)
+			}
+		case err := <-errCh:
+			if ctx.Err() != nil {
+				// interrupted
+				return nil
+			}
+			if err == nil {
+				err = fmt.Errorf("connection closed by the server")
+			}
+			return fmt.Errorf("track: %w", err)
+		}
+	}
+}
+
+// readSentences sends the NMEA sentences received from the server on conn to
+// lines, until the connection is closed
+func readSentences(conn net.Conn, lines chan<- []byte) error {
+	// the default format for clients may be set to something else
+	if _, err := conn.Write([]byte("FORMAT nmea\n")); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// sentences from devices with a source_tag are prefixed with it
+		if strings.HasPrefix(line, "[") {
+			if i := strings.Index(line, "] "); i >= 0 {
+				line = line[i+2:]
+			}
+		}
+		lines <- []byte(line)
+	}
+	return scanner.Err()
+}
+
+// trackWriter writes a CSV row for each fix cycle with a valid fix, with the
+// position from the first GGA sentence and the date from the first RMC
+// sentence of the cycle
+type trackWriter struct {
+	w        *csv.Writer
+	interval time.Duration
+	cycles   nmea.CycleDetector
+	pos      *nmea.Position
+	date     time.Time
+	hasRMC   bool
+	// set once the row for the current cycle has been handled
+	done bool
+	// when the last row was written
+	last time.Time
+}
+
+func newTrackWriter(out io.Writer, interval time.Duration) *trackWriter {
+	return &trackWriter{
+		w:        csv.NewWriter(out),
+		interval: interval,
+	}
+}
+
+// header writes the CSV header row
+func (t *trackWriter) header() error {
+	t.w.Write(trackHeader)
+	t.w.Flush()
+	return t.w.Error()
+}
+
+// add adds a sentence read at the given time, and writes the row for the fix
+// once both the GGA and RMC sentences of a cycle have been seen, or once the
+// next cycle starts if the cycle had no RMC sentence.
+func (t *trackWriter) add(line []byte, now time.Time) (err error) {
+	if t.cycles.Start(line) {
+		err = t.flush(now)
+		t.done = false
+	}
+	if t.done || err != nil {
+		return
+	}
+
+	s, perr := nmea.Parse(string(line))
+	if perr != nil {
+		return
+	}
+	switch s.Type {
+	case "GGA":
+		if t.pos != nil {
+			return
+		}
+		if pos, perr := s.Position(); perr == nil {
+			t.pos = &pos
+		}
+	case "RMC":
+		if t.hasRMC {
+			return
+		}
+		if date, perr := s.Date(); perr == nil {
+			t.date = date
+			t.hasRMC = true
+		}
+	}
+
+	if t.pos != nil && t.hasRMC {
+		err = t.flush(now)
+		t.done = true
+	}
+
+	return
+}
+
+// flush writes the row for the fix seen so far, if there is a valid one and
+// the interval since the last row has passed, and forgets it
+func (t *trackWriter) flush(now time.Time) error {
+	defer func() {
+		t.pos = nil
+		t.date = time.Time{}
+		t.hasRMC = false
+	}()
+	if t.pos == nil || t.pos.Quality == nmea.FixInvalid {
+		return nil
+	}
+	if t.interval > 0 && !t.last.IsZero() && now.Sub(t.last) < t.interval {
+		return nil
+	}
+	t.last = now
+
+	t.w.Write([]string{
+		t.timestamp(),
+		strconv.FormatFloat(t.pos.Latitude, 'f', 7, 64),
+		strconv.FormatFloat(t.pos.Longitude, 'f', 7, 64),
+		strconv.FormatFloat(t.pos.Altitude, 'f', -1, 64),
+		strconv.Itoa(t.pos.Satellites),
+		strconv.FormatFloat(t.pos.HDOP, 'f', -1, 64),
+	})
+	t.w.Flush()
+	return t.w.Error()
+}
+
+// timestamp returns the UTC time of the fix, with the date if it is known
+func (t *trackWriter) timestamp() string {
+	if t.date.IsZero() {
+		return t.pos.Time.Format("15:04:05.000")
+	}
+
+	h, m, s := t.pos.Time.Clock()
+	ts := t.date.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute +
+		time.Duration(s)*time.Second + time.Duration(t.pos.Time.Nanosecond()))
+	return ts.Format("2006-01-02T15:04:05.000Z")
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/nmea"
+)
+
+// trackGGA returns a GGA sentence at 48.5N 11.5E at the given time of day, with
+// the given fix quality
+func trackGGA(talker string, clock string, quality string) string {
+	return nmea.Sentence{Talker: talker, Type: "GGA", Data: []string{
+		clock, "4830.0000", "N", "01130.0000", "E", quality, "08", "0.9", "545.4", "M", "46.9", "M", "", "",
+	}}.String()
+}
+
+// trackRMC returns a RMC sentence with the given date
+func trackRMC(talker string, clock string, date string) string {
+	return nmea.Sentence{Talker: talker, Type: "RMC", Data: []string{
+		clock, "A", "4830.0000", "N", "01130.0000", "E", "0.0", "0.0", date, "", "", "A",
+	}}.String()
+}
+
+// Test that a row is written for each fix cycle with a valid fix, at most
+// every interval
+func TestTrackWriter(t *testing.T) {
+	gsv := nmea.Sentence{Talker: "GP", Type: "GSV", Data: []string{"1", "1", "00"}}.String()
+	row := func(ts string) string {
+		return ts + ",48.5000000,11.5000000,545.4,8,0.9"
+	}
+	type step struct {
+		line string
+		// when the line is read, relative to the first one
+		at time.Duration
+	}
+
+	tables := []struct {
+		name     string
+		interval time.Duration
+		steps    []step
+		expected []string
+	}{
+		{"gga and rmc", 0, []step{
+			{trackGGA("GP", "123519.000", "1"), 0},
+			{trackRMC("GN", "123519.000", "010621"), 0},
+			{gsv, 0},
+		}, []string{row("2021-06-01T12:35:19.000Z")}},
+		{"rmc leads", 0, []step{
+			{trackRMC("GN", "123519.000", "010621"), 0},
+			{gsv, 0},
+			{trackGGA("GN", "123519.000", "1"), 0},
+		}, []string{row("2021-06-01T12:35:19.000Z")}},
+		// the row is only written once the next cycle starts, so the
+		// last cycle is not written yet
+		{"gga only", 0, []step{
+			{trackGGA("GP", "123519.000", "1"), 0},
+			{gsv, 0},
+			{trackGGA("GP", "123520.000", "1"), time.Second},
+			{gsv, time.Second},
+		}, []string{row("12:35:19.000")}},
+		{"rmc without date", 0, []step{
+			{trackGGA("GP", "123519.000", "1"), 0},
+			{trackRMC("GP", "123519.000", ""), 0},
+		}, []string{row("12:35:19.000")}},
+		// only the first GGA and RMC of each cycle are used
+		{"repeated sentences", 0, []step{
+			{trackGGA("GP", "123519.000", "1"), 0},
+			{trackGGA("GN", "123520.000", "1"), 0},
+			{trackRMC("GN", "123519.000", "010621"), 0},
+			{trackRMC("GN", "123519.000", "020621"), 0},
+		}, []string{row("2021-06-01T12:35:19.000Z")}},
+		{"no fix", 0, []step{
+			{trackGGA("GP", "123519.000", "0"), 0},
+			{trackRMC("GP", "123519.000", "010621"), 0},
+			{trackGGA("GP", "123520.000", "0"), time.Second},
+			{gsv, time.Second},
+			{trackGGA("GP", "123521.000", "1"), 2 * time.Second},
+			{trackRMC("GP", "123521.000", "010621"), 2 * time.Second},
+		}, []string{row("2021-06-01T12:35:21.000Z")}},
+		{"fix lost", 0, []step{
+			{trackGGA("GP", "123519.000", "1"), 0},
+			{trackRMC("GP", "123519.000", "010621"), 0},
+			{trackGGA("GP", "123520.000", "0"), time.Second},
+			{trackRMC("GP", "123520.000", "010621"), time.Second},
+		}, []string{row("2021-06-01T12:35:19.000Z")}},
+		{"interval", 2 * time.Second, []step{
+			{trackGGA("GP", "123519.000", "1"), 0},
+			{trackRMC("GP", "123519.000", "010621"), 0},
+			{trackGGA("GP", "123520.000", "1"), time.Second},
+			{trackRMC("GP", "123520.000", "010621"), time.Second},
+			{trackGGA("GP", "123521.000", "1"), 2 * time.Second},
+			{trackRMC("GP", "123521.000", "010621"), 2 * time.Second},
+			{trackGGA("GP", "123522.000", "1"), 3 * time.Second},
+			{trackRMC("GP", "123522.000", "010621"), 3 * time.Second},
+		}, []string{row("2021-06-01T12:35:19.000Z"), row("2021-06-01T12:35:21.000Z")}},
+		{"invalid sentences", 0, []step{
+			{"garbage", 0},
+			{trackGGA("GP", "123519.000", "1"), 0},
+			{"$GPRMC,123519.000*00", 0},
+			{trackRMC("GP", "123519.000", "010621"), 0},
+		}, []string{row("2021-06-01T12:35:19.000Z")}},
+	}
+
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, table := range tables {
+		var out bytes.Buffer
+		w := newTrackWriter(&out, table.interval)
+		if err := w.header(); err != nil {
+			t.Fatalf("%s: writing header: %s", table.name, err)
+		}
+		for _, s := range table.steps {
+			if err := w.add([]byte(s.line), start.Add(s.at)); err != nil {
+				t.Errorf("%s: unexpected error: %s", table.name, err)
+			}
+		}
+
+		expected := strings.Join(append([]string{strings.Join(trackHeader, ",")}, table.expected...), "\n") + "\n"
+		if out.String() != expected {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", table.name, expected, out.String())
+		}
+	}
+}
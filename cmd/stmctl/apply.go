@@ -0,0 +1,109 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/gnss"
+)
+
+// applyLine is a "set" command read from a file
+type applyLine struct {
+	num   int
+	text  string
+	param gnss.Param
+	err   error
+}
+
+// apply reads "set <CDB-ID> <value>" lines from the given file, and sets all
+// of the parameters at once. Empty lines, and lines starting with '#' are
+// ignored. The result for each line is printed, and an error is returned if
+// any of them failed.
+func apply(stm gnss.Stm, path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("apply: %w", err)
+	}
+	defer fd.Close()
+
+	var lines []*applyLine
+	var params []gnss.Param
+	// lines that are sent to the module, in the same order as params
+	var sent []*applyLine
+
+	scanner := bufio.NewScanner(fd)
+	num := 0
+	for scanner.Scan() {
+		num++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		l := &applyLine{num: num, text: text}
+		lines = append(lines, l)
+
+		l.param, l.err = parseSetLine(text)
+		if l.err == nil {
+			params = append(params, l.param)
+			sent = append(sent, l)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("apply: %w", err)
+	}
+
+	if len(params) > 0 {
+		errs, err := stm.SetParams(params, true)
+		if err != nil {
+			return fmt.Errorf("apply: %w", err)
+		}
+		for i, l := range sent {
+			l.err = errs[i]
+		}
+	}
+
+	failed := 0
+	for _, l := range lines {
+		if l.err != nil {
+			failed++
+			fmt.Printf("line %d: %q: error: %s\n", l.num, l.text, l.err)
+		} else {
+			fmt.Printf("line %d: %q: ok\n", l.num, l.text)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("apply: %d of %d parameters failed", failed, len(lines))
+	}
+
+	return nil
+}
+
+func parseSetLine(line string) (p gnss.Param, err error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "set" {
+		err = fmt.Errorf("expected \"set <CDB-ID> <value>\"")
+		return
+	}
+
+	cdb, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		err = fmt.Errorf("invalid CDB-ID %q: %w", fields[1], err)
+		return
+	}
+	value, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		err = fmt.Errorf("invalid value %q: %w", fields[2], err)
+		return
+	}
+
+	p = gnss.Param{CdbId: int(cdb), Value: value}
+	return
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/gnss"
+)
+
+// fakeStm records the parameters set with SetParams, other methods are not
+// implemented
+type fakeStm struct {
+	gnss.Stm
+	// parameters and save flag of each SetParams call
+	calls [][]gnss.Param
+	saves []bool
+	// returned by SetParams for the parameter with the CDB-ID
+	paramErrs map[int]error
+	err       error
+}
+
+func (f *fakeStm) SetParams(params []gnss.Param, save bool) (errs []error, err error) {
+	f.calls = append(f.calls, params)
+	f.saves = append(f.saves, save)
+	if f.err != nil {
+		return nil, f.err
+	}
+	for _, p := range params {
+		errs = append(errs, f.paramErrs[p.CdbId])
+	}
+	return
+}
+
+// Test that all parameters in the file are set with a single SetParams call,
+// which saves them and resets the module once, and that the lines that failed
+// are counted
+func TestApply(t *testing.T) {
+	setErr := errors.New("set failed")
+	tables := []struct {
+		name      string
+		contents  string
+		paramErrs map[int]error
+		err       error
+		// parameters set in the single call, no call if nil
+		expected []gnss.Param
+		failed   bool
+	}{
+		{"valid", "# comment\n\nset 200 1\n  set 227 16  \n", nil, nil,
+			[]gnss.Param{{CdbId: 200, Value: 1}, {CdbId: 227, Value: 16}}, false},
+		{"parse errors", "set 200 1\nget 200\nset x 1\nset 201 -1\nset 202 0x10\nset 203 1 2\n", nil, nil,
+			[]gnss.Param{{CdbId: 200, Value: 1}}, true},
+		{"set error", "set 200 1\nset 201 2\n", map[int]error{201: setErr}, nil,
+			[]gnss.Param{{CdbId: 200, Value: 1}, {CdbId: 201, Value: 2}}, true},
+		{"save error", "set 200 1\n", nil, setErr,
+			[]gnss.Param{{CdbId: 200, Value: 1}}, true},
+		{"nothing to set", "# only comments\n\nbogus\n", nil, nil,
+			nil, true},
+		{"empty", "", nil, nil,
+			nil, false},
+	}
+
+	for _, table := range tables {
+		path := filepath.Join(t.TempDir(), "params")
+		if err := os.WriteFile(path, []byte(table.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		stm := &fakeStm{paramErrs: table.paramErrs, err: table.err}
+
+		err := apply(stm, path)
+		if got := err != nil; got != table.failed {
+			t.Errorf("%s: expected failure: %t, got: %v", table.name, table.failed, err)
+		}
+		if table.err != nil && !errors.Is(err, table.err) {
+			t.Errorf("%s: expected error: %v, got: %v", table.name, table.err, err)
+		}
+
+		if table.expected == nil {
+			if len(stm.calls) != 0 {
+				t.Errorf("%s: expected no parameters to be set, got: %v", table.name, stm.calls)
+			}
+			continue
+		}
+		if len(stm.calls) != 1 {
+			t.Errorf("%s: expected a single SetParams call, got: %d", table.name, len(stm.calls))
+			continue
+		}
+		if !reflect.DeepEqual(stm.calls[0], table.expected) {
+			t.Errorf("%s: expected parameters: %v, got: %v", table.name, table.expected, stm.calls[0])
+		}
+		if !stm.saves[0] {
+			t.Errorf("%s: expected the parameters to be saved", table.name)
+		}
+	}
+
+	if err := apply(&fakeStm{}, filepath.Join(t.TempDir(), "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected error: %v, got: %v", os.ErrNotExist, err)
+	}
+}
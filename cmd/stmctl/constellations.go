@@ -0,0 +1,129 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/gnss"
+)
+
+// CDB-ID of the mask of enabled constellations. It is read from the current
+// configuration block, and written to the NVM block by SetParam.
+const constellationMaskCdb = 227
+
+// Constellations, and their bit in the constellation mask
+var constellations = []struct {
+	name string
+	bit  uint64
+}{
+	{"gps", 0x01},
+	{"glonass", 0x02},
+	{"qzss", 0x04},
+	{"galileo", 0x08},
+	{"beidou", 0x80},
+}
+
+// setConstellations enables and disables the given comma-separated lists of
+// constellations, and prints the constellations that are enabled. The module
+// config is only changed, and the module reset, if the mask changed.
+func setConstellations(stm gnss.Stm, args []string) error {
+	flags := flag.NewFlagSet("constellations", flag.ExitOnError)
+	enable := flags.String("enable", "", "Comma-separated list of constellations to enable.")
+	disable := flags.String("disable", "", "Comma-separated list of constellations to disable.")
+	flags.Parse(args)
+
+	val, err := stm.GetParam(gnss.BlockCurrent.ID(constellationMaskCdb))
+	if err != nil {
+		return fmt.Errorf("constellations: %w", err)
+	}
+	mask, err := val.Uint64()
+	if err != nil {
+		return fmt.Errorf("constellations: %w", err)
+	}
+
+	newMask, err := constellationMask(mask, *enable, *disable)
+	if err != nil {
+		return fmt.Errorf("constellations: %w", err)
+	}
+
+	if newMask != mask {
+		if err := stm.SetParam(constellationMaskCdb, newMask, true); err != nil {
+			return fmt.Errorf("constellations: %w", err)
+		}
+	}
+
+	fmt.Printf("Enabled constellations: %s\n", strings.Join(constellationNames(newMask), ","))
+	return nil
+}
+
+// constellationMask returns mask with the bits for the constellations in the
+// comma-separated enable and disable lists set and cleared
+func constellationMask(mask uint64, enable string, disable string) (uint64, error) {
+	enableBits, err := constellationBits(enable)
+	if err != nil {
+		return 0, err
+	}
+	disableBits, err := constellationBits(disable)
+	if err != nil {
+		return 0, err
+	}
+	if enableBits&disableBits != 0 {
+		return 0, fmt.Errorf("constellations can't be both enabled and disabled: %s",
+			strings.Join(constellationNames(enableBits&disableBits), ","))
+	}
+
+	mask = (mask | enableBits) &^ disableBits
+	if mask&constellationBitsAll() == 0 {
+		return 0, fmt.Errorf("at least one constellation must be enabled")
+	}
+
+	return mask, nil
+}
+
+func constellationBits(list string) (bits uint64, err error) {
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		found := false
+		for _, c := range constellations {
+			if c.name == name {
+				bits |= c.bit
+				found = true
+				break
+			}
+		}
+		if !found {
+			var valid []string
+			for _, c := range constellations {
+				valid = append(valid, c.name)
+			}
+			err = fmt.Errorf("unknown constellation %q, must be one of: %s", name, strings.Join(valid, ","))
+			return
+		}
+	}
+
+	return
+}
+
+func constellationBitsAll() (bits uint64) {
+	for _, c := range constellations {
+		bits |= c.bit
+	}
+	return
+}
+
+func constellationNames(mask uint64) (names []string) {
+	for _, c := range constellations {
+		if mask&c.bit != 0 {
+			names = append(names, c.name)
+		}
+	}
+	return
+}
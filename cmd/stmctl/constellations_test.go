@@ -0,0 +1,46 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"testing"
+)
+
+// Test enabling and disabling constellations in the constellation mask
+func TestConstellationMask(t *testing.T) {
+	tables := []struct {
+		mask     uint64
+		enable   string
+		disable  string
+		expected uint64
+		err      bool
+	}{
+		{0x01, "", "", 0x01, false},
+		{0x01, "glonass", "", 0x03, false},
+		{0x01, "Galileo, BEIDOU", "", 0x89, false},
+		{0x01, "gps", "", 0x01, false},
+		{0x8f, "", "glonass,qzss", 0x89, false},
+		{0x03, "galileo", "glonass", 0x09, false},
+		{0x01, ",gps,", "", 0x01, false},
+		// bits of other settings in the mask are kept
+		{0x101, "glonass", "", 0x103, false},
+		{0x103, "", "glonass", 0x101, false},
+		{0x01, "gps", "gps", 0, true},
+		{0x01, "", "gps", 0, true},
+		{0x101, "", "gps", 0, true},
+		{0x01, "navic", "", 0, true},
+		{0x01, "", "gps,navic", 0, true},
+	}
+
+	for _, table := range tables {
+		mask, err := constellationMask(table.mask, table.enable, table.disable)
+		if got := err != nil; got != table.err {
+			t.Errorf("%#x enable %q disable %q: expected error: %t, got: %v", table.mask, table.enable, table.disable, table.err, err)
+			continue
+		}
+		if mask != table.expected {
+			t.Errorf("%#x enable %q disable %q: expected: %#x, got: %#x", table.mask, table.enable, table.disable, table.expected, mask)
+		}
+	}
+}
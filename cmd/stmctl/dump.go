@@ -0,0 +1,102 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/gnss"
+)
+
+// CDB-IDs that are dumped by default, and what they are
+var dumpParams = []struct {
+	cdbId       int
+	description string
+}{
+	{102, "NMEA port baud rate"},
+	{200, "Application on/off"},
+	{201, "NMEA message list 0 (low bits)"},
+	{227, "Constellation mask"},
+	{228, "NMEA message list 0 (high bits)"},
+	{303, "Fix rate"},
+}
+
+type dumpEntry struct {
+	CdbId       int    `json:"cdb_id" toml:"cdb_id"`
+	Description string `json:"description,omitempty" toml:"description,omitempty"`
+	Value       string `json:"value,omitempty" toml:"value,omitempty"`
+	Error       string `json:"error,omitempty" toml:"error,omitempty"`
+}
+
+// dump prints the values of the given CDB-IDs, or of a default set of IDs if
+// none are given, as a table or JSON. IDs that can't be read are included with
+// the error instead of a value.
+func dump(stm gnss.Stm, args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	asJson := flags.Bool("json", false, "Print the parameters as JSON.")
+	flags.Parse(args)
+
+	entries, err := readParams(stm, flags.Args())
+	if err != nil {
+		return fmt.Errorf("dump: %w", err)
+	}
+
+	if *asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+
+	for _, e := range entries {
+		value := e.Value
+		if e.Error != "" {
+			value = "skipped: " + e.Error
+		}
+		fmt.Printf("%-6d %-32s %s\n", e.CdbId, e.Description, value)
+	}
+
+	return nil
+}
+
+// readParams reads the values of the given CDB-IDs from the current
+// configuration, or of the default set of IDs if none are given. IDs that
+// can't be read are returned with the error instead of a value.
+func readParams(stm gnss.Stm, args []string) (entries []*dumpEntry, err error) {
+	if len(args) == 0 {
+		for _, p := range dumpParams {
+			entries = append(entries, &dumpEntry{CdbId: p.cdbId, Description: p.description})
+		}
+	}
+	for _, arg := range args {
+		cdb, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CDB-ID %q: %w", arg, err)
+		}
+		entries = append(entries, &dumpEntry{CdbId: cdb})
+	}
+
+	var ids []int
+	for _, e := range entries {
+		ids = append(ids, gnss.BlockCurrent.ID(e.CdbId))
+	}
+	vals, errs, err := stm.GetParams(ids)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		if errs[i] != nil {
+			e.Error = errs[i].Error()
+		} else if u, err := vals[i].Uint64(); err == nil {
+			e.Value = fmt.Sprintf("0x%02X", u)
+		} else {
+			e.Value = vals[i].String()
+		}
+	}
+
+	return
+}
@@ -4,37 +4,90 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"os"
 	"strconv"
 
+	"gitlab.com/postmarketOS/gnss-share/internal/config"
 	"gitlab.com/postmarketOS/gnss-share/internal/gnss"
+	"gitlab.com/postmarketOS/gnss-share/internal/version"
 )
 
 func usage() {
 	flag.CommandLine.Usage()
 }
 
+// Exit codes for errors, so that scripts can tell why a command failed. 2 is
+// used by the flag package for invalid options.
+const (
+	exitError    = 1
+	exitNotReady = 3
+	exitBusy     = 4
+	exitTimeout  = 5
+	exitParam    = 6
+)
+
+// fail prints the error and exits with the exit code for it
+func fail(err error) {
+	fmt.Println(err)
+
+	code := exitError
+	switch {
+	case errors.Is(err, gnss.ErrDeviceNotReady):
+		code = exitNotReady
+	case errors.Is(err, gnss.ErrDeviceBusy):
+		code = exitBusy
+	case errors.Is(err, gnss.ErrTimeout):
+		code = exitTimeout
+	case errors.Is(err, gnss.ErrParamSet), errors.Is(err, gnss.ErrParamGet):
+		code = exitParam
+	}
+	os.Exit(code)
+}
+
 func main() {
 	var devPath string
 	flag.StringVar(&devPath, "d", "/dev/gnss0", "Path to STM device")
-	var baud int
-	flag.IntVar(&baud, "b", 9600, "Baud rate, only applicable if STM device is a serial device *not* using the Linux GNSS subsystem.")
+	var baudRate string
+	flag.StringVar(&baudRate, "b", "9600", "Baud rate, or \"auto\" to detect it, only applicable if STM device is a serial device *not* using the Linux GNSS subsystem.")
 	var serial bool
 	flag.BoolVar(&serial, "s", false, "STM device is a serial device (e.g. /dev/tty*) *not* using the Linux GNSS subsystem")
 
+	var dryRun bool
+	flag.BoolVar(&dryRun, "n", false, "Dry run, print the sentences that set, apply, restore and reset would send without sending them.")
+	flag.BoolVar(&dryRun, "dry-run", false, "Same as -n.")
+
+	var quiet bool
+	flag.BoolVar(&quiet, "q", false, "Quiet, do not print the sentences written to and read from the device, only the result.")
+	flag.BoolVar(&quiet, "quiet", false, "Same as -q.")
+
 	var help bool
 	flag.BoolVar(&help, "h", false, "Print help and quit.")
+	var showVersion bool
+	flag.BoolVar(&showVersion, "v", false, "Print version and quit.")
 
 	flag.Usage = func() {
 		fmt.Println("usage: stmctl [OPTION...] COMMAND ")
 		fmt.Println("Options:")
 		flag.PrintDefaults()
 		fmt.Println("Commands:")
-		fmt.Printf("  %-12s\t%s\n", "get <CDB-ID>", "Get CDB-ID value.")
-		fmt.Printf("  %-12s\t%s\n", "set <CDB-ID> <value>", "Set CDB-ID to given value.")
+		fmt.Printf("  %-12s\t%s\n", "get <ID>", "Get parameter value, the ID is the block followed by the CDB-ID, e.g. 1201 for CDB-ID 201 in the current configuration (1), 2201 in the defaults (2) or 3201 in NVM (3).")
+		fmt.Printf("  %-12s\t%s\n", "set [--block <1|3>] [--no-save] <CDB-ID> <value>", "Set CDB-ID to given value in the NVM configuration block (3, default, parameter IDs 3000-3999) or the current one (1, parameter IDs 1000-1999), then save and reset. The NVM block is used once the module is reset, the current one right away. With --no-save, the value is set in the current block only, without saving to flash or resetting, so it is used until the module is reset. The defaults (2, parameter IDs 2000-2999) can't be set.")
+		fmt.Printf("  %-12s\t%s\n", "dump [--json] [CDB-ID...]", "Print the values of the given CDB-IDs, or of a default set of CDB-IDs.")
+		fmt.Printf("  %-12s\t%s\n", "apply <file>", "Set CDB-IDs from lines of \"set <CDB-ID> <value>\" in file, then save and reset once.")
+		fmt.Printf("  %-12s\t%s\n", "export <file> [CDB-ID...]", "Write the values of the given CDB-IDs, or of the set that dump prints, to a TOML profile file. CDB-IDs that can't be read are written with the error instead of a value.")
+		fmt.Printf("  %-12s\t%s\n", "import <file>", "Set the CDB-IDs in a profile file written by export, then save and reset once. CDB-IDs without a value are skipped.")
+		fmt.Printf("  %-12s\t%s\n", "constellations [--enable <list>] [--disable <list>]", "Enable/disable constellations (gps,glonass,qzss,galileo,beidou), then save and reset if changed. Prints the enabled constellations.")
+		fmt.Printf("  %-12s\t%s\n", "rate [<Hz>]", "Print the fix rate, or set it to 1, 2, 5 or 10 Hz, then save and reset if changed.")
+		fmt.Printf("  %-12s\t%s\n", "raw [--no-ack] <sentence>", "Send a NMEA sentence, adding the checksum if missing, and print the response until it is echoed back.")
 		fmt.Printf("  %-12s\t%s\n", "restore", "Restore module config to factory defaults.")
 		fmt.Printf("  %-12s\t%s\n", "reset", "Reset the module.")
+		fmt.Printf("  %-12s\t%s\n", "version", "Print version and quit.")
+		fmt.Println("Exit codes:")
+		fmt.Printf("  %d if the device is not ready, %d if it is busy, %d if the module timed out, %d if it rejected a parameter, %d for other errors.\n",
+			exitNotReady, exitBusy, exitTimeout, exitParam, exitError)
 	}
 
 	flag.Parse()
@@ -44,35 +97,132 @@ func main() {
 		return
 	}
 
+	if showVersion || flag.Arg(0) == "version" {
+		fmt.Println(version.String("stmctl"))
+		return
+	}
+
 	var stm gnss.Stm
 	if serial {
+		baud, err := config.ParseBaudRate(baudRate)
+		if err != nil {
+			panic(fmt.Errorf("invalid argument %q: %s", baudRate, err))
+		}
 		stm = gnss.NewStmSerial(devPath, baud)
 
 	} else {
 		stm = gnss.NewStmGnss(devPath)
 	}
+	stm.SetDryRun(dryRun)
+	stm.SetVerbose(!quiet)
 
 	switch cmd := flag.Arg(0); cmd {
+	case "apply":
+		if len(flag.Args()) < 2 {
+			usage()
+			return
+		}
+		if err := apply(stm, flag.Arg(1)); err != nil {
+			fail(err)
+		}
+		return
+	case "dump":
+		if err := dump(stm, flag.Args()[1:]); err != nil {
+			fail(err)
+		}
+		return
+	case "export":
+		if len(flag.Args()) < 2 {
+			usage()
+			return
+		}
+		if err := exportProfile(stm, flag.Arg(1), flag.Args()[2:]); err != nil {
+			fail(err)
+		}
+		return
+	case "import":
+		if len(flag.Args()) < 2 {
+			usage()
+			return
+		}
+		if err := importProfile(stm, flag.Arg(1)); err != nil {
+			fail(err)
+		}
+		return
+	case "constellations":
+		if err := setConstellations(stm, flag.Args()[1:]); err != nil {
+			fail(err)
+		}
+		return
+	case "rate":
+		if err := fixRate(stm, flag.Args()[1:]); err != nil {
+			fail(err)
+		}
+		return
+	case "raw":
+		rawFlags := flag.NewFlagSet("raw", flag.ExitOnError)
+		noAck := rawFlags.Bool("no-ack", false, "Do not wait for the module to echo the sentence.")
+		rawFlags.Parse(flag.Args()[1:])
+		if rawFlags.NArg() < 1 {
+			usage()
+			return
+		}
+		out, err := stm.SendCommand(rawFlags.Arg(0), !*noAck)
+		for _, line := range out {
+			fmt.Println(line)
+		}
+		if err != nil {
+			fail(err)
+		}
+		return
 	case "restore":
-		stm.Restore()
+		if err := stm.Restore(); err != nil {
+			fail(err)
+		}
 		return
 	case "reset":
-		stm.Reset()
+		if err := stm.Reset(); err != nil {
+			fail(err)
+		}
 		return
 	case "set":
-		if len(flag.Args()) < 2 {
+		setFlags := flag.NewFlagSet("set", flag.ExitOnError)
+		block := setFlags.Int("block", int(gnss.BlockNVM), "Configuration block to set the value in: 1 for the current configuration (parameter IDs 1000-1999), used right away, 3 for the configuration stored in NVM (parameter IDs 3000-3999), used once the module is reset.")
+		noSave := setFlags.Bool("no-save", false, "Set the value in the current configuration only, without saving it to flash or resetting the module.")
+		setFlags.Parse(flag.Args()[1:])
+		blockSet := false
+		setFlags.Visit(func(f *flag.Flag) {
+			blockSet = blockSet || f.Name == "block"
+		})
+		if *noSave && !blockSet {
+			*block = int(gnss.BlockCurrent)
+		}
+		if setFlags.NArg() < 2 {
 			usage()
 			return
 		}
-		cdb, err := strconv.ParseInt(flag.Arg(1), 10, 64)
+		cdb, err := strconv.ParseInt(setFlags.Arg(0), 10, 64)
 		if err != nil {
-			panic(fmt.Errorf("invalid argument %q: %s", flag.Arg(1), err))
+			panic(fmt.Errorf("invalid argument %q: %s", setFlags.Arg(0), err))
 		}
-		value, err := strconv.ParseUint(flag.Arg(2), 10, 64)
+		value, err := strconv.ParseUint(setFlags.Arg(1), 10, 64)
 		if err != nil {
-			panic(fmt.Errorf("invalid argument %q: %s", flag.Arg(2), err))
+			panic(fmt.Errorf("invalid argument %q: %s", setFlags.Arg(1), err))
+		}
+		if *block != int(gnss.BlockCurrent) && *block != int(gnss.BlockNVM) {
+			panic(fmt.Errorf("invalid block %d, must be %d or %d", *block, gnss.BlockCurrent, gnss.BlockNVM))
+		}
+		if *noSave && *block != int(gnss.BlockCurrent) {
+			// the NVM block is only used once it is saved and the module reset
+			panic(fmt.Errorf("--no-save can only be used with block %d", gnss.BlockCurrent))
+		}
+		errs, err := stm.SetParams([]gnss.Param{{CdbId: int(cdb), Value: value, Block: gnss.ConfigBlock(*block)}}, !*noSave)
+		if err == nil {
+			err = errs[0]
+		}
+		if err != nil {
+			fail(err)
 		}
-		stm.SetParam(int(cdb), value)
 		return
 	case "get":
 		if len(flag.Args()) < 1 {
@@ -85,9 +235,13 @@ func main() {
 		}
 		val, err := stm.GetParam(int(cdb))
 		if err != nil {
-			panic(fmt.Errorf("unable to get CDB ID \"%d\": %s", int(cdb), err))
+			fail(fmt.Errorf("unable to get CDB ID \"%d\": %w", int(cdb), err))
+		}
+		if u, err := val.Uint64(); err == nil {
+			fmt.Printf("%d: 0x%02X\n", cdb, u)
+		} else {
+			fmt.Printf("%d: %s\n", cdb, val)
 		}
-		fmt.Printf("%d: 0x%02X\n", cdb, val)
 	default:
 		usage()
 		return
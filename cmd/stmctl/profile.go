@@ -0,0 +1,115 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/pelletier/go-toml"
+	"gitlab.com/postmarketOS/gnss-share/internal/gnss"
+)
+
+// profile is a set of parameter values read from a module, which can be
+// applied to another module. Parameters that could not be read are included
+// with the error instead of a value, and are skipped when it is applied.
+type profile struct {
+	Params []*dumpEntry `toml:"param"`
+}
+
+// exportProfile writes the values of the given CDB-IDs, or of the default set
+// of IDs that dump uses, to a profile file at path
+func exportProfile(stm gnss.Stm, path string, args []string) error {
+	entries, err := readParams(stm, args)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+
+	data, err := toml.Marshal(profile{Params: entries})
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+
+	failed := 0
+	for _, e := range entries {
+		if e.Error != "" {
+			failed++
+			fmt.Printf("%d: error: %s\n", e.CdbId, e.Error)
+		}
+	}
+	fmt.Printf("Exported %d of %d parameters to %q\n", len(entries)-failed, len(entries), path)
+
+	return nil
+}
+
+// importProfile sets the parameters in the profile file at path all at once,
+// then saves them and resets the module. The result for each parameter is
+// printed, and an error is returned if any of them failed or were skipped.
+func importProfile(stm gnss.Stm, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	var prof profile
+	if err := toml.Unmarshal(data, &prof); err != nil {
+		return fmt.Errorf("import: %s: %w", path, err)
+	}
+
+	var params []gnss.Param
+	// the result for each entry in the profile
+	results := make([]error, len(prof.Params))
+	// index in results of each parameter that is sent to the module
+	var sent []int
+	for i, e := range prof.Params {
+		switch {
+		case e.Error != "":
+			results[i] = fmt.Errorf("skipped, it could not be exported: %s", e.Error)
+		case e.Value == "":
+			results[i] = fmt.Errorf("skipped, no value")
+		default:
+			params = append(params, profileParam(e))
+			sent = append(sent, i)
+		}
+	}
+
+	if len(params) > 0 {
+		errs, err := stm.SetParams(params, true)
+		if err != nil {
+			return fmt.Errorf("import: %w", err)
+		}
+		for i, r := range sent {
+			results[r] = errs[i]
+		}
+	}
+
+	failed := 0
+	for i, e := range prof.Params {
+		if results[i] != nil {
+			failed++
+			fmt.Printf("%d: error: %s\n", e.CdbId, results[i])
+		} else {
+			fmt.Printf("%d: %s: ok\n", e.CdbId, e.Value)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("import: %d of %d parameters failed", failed, len(prof.Params))
+	}
+
+	return nil
+}
+
+// profileParam returns the parameter to set for the entry. Integer values are
+// set like with "set", and other values, e.g. the fix period, are sent as they
+// were read from the module.
+func profileParam(e *dumpEntry) gnss.Param {
+	if value, err := strconv.ParseUint(e.Value, 0, 64); err == nil {
+		return gnss.Param{CdbId: e.CdbId, Value: value}
+	}
+	return gnss.Param{CdbId: e.CdbId, Text: e.Value}
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/gnss"
+)
+
+// CDB-ID of the fix rate, which the module stores as the time between fixes in
+// seconds, e.g. 0.2 for 5 Hz
+const fixRateCdb = 303
+
+// Fix rates in Hz that the module supports. Rates above 1 Hz may also require
+// a higher baud rate, or fewer messages in the message list, so that all
+// sentences fit in each fix cycle.
+var fixRates = []int{1, 2, 5, 10}
+
+// fixRate prints the current fix rate if no rate is given in args, otherwise
+// sets the fix rate in Hz, then saves and resets the module if it changed.
+func fixRate(stm gnss.Stm, args []string) error {
+	val, err := stm.GetParam(gnss.BlockCurrent.ID(fixRateCdb))
+	if err != nil {
+		return fmt.Errorf("rate: %w", err)
+	}
+	current, err := periodToRate(val.Float64())
+	if err != nil {
+		return fmt.Errorf("rate: %w", err)
+	}
+
+	if len(args) == 0 {
+		fmt.Printf("Fix rate: %s Hz\n", strconv.FormatFloat(current, 'f', -1, 64))
+		return nil
+	}
+
+	rate, err := parseFixRate(args[0])
+	if err != nil {
+		return fmt.Errorf("rate: %w", err)
+	}
+
+	if float64(rate) != current {
+		period := fmt.Sprintf("%.1f", 1/float64(rate))
+		errs, err := stm.SetParams([]gnss.Param{{CdbId: fixRateCdb, Text: period}}, true)
+		if err == nil {
+			err = errs[0]
+		}
+		if err != nil {
+			return fmt.Errorf("rate: %w", err)
+		}
+	}
+
+	fmt.Printf("Fix rate: %d Hz\n", rate)
+	return nil
+}
+
+// parseFixRate parses a fix rate in Hz, which must be one of fixRates
+func parseFixRate(s string) (int, error) {
+	rate, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(s), "Hz"))
+	if err == nil {
+		for _, r := range fixRates {
+			if r == rate {
+				return rate, nil
+			}
+		}
+	}
+
+	var valid []string
+	for _, r := range fixRates {
+		valid = append(valid, strconv.Itoa(r))
+	}
+	return 0, fmt.Errorf("unsupported fix rate %q, must be one of (Hz): %s", s, strings.Join(valid, ","))
+}
+
+// periodToRate converts the time between fixes in seconds to a rate in Hz,
+// rounded to 2 decimal places
+func periodToRate(period float64) (float64, error) {
+	if period <= 0 {
+		return 0, fmt.Errorf("invalid fix period: %v", period)
+	}
+	return math.Round(100/period) / 100, nil
+}
@@ -5,6 +5,5 @@ go 1.17
 require (
 	github.com/pelletier/go-toml v1.9.4
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
+	golang.org/x/sys v0.0.0-20211116061358-0a5406a5449c
 )
-
-require golang.org/x/sys v0.0.0-20211116061358-0a5406a5449c // indirect
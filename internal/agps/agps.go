@@ -0,0 +1,112 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package agps
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/gnss"
+)
+
+var client = http.Client{
+	Timeout: 60 * time.Second,
+}
+
+// Fetch downloads almanac and ephemeris data from the given base URL, and
+// stores it in the cache so that it can be loaded by a driver. The server at url
+// is expected to provide the data in the same format that the driver stores it,
+// at <url>/ephemeris.txt and <url>/almanac.txt. The data is compressed if
+// cache.Compress is set. The files in the cache are only replaced once both
+// were downloaded, so that they are not left with data from different fetches.
+func Fetch(url string, cache gnss.AgpsCache) (err error) {
+	paths := []string{cache.EphemerisPath(), cache.AlmanacPath()}
+	// downloaded files, in the same order as paths
+	var tmps []string
+	defer func() {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}()
+
+	for i, file := range []string{gnss.EphemerisFile, gnss.AlmanacFile} {
+		if err = os.MkdirAll(filepath.Dir(paths[i]), 0755); err != nil {
+			return fmt.Errorf("agps.Fetch: %w", err)
+		}
+
+		fileUrl := strings.TrimSuffix(url, "/") + "/" + file
+		fmt.Printf("Fetching AGPS data from: %q\n", fileUrl)
+
+		var tmp string
+		if tmp, err = download(fileUrl, paths[i]); err != nil {
+			return fmt.Errorf("agps.Fetch: %w", err)
+		}
+		tmps = append(tmps, tmp)
+	}
+
+	for i, tmp := range tmps {
+		if err = os.Rename(tmp, paths[i]); err != nil {
+			return fmt.Errorf("agps.Fetch: %w", err)
+		}
+	}
+
+	return
+}
+
+// download fetches url and writes it to a temporary file next to path,
+// gzip-compressed if path ends with gnss.CompressedExt, which is returned to
+// replace path with. The temporary file is removed if the download failed or
+// was empty.
+func download(url string, path string) (tmpPath string, err error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("unexpected response for %q: %s", url, resp.Status)
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	var size int64
+	if strings.HasSuffix(path, gnss.CompressedExt) {
+		gz := gzip.NewWriter(tmp)
+		size, err = io.Copy(gz, resp.Body)
+		if cerr := gz.Close(); err == nil {
+			err = cerr
+		}
+	} else {
+		size, err = io.Copy(tmp, resp.Body)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+
+	if size == 0 {
+		err = fmt.Errorf("no data received from %q", url)
+		return
+	}
+
+	return tmp.Name(), nil
+}
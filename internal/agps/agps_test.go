@@ -0,0 +1,149 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package agps
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/gnss"
+)
+
+// Test fetching AGPS data, and that the files in the cache are only replaced
+// if both were downloaded
+func TestFetch(t *testing.T) {
+	ok := func(data string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, data)
+		}
+	}
+	status := func(code int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "error", code)
+		}
+	}
+
+	tables := []struct {
+		name      string
+		compress  bool
+		ephemeris http.HandlerFunc
+		almanac   http.HandlerFunc
+		// expected contents of the files afterwards
+		expectedEph string
+		expectedAlm string
+		err         bool
+	}{
+		{"fetched", false, ok("new eph"), ok("new alm"), "new eph", "new alm", false},
+		{"compressed", true, ok("new eph"), ok("new alm"), "new eph", "new alm", false},
+		{"ephemeris not found", false, status(http.StatusNotFound), ok("new alm"), "old eph", "old alm", true},
+		{"almanac server error", false, ok("new eph"), status(http.StatusInternalServerError), "old eph", "old alm", true},
+		{"ephemeris empty", false, ok(""), ok("new alm"), "old eph", "old alm", true},
+		{"almanac empty", true, ok("new eph"), ok(""), "old eph", "old alm", true},
+	}
+
+	for _, table := range tables {
+		mux := http.NewServeMux()
+		mux.Handle("/agps/"+gnss.EphemerisFile, table.ephemeris)
+		mux.Handle("/agps/"+gnss.AlmanacFile, table.almanac)
+		server := httptest.NewServer(mux)
+
+		cache := gnss.AgpsCache{Dir: t.TempDir(), Compress: table.compress}
+		writeFile(t, cache.EphemerisPath(), "old eph", table.compress)
+		writeFile(t, cache.AlmanacPath(), "old alm", table.compress)
+
+		err := Fetch(server.URL+"/agps/", cache)
+		server.Close()
+		if got := err != nil; got != table.err {
+			t.Errorf("%s: expected error: %t, got: %v", table.name, table.err, err)
+		}
+
+		if data := readFile(t, cache.EphemerisPath(), table.compress); data != table.expectedEph {
+			t.Errorf("%s: expected ephemeris: %q, got: %q", table.name, table.expectedEph, data)
+		}
+		if data := readFile(t, cache.AlmanacPath(), table.compress); data != table.expectedAlm {
+			t.Errorf("%s: expected almanac: %q, got: %q", table.name, table.expectedAlm, data)
+		}
+
+		// no temporary files are left behind
+		entries, err := os.ReadDir(cache.Dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		expected := []string{filepath.Base(cache.AlmanacPath()), filepath.Base(cache.EphemerisPath())}
+		sort.Strings(expected)
+		if strings.Join(names, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s: expected files: %q, got: %q", table.name, expected, names)
+		}
+	}
+}
+
+// Test that the cache directory is created if it does not exist
+func TestFetchNewDir(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "data for "+r.URL.Path)
+	}))
+	defer server.Close()
+
+	cache := gnss.AgpsCache{Dir: filepath.Join(t.TempDir(), "cache")}
+	if err := Fetch(server.URL, cache); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if data := readFile(t, cache.EphemerisPath(), false); data != "data for /"+gnss.EphemerisFile {
+		t.Errorf("unexpected ephemeris: %q", data)
+	}
+	if data := readFile(t, cache.AlmanacPath(), false); data != "data for /"+gnss.AlmanacFile {
+		t.Errorf("unexpected almanac: %q", data)
+	}
+}
+
+func writeFile(t *testing.T, path string, data string, compress bool) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	if compress {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		w = gz
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string, compressed bool) string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if compressed {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("%q: %s", path, err)
+		}
+		r = gz
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%q: %s", path, err)
+	}
+	return string(data)
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/nmea"
+)
+
+// ErrNotRunning is returned when there is no server listening on the socket
+var ErrNotRunning = errors.New("server is not running")
+
+const (
+	// How long to wait for the server to respond to a command
+	commandTimeout = 5 * time.Minute
+	// How long to wait for the server to accept a connection in Ping
+	pingTimeout = time.Second
+)
+
+// Dial connects to the server listening on the given socket. ErrNotRunning is
+// returned if the socket does not exist, or nothing is listening on it, or if
+// socket is empty.
+func Dial(socket string) (net.Conn, error) {
+	if socket == "" {
+		return nil, fmt.Errorf("client.Dial: no socket configured: %w", ErrNotRunning)
+	}
+	conn, err := net.Dial("unix", socket)
+	if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+		return nil, fmt.Errorf("client.Dial: %q: %w", socket, ErrNotRunning)
+	} else if err != nil {
+		return nil, fmt.Errorf("client.Dial: %w", err)
+	}
+
+	return conn, nil
+}
+
+// Ping returns nil if a server is listening on the given socket. ErrNotRunning
+// is returned if the socket does not exist, or if it is stale because nothing
+// is listening on it anymore, e.g. after the server crashed.
+func Ping(socket string) error {
+	if socket == "" {
+		return fmt.Errorf("client.Ping: no socket configured: %w", ErrNotRunning)
+	}
+
+	info, err := os.Stat(socket)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("client.Ping: %q: %w", socket, ErrNotRunning)
+	} else if err != nil {
+		return fmt.Errorf("client.Ping: %w", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("client.Ping: %q is not a socket", socket)
+	}
+
+	conn, err := net.DialTimeout("unix", socket, pingTimeout)
+	if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("client.Ping: %q: %w", socket, ErrNotRunning)
+	} else if err != nil {
+		return fmt.Errorf("client.Ping: %w", err)
+	}
+
+	return conn.Close()
+}
+
+// Command runs the command on the server listening on the given socket, and
+// returns the error reported by the server if the command failed.
+func Command(socket string, cmd string) (err error) {
+	conn, err := Dial(socket)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	cmd = strings.ToUpper(cmd)
+	name := strings.Fields(cmd)[0]
+
+	conn.SetDeadline(time.Now().Add(commandTimeout))
+	if _, err = conn.Write([]byte(cmd + "\n")); err != nil {
+		return fmt.Errorf("client.Command: %w", err)
+	}
+
+	// skip over any NMEA sentences sent before the response
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "OK "+name {
+			return nil
+		}
+		if strings.HasPrefix(line, "ERROR "+name+": ") {
+			return fmt.Errorf("client.Command: %s", strings.TrimPrefix(line, "ERROR "+name+": "))
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("client.Command: %w", err)
+	}
+
+	return fmt.Errorf("client.Command: connection closed before response to %q", cmd)
+}
+
+// Check connects to the server listening on the given socket, and waits for up
+// to timeout for it to send a valid NMEA sentence. An error is returned if no
+// valid sentence was received.
+func Check(socket string, timeout time.Duration) (err error) {
+	conn, err := Dial(socket)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	scanner := bufio.NewScanner(conn)
+	invalid := 0
+	for scanner.Scan() {
+		if _, err := nmea.Parse(scanner.Text()); err == nil {
+			return nil
+		}
+		invalid++
+	}
+
+	if err = scanner.Err(); errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("client.Check: no valid sentences received within %s, %d invalid lines received", timeout, invalid)
+	} else if err != nil {
+		return fmt.Errorf("client.Check: %w", err)
+	}
+
+	return fmt.Errorf("client.Check: connection closed before a valid sentence was received")
+}
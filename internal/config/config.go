@@ -6,19 +6,217 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	toml "github.com/pelletier/go-toml"
 )
 
 type Config struct {
-	Socket     string `toml:"socket"`
-	OwnerGroup string `toml:"group"`
-	Driver     string `toml:"device_driver"`
-	DevicePath string `toml:"device_path"`
-	BaudRate   int    `toml:"device_baud_rate"`
-	CachePath  string `toml:"agps_directory"`
+	// Sockets to accept connections on. If none are configured, the socket,
+	// group and socket_mode settings are used for a single socket.
+	Listeners  []Listener `toml:"listener"`
+	Socket     string     `toml:"socket"`
+	SocketMode FileMode   `toml:"socket_mode"`
+	OwnerGroup string     `toml:"group"`
+	// How long writing to a client can take before it is disconnected, not
+	// limited if 0
+	ClientWriteTimeout time.Duration `toml:"client_write_timeout"`
+	// CIDR ranges or addresses that clients connecting to TCP listeners must
+	// connect from, all are allowed if empty
+	TcpAllowed []string `toml:"tcp_allowed"`
+	// Users and primary groups that processes connecting to sockets must
+	// run as, all are allowed if both are empty
+	AllowedUids []int `toml:"allowed_uids"`
+	AllowedGids []int `toml:"allowed_gids"`
+	// Tag to prefix sentences from the device with, e.g. "[rover] $GPGGA,...",
+	// not tagged if empty
+	SourceTag string `toml:"source_tag"`
+	// Line ending of sentences sent to clients: "lf" (default) or "crlf"
+	LineEnding string `toml:"line_ending"`
+	// Format of messages sent to clients that don't ask for another one with
+	// the FORMAT command: "nmea" (default) or "json"
+	Format string `toml:"format"`
+	// Devices to read sentences from, all are started when the first client
+	// connects. If none are configured, the device_driver, device_path,
+	// device_baud_rate and source_tag settings are used for a single device.
+	Devices []Device `toml:"device"`
+	// Keep the device running when no clients are connected, either forever
+	// or for the given time
+	KeepAlive        bool          `toml:"keep_alive"`
+	KeepAliveTimeout time.Duration `toml:"keep_alive_timeout"`
+	Driver           string        `toml:"device_driver"`
+	DevicePath       string        `toml:"device_path"`
+	BaudRate         BaudRate      `toml:"device_baud_rate"`
+	CachePath        string        `toml:"agps_directory"`
+	// Names of the AGPS data files in CachePath, and whether to use a
+	// subdirectory of CachePath for each device
+	EphemerisFile  string `toml:"ephemeris_file"`
+	AlmanacFile    string `toml:"almanac_file"`
+	CachePerDevice bool   `toml:"agps_per_device"`
+	// Store AGPS data gzip-compressed
+	CompressCache bool `toml:"compress_cache"`
+	// How long to wait for the device to be ready after opening it, and how
+	// many more times to try opening it if it is not
+	ReadyTimeout time.Duration `toml:"ready_timeout"`
+	ReadyRetries int           `toml:"ready_retries"`
+	// How long to wait before restarting the device after it failed, which
+	// is doubled for each restart in a row up to the max delay, and how many
+	// restarts in a row to do before giving up, not limited if 0
+	RestartDelay       time.Duration `toml:"restart_delay"`
+	RestartMaxDelay    time.Duration `toml:"restart_max_delay"`
+	RestartMaxAttempts int           `toml:"restart_max_attempts"`
+	// Longest line read from the device, longer lines are skipped. The
+	// driver's default is used if 0.
+	MaxLineLength int `toml:"max_line_length"`
+	// Base URL to fetch AGPS data from, and how often to fetch it when in
+	// server mode
+	AgpsUrl     string        `toml:"agps_url"`
+	AgpsRefresh time.Duration `toml:"agps_refresh_interval"`
+	// Load AGPS data each time the device is started in server mode
+	LoadOnStart bool `toml:"load_on_start"`
+	// How many more times to send AGPS data records that fail to load
+	AgpsLoadRetries int `toml:"agps_load_retries"`
+	// How long storing or loading AGPS data can take, not limited if 0
+	AgpsTimeout time.Duration `toml:"agps_timeout"`
+	// How long to wait for the module to respond to each command
+	CommandTimeout time.Duration `toml:"command_timeout"`
+	// Print the sentences written to and read from the device while running
+	// commands, e.g. storing or loading AGPS data
+	Verbose bool `toml:"verbose"`
+	// AGPS data older than these is not loaded, 0 means no limit
+	EphemerisMaxAge time.Duration `toml:"ephemeris_max_age"`
+	AlmanacMaxAge   time.Duration `toml:"almanac_max_age"`
+	// When the systemd watchdog is enabled, it is no longer notified once no
+	// sentences were received from the running device for this long
+	WatchdogStallTimeout time.Duration `toml:"watchdog_stall_timeout"`
+	// Address to serve stats on over HTTP, disabled if empty
+	MetricsListen string `toml:"metrics_listen"`
+	// Maximum number of fix cycles per second to send to clients, not
+	// limited if 0
+	MaxFixRate float64 `toml:"max_fix_rate_hz"`
+	// Types of sentences that clients connected to a control socket are
+	// allowed to send to the device, e.g. "PSTMSETPAR". Types starting with
+	// any of these are allowed.
+	ControlCommands []string `toml:"control_commands"`
+	// Types of sentences from the last fix cycle to send to new clients when
+	// they connect
+	ReplaySentences []string `toml:"replay_sentences"`
+	// URL of a NTRIP caster to stream RTCM corrections to the device from,
+	// disabled if empty
+	RtcmSource string `toml:"rtcm_source"`
+	// Address to send each sentence to as a UDP datagram, disabled if empty
+	UdpBroadcast string `toml:"udp_broadcast"`
+	// Start position, speed (m/s) and heading (degrees) for the "sim" driver
+	SimLatitude  float64 `toml:"sim_latitude"`
+	SimLongitude float64 `toml:"sim_longitude"`
+	SimSpeed     float64 `toml:"sim_speed"`
+	SimHeading   float64 `toml:"sim_heading"`
 }
 
+type Listener struct {
+	Socket string `toml:"socket"`
+	Group  string `toml:"group"`
+	// Defaults to socket_mode if not set
+	Mode FileMode `toml:"socket_mode"`
+	// Clients connected to a control socket can send commands to the device
+	Control bool `toml:"control"`
+	// TCP address (host:port) to listen on instead of a socket
+	Address string `toml:"address"`
+}
+
+type Device struct {
+	Driver   string   `toml:"device_driver"`
+	Path     string   `toml:"device_path"`
+	BaudRate BaudRate `toml:"device_baud_rate"`
+	// Defaults to source_tag if not set
+	SourceTag string `toml:"source_tag"`
+}
+
+// ForDevice returns a copy of the config with the device settings replaced by
+// the ones of the given device, for creating its driver
+func (c *Config) ForDevice(d Device) *Config {
+	dc := *c
+	dc.Driver = d.Driver
+	dc.DevicePath = d.Path
+	dc.BaudRate = d.BaudRate
+	dc.SourceTag = d.SourceTag
+	dc.Devices = []Device{d}
+
+	return &dc
+}
+
+// ClientSocket returns the first socket that the server listens on, for
+// commands that connect to a running server. It is empty if the server only
+// listens on TCP addresses.
+func (c *Config) ClientSocket() string {
+	for _, l := range c.Listeners {
+		if l.Socket != "" {
+			return l.Socket
+		}
+	}
+	return ""
+}
+
+// BaudRate is the baud rate for a serial device. A value of 0 means that the
+// baud rate should be detected automatically, and is configured by setting it
+// to "auto".
+type BaudRate int
+
+func (b *BaudRate) UnmarshalTOML(v interface{}) (err error) {
+	switch val := v.(type) {
+	case int64:
+		*b = BaudRate(val)
+	case string:
+		var baud int
+		baud, err = ParseBaudRate(val)
+		*b = BaudRate(baud)
+	default:
+		err = fmt.Errorf("config.BaudRate: invalid baud rate: %v", v)
+	}
+
+	return
+}
+
+// FileMode is a file mode, which is configured as an octal string, e.g. "0660"
+type FileMode os.FileMode
+
+func (m *FileMode) UnmarshalTOML(v interface{}) (err error) {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("config.FileMode: file mode must be an octal string, e.g. \"0660\": %v", v)
+	}
+
+	mode, err := strconv.ParseUint(str, 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("config.FileMode: invalid file mode: %q", str)
+	}
+	*m = FileMode(mode)
+
+	return
+}
+
+// ParseBaudRate parses the given baud rate, which is either a number or
+// "auto". 0 is returned for "auto".
+func ParseBaudRate(s string) (baud int, err error) {
+	if s == "auto" {
+		return
+	}
+
+	baud, err = strconv.Atoi(s)
+	if err != nil || baud <= 0 {
+		err = fmt.Errorf("config.ParseBaudRate: invalid baud rate: %q", s)
+	}
+
+	return
+}
+
+// Parse reads the config from the given file. Settings in the file can be
+// overridden by environment variables named after the setting with a
+// GNSS_SHARE_ prefix, e.g. GNSS_SHARE_DEVICE_PATH, so the precedence is:
+// environment > file > defaults.
 func Parse(file string) (c *Config, err error) {
 	contents, err := ioutil.ReadFile(file)
 	if err != nil {
@@ -26,10 +224,158 @@ func Parse(file string) (c *Config, err error) {
 		return
 	}
 
-	c = &Config{}
+	c = &Config{
+		SocketMode:         0660,
+		ClientWriteTimeout: 5 * time.Second,
+		EphemerisMaxAge:    4 * time.Hour,
+		AlmanacMaxAge:      14 * 24 * time.Hour,
+		ReplaySentences:    []string{"GGA", "RMC"},
+		AgpsLoadRetries:    2,
+		AgpsTimeout:        2 * time.Minute,
+		CommandTimeout:     30 * time.Second,
+		RestartDelay:       2 * time.Second,
+		RestartMaxDelay:    time.Minute,
+		Verbose:            true,
+	}
 
 	if err = toml.Unmarshal(contents, c); err != nil {
 		err = fmt.Errorf("config.Parse(): %w", err)
+		return
+	}
+
+	// environment variables take precedence over the config file
+	env, err := applyEnv(c)
+	if err != nil {
+		err = fmt.Errorf("config.Parse(): %w", err)
+		return
+	}
+
+	if len(c.Listeners) == 0 {
+		c.Listeners = []Listener{{
+			Socket: c.Socket,
+			Group:  c.OwnerGroup,
+			Mode:   c.SocketMode,
+		}}
+	} else if err = c.applyEnvListener(env); err != nil {
+		err = fmt.Errorf("config.Parse(): %w", err)
+		return
+	}
+	for i, l := range c.Listeners {
+		if l.Address != "" {
+			if l.Socket != "" {
+				err = fmt.Errorf("config.Parse(): listener %d can't have both a socket and an address", i)
+				return
+			}
+			if l.Control {
+				err = fmt.Errorf("config.Parse(): listener %d: only sockets can be control sockets", i)
+				return
+			}
+			continue
+		}
+		if l.Socket == "" {
+			err = fmt.Errorf("config.Parse(): no socket path or address set for listener %d", i)
+			return
+		}
+		if l.Mode == 0 {
+			c.Listeners[i].Mode = c.SocketMode
+		}
+	}
+
+	if c.MaxFixRate < 0 {
+		err = fmt.Errorf("config.Parse(): max_fix_rate_hz must not be negative: %f", c.MaxFixRate)
+		return
+	}
+
+	if c.ClientWriteTimeout < 0 {
+		err = fmt.Errorf("config.Parse(): client_write_timeout must not be negative: %s", c.ClientWriteTimeout)
+		return
+	}
+
+	if c.KeepAliveTimeout < 0 {
+		err = fmt.Errorf("config.Parse(): keep_alive_timeout must not be negative: %s", c.KeepAliveTimeout)
+		return
+	}
+
+	if len(c.Devices) == 0 {
+		c.Devices = []Device{{
+			Driver:   c.Driver,
+			Path:     c.DevicePath,
+			BaudRate: c.BaudRate,
+		}}
+	} else if err = c.applyEnvDevice(env); err != nil {
+		err = fmt.Errorf("config.Parse(): %w", err)
+		return
+	}
+	for i, d := range c.Devices {
+		if d.SourceTag == "" {
+			c.Devices[i].SourceTag = c.SourceTag
+		}
+		if strings.ContainsAny(c.Devices[i].SourceTag, "\r\n") {
+			err = fmt.Errorf("config.Parse(): source_tag must not contain newlines: %q", c.Devices[i].SourceTag)
+			return
+		}
+	}
+
+	switch c.LineEnding {
+	case "", "lf", "crlf":
+	default:
+		err = fmt.Errorf("config.Parse(): line_ending must be \"lf\" or \"crlf\": %q", c.LineEnding)
+		return
+	}
+
+	switch c.Format {
+	case "", "nmea", "json":
+	default:
+		err = fmt.Errorf("config.Parse(): format must be \"nmea\" or \"json\": %q", c.Format)
+		return
+	}
+
+	if c.AgpsLoadRetries < 0 {
+		err = fmt.Errorf("config.Parse(): agps_load_retries must not be negative: %d", c.AgpsLoadRetries)
+		return
+	}
+
+	for _, ids := range [][]int{c.AllowedUids, c.AllowedGids} {
+		for _, id := range ids {
+			if id < 0 {
+				err = fmt.Errorf("config.Parse(): allowed_uids and allowed_gids must not be negative: %d", id)
+				return
+			}
+		}
+	}
+
+	if c.AgpsTimeout < 0 {
+		err = fmt.Errorf("config.Parse(): agps_timeout must not be negative: %s", c.AgpsTimeout)
+		return
+	}
+
+	if c.CommandTimeout <= 0 {
+		err = fmt.Errorf("config.Parse(): command_timeout must be positive: %s", c.CommandTimeout)
+		return
+	}
+
+	if c.MaxLineLength < 0 {
+		err = fmt.Errorf("config.Parse(): max_line_length must not be negative: %d", c.MaxLineLength)
+		return
+	}
+
+	if c.RestartDelay <= 0 || c.RestartMaxDelay < c.RestartDelay || c.RestartMaxAttempts < 0 {
+		err = fmt.Errorf("config.Parse(): restart_delay must be positive, restart_max_delay must not be less than it, and restart_max_attempts must not be negative")
+		return
+	}
+
+	if c.ReadyTimeout < 0 || c.ReadyRetries < 0 {
+		err = fmt.Errorf("config.Parse(): ready_timeout and ready_retries must not be negative")
+		return
+	}
+
+	if c.AgpsRefresh < 0 {
+		err = fmt.Errorf("config.Parse(): agps_refresh_interval must not be negative: %s", c.AgpsRefresh)
+		return
+	}
+
+	if c.EphemerisMaxAge < 0 || c.AlmanacMaxAge < 0 {
+		err = fmt.Errorf("config.Parse(): ephemeris_max_age and almanac_max_age must not be negative")
 	}
 
 	return
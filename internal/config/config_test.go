@@ -0,0 +1,197 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Test parsing the devices from a config with a single device, and a config
+// with [[device]] tables, and getting the config of each device
+func TestParseDevices(t *testing.T) {
+	tables := []struct {
+		name     string
+		contents string
+		expected []Device
+		err      bool
+	}{
+		{"legacy", `
+socket="/run/gnss-share.sock"
+device_driver="stm_serial"
+device_path="/dev/ttyUSB0"
+device_baud_rate=9600
+source_tag="rover"
+`, []Device{{Driver: "stm_serial", Path: "/dev/ttyUSB0", BaudRate: 9600, SourceTag: "rover"}}, false},
+		{"legacy auto baud", `
+socket="/run/gnss-share.sock"
+device_driver="nmea_serial"
+device_path="/dev/ttyUSB0"
+device_baud_rate="auto"
+`, []Device{{Driver: "nmea_serial", Path: "/dev/ttyUSB0"}}, false},
+		{"devices", `
+socket="/run/gnss-share.sock"
+# not used once devices are configured
+device_driver="stm"
+device_path="/dev/gnss0"
+source_tag="base"
+
+[[device]]
+device_driver="stm_serial"
+device_path="/dev/ttyUSB0"
+device_baud_rate="auto"
+source_tag="rover"
+
+[[device]]
+device_driver="nmea_serial"
+device_path="/dev/ttyACM0"
+device_baud_rate=115200
+`, []Device{
+			{Driver: "stm_serial", Path: "/dev/ttyUSB0", SourceTag: "rover"},
+			{Driver: "nmea_serial", Path: "/dev/ttyACM0", BaudRate: 115200, SourceTag: "base"},
+		}, false},
+		{"tag with newline", `
+socket="/run/gnss-share.sock"
+[[device]]
+device_driver="stm"
+device_path="/dev/gnss0"
+source_tag="a\nb"
+`, nil, true},
+		{"invalid baud rate", `
+socket="/run/gnss-share.sock"
+[[device]]
+device_driver="stm_serial"
+device_path="/dev/ttyUSB0"
+device_baud_rate="fast"
+`, nil, true},
+	}
+
+	for _, table := range tables {
+		file := filepath.Join(t.TempDir(), "gnss-share.conf")
+		if err := os.WriteFile(file, []byte(table.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := Parse(file)
+		if got := err != nil; got != table.err {
+			t.Errorf("%s: expected error: %t, got: %v", table.name, table.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(c.Devices, table.expected) {
+			t.Errorf("%s: expected devices: %+v, got: %+v", table.name, table.expected, c.Devices)
+		}
+
+		for _, d := range c.Devices {
+			dc := c.ForDevice(d)
+			if dc.Driver != d.Driver || dc.DevicePath != d.Path || dc.BaudRate != d.BaudRate || dc.SourceTag != d.SourceTag {
+				t.Errorf("%s: expected device settings of %+v, got: %q, %q, %d, %q", table.name, d, dc.Driver, dc.DevicePath, dc.BaudRate, dc.SourceTag)
+			}
+			if !reflect.DeepEqual(dc.Devices, []Device{d}) {
+				t.Errorf("%s: expected only device %+v, got: %+v", table.name, d, dc.Devices)
+			}
+			// the other settings are shared
+			if dc.Socket != c.Socket || &dc.Listeners[0] != &c.Listeners[0] {
+				t.Errorf("%s: expected the other settings to be shared", table.name)
+			}
+		}
+	}
+}
+
+// Test that environment variables for the listener and device settings
+// override the [[listener]] and [[device]] tables, which is only possible if
+// there is one of them
+func TestParseEnvTables(t *testing.T) {
+	listener := `
+[[listener]]
+socket="/run/gnss-share.sock"
+group="geoclue"
+`
+	device := `
+[[device]]
+device_driver="stm_serial"
+device_path="/dev/ttyUSB0"
+device_baud_rate=9600
+source_tag="rover"
+`
+	tables := []struct {
+		name      string
+		contents  string
+		env       map[string]string
+		listeners []Listener
+		devices   []Device
+		err       bool
+	}{
+		{"listener", listener + device, map[string]string{
+			"GNSS_SHARE_SOCKET":      "/tmp/gnss-share.sock",
+			"GNSS_SHARE_GROUP":       "users",
+			"GNSS_SHARE_SOCKET_MODE": "0600",
+		}, []Listener{{Socket: "/tmp/gnss-share.sock", Group: "users", Mode: 0600}},
+			[]Device{{Driver: "stm_serial", Path: "/dev/ttyUSB0", BaudRate: 9600, SourceTag: "rover"}}, false},
+		{"tcp listener", "[[listener]]\naddress=\"127.0.0.1:10110\"\n" + device, map[string]string{
+			"GNSS_SHARE_SOCKET": "/tmp/gnss-share.sock",
+		}, []Listener{{Socket: "/tmp/gnss-share.sock", Mode: 0660}},
+			[]Device{{Driver: "stm_serial", Path: "/dev/ttyUSB0", BaudRate: 9600, SourceTag: "rover"}}, false},
+		{"device", listener + device, map[string]string{
+			"GNSS_SHARE_DEVICE_DRIVER": "nmea_serial",
+			"GNSS_SHARE_DEVICE_PATH":   "/dev/ttyACM0",
+			"GNSS_SHARE_BAUD_RATE":     "auto",
+			"GNSS_SHARE_SOURCE_TAG":    "base",
+		}, []Listener{{Socket: "/run/gnss-share.sock", Group: "geoclue", Mode: 0660}},
+			[]Device{{Driver: "nmea_serial", Path: "/dev/ttyACM0", SourceTag: "base"}}, false},
+		// socket_mode and source_tag are only defaults with several
+		// tables
+		{"defaults", listener + listener + device + "[[device]]\ndevice_driver=\"stm\"\n", map[string]string{
+			"GNSS_SHARE_SOCKET_MODE": "0600",
+			"GNSS_SHARE_SOURCE_TAG":  "base",
+		}, []Listener{
+			{Socket: "/run/gnss-share.sock", Group: "geoclue", Mode: 0600},
+			{Socket: "/run/gnss-share.sock", Group: "geoclue", Mode: 0600},
+		}, []Device{
+			{Driver: "stm_serial", Path: "/dev/ttyUSB0", BaudRate: 9600, SourceTag: "rover"},
+			{Driver: "stm", SourceTag: "base"},
+		}, false},
+		{"several listeners", listener + listener + device, map[string]string{
+			"GNSS_SHARE_SOCKET": "/tmp/gnss-share.sock",
+		}, nil, nil, true},
+		{"several devices", listener + device + device, map[string]string{
+			"GNSS_SHARE_DEVICE_PATH": "/dev/ttyACM0",
+		}, nil, nil, true},
+		{"several devices alias", listener + device + device, map[string]string{
+			"GNSS_SHARE_BAUD_RATE": "4800",
+		}, nil, nil, true},
+	}
+
+	for _, table := range tables {
+		file := filepath.Join(t.TempDir(), "gnss-share.conf")
+		if err := os.WriteFile(file, []byte(table.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for name, val := range table.env {
+			os.Setenv(name, val)
+		}
+		c, err := Parse(file)
+		for name := range table.env {
+			os.Unsetenv(name)
+		}
+
+		if got := err != nil; got != table.err {
+			t.Errorf("%s: expected error: %t, got: %v", table.name, table.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(c.Listeners, table.listeners) {
+			t.Errorf("%s: expected listeners: %+v, got: %+v", table.name, table.listeners, c.Listeners)
+		}
+		if !reflect.DeepEqual(c.Devices, table.devices) {
+			t.Errorf("%s: expected devices: %+v, got: %+v", table.name, table.devices, c.Devices)
+		}
+	}
+}
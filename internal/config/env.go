@@ -0,0 +1,163 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefix of environment variables that override config settings, e.g.
+// GNSS_SHARE_DEVICE_PATH overrides device_path
+const envPrefix = "GNSS_SHARE_"
+
+// Other names of environment variables for settings, by toml key, which are
+// used if the variable named after the key is not set
+var envAliases = map[string][]string{
+	"device_baud_rate": {envPrefix + "BAUD_RATE"},
+}
+
+// envName returns the name of the environment variable that overrides the
+// setting with the given toml key
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(key)
+}
+
+// lookupEnv returns the value and name of the environment variable that
+// overrides the setting with the given toml key, if any is set
+func lookupEnv(key string) (val string, name string, ok bool) {
+	for _, name = range append([]string{envName(key)}, envAliases[key]...) {
+		if val, ok = os.LookupEnv(name); ok {
+			return
+		}
+	}
+	return "", "", false
+}
+
+// applyEnv overrides settings in c with any environment variables that are
+// set. Only settings with a single value can be overridden, setting the
+// variable for any other setting is an error. The names of the variables that
+// were applied are returned by toml key.
+func applyEnv(c *Config) (applied map[string]string, err error) {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	applied = make(map[string]string)
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("toml")
+		if key == "" {
+			continue
+		}
+		val, name, ok := lookupEnv(key)
+		if !ok {
+			continue
+		}
+		if err = setField(v.Field(i), val); err != nil {
+			return nil, fmt.Errorf("config.applyEnv: %s: %w", name, err)
+		}
+		applied[key] = name
+	}
+
+	return
+}
+
+// applyEnvListener applies the environment variables for the socket settings,
+// which were applied by applyEnv, to the listener configured with a
+// [[listener]] table. The socket and group can't be overridden if there are
+// several listeners, while socket_mode is then only the default for them.
+func (c *Config) applyEnvListener(env map[string]string) error {
+	if len(c.Listeners) > 1 {
+		for _, key := range []string{"socket", "group"} {
+			if name, ok := env[key]; ok {
+				return fmt.Errorf("%s can't be set with %d [[listener]] tables in the config file", name, len(c.Listeners))
+			}
+		}
+		return nil
+	}
+
+	l := &c.Listeners[0]
+	if _, ok := env["socket"]; ok {
+		l.Socket = c.Socket
+		l.Address = ""
+	}
+	if _, ok := env["group"]; ok {
+		l.Group = c.OwnerGroup
+	}
+	if _, ok := env["socket_mode"]; ok {
+		l.Mode = c.SocketMode
+	}
+
+	return nil
+}
+
+// applyEnvDevice applies the environment variables for the device settings,
+// which were applied by applyEnv, to the device configured with a [[device]]
+// table. The device settings can't be overridden if there are several devices,
+// while source_tag is then only the default for them.
+func (c *Config) applyEnvDevice(env map[string]string) error {
+	if len(c.Devices) > 1 {
+		for _, key := range []string{"device_driver", "device_path", "device_baud_rate"} {
+			if name, ok := env[key]; ok {
+				return fmt.Errorf("%s can't be set with %d [[device]] tables in the config file", name, len(c.Devices))
+			}
+		}
+		return nil
+	}
+
+	d := &c.Devices[0]
+	if _, ok := env["device_driver"]; ok {
+		d.Driver = c.Driver
+	}
+	if _, ok := env["device_path"]; ok {
+		d.Path = c.DevicePath
+	}
+	if _, ok := env["device_baud_rate"]; ok {
+		d.BaudRate = c.BaudRate
+	}
+	if _, ok := env["source_tag"]; ok {
+		d.SourceTag = c.SourceTag
+	}
+
+	return nil
+}
+
+// setField sets f to val parsed as the type of f, or returns an error if f can't
+// be set from a string
+func setField(f reflect.Value, val string) (err error) {
+	switch f.Addr().Interface().(type) {
+	case *BaudRate:
+		var baud int
+		baud, err = ParseBaudRate(val)
+		f.SetInt(int64(baud))
+	case *FileMode:
+		err = f.Addr().Interface().(*FileMode).UnmarshalTOML(val)
+	case *time.Duration:
+		var d time.Duration
+		d, err = time.ParseDuration(val)
+		f.SetInt(int64(d))
+	case *string:
+		f.SetString(val)
+	case *bool:
+		var b bool
+		b, err = strconv.ParseBool(val)
+		f.SetBool(b)
+	case *int:
+		var i int
+		i, err = strconv.Atoi(val)
+		f.SetInt(int64(i))
+	case *float64:
+		var fl float64
+		fl, err = strconv.ParseFloat(val, 64)
+		f.SetFloat(fl)
+	default:
+		// e.g. listeners, which can only be set in the config file
+		err = fmt.Errorf("setting is not supported, it can only be set in the config file")
+	}
+
+	return
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package config
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Test overriding settings with environment variables
+func TestApplyEnv(t *testing.T) {
+	tables := []struct {
+		name     string
+		val      string
+		expected Config
+		err      bool
+	}{
+		{"GNSS_SHARE_DEVICE_PATH", "/dev/ttyUSB0", Config{DevicePath: "/dev/ttyUSB0"}, false},
+		{"GNSS_SHARE_DEVICE_BAUD_RATE", "9600", Config{BaudRate: 9600}, false},
+		{"GNSS_SHARE_DEVICE_BAUD_RATE", "auto", Config{}, false},
+		{"GNSS_SHARE_DEVICE_BAUD_RATE", "fast", Config{}, true},
+		{"GNSS_SHARE_BAUD_RATE", "4800", Config{BaudRate: 4800}, false},
+		{"GNSS_SHARE_BAUD_RATE", "fast", Config{}, true},
+		{"GNSS_SHARE_SOCKET_MODE", "0600", Config{SocketMode: 0600}, false},
+		{"GNSS_SHARE_SOCKET_MODE", "rw", Config{}, true},
+		{"GNSS_SHARE_AGPS_TIMEOUT", "90s", Config{AgpsTimeout: 90 * time.Second}, false},
+		{"GNSS_SHARE_AGPS_TIMEOUT", "90", Config{}, true},
+		{"GNSS_SHARE_KEEP_ALIVE", "true", Config{KeepAlive: true}, false},
+		{"GNSS_SHARE_KEEP_ALIVE", "maybe", Config{}, true},
+		{"GNSS_SHARE_READY_RETRIES", "3", Config{ReadyRetries: 3}, false},
+		{"GNSS_SHARE_READY_RETRIES", "three", Config{}, true},
+		{"GNSS_SHARE_MAX_FIX_RATE_HZ", "0.5", Config{MaxFixRate: 0.5}, false},
+		{"GNSS_SHARE_MAX_FIX_RATE_HZ", "half", Config{}, true},
+		// settings with several values can only be set in the config file
+		{"GNSS_SHARE_TCP_ALLOWED", "127.0.0.1", Config{}, true},
+		{"GNSS_SHARE_ALLOWED_UIDS", "0", Config{}, true},
+		{"GNSS_SHARE_LISTENER", "/tmp/gnss-share.sock", Config{}, true},
+	}
+
+	for _, table := range tables {
+		os.Setenv(table.name, table.val)
+		c := Config{}
+		_, err := applyEnv(&c)
+		os.Unsetenv(table.name)
+
+		if got := err != nil; got != table.err {
+			t.Errorf("%s=%q: expected error: %t, got: %v", table.name, table.val, table.err, err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(c, table.expected) {
+			t.Errorf("%s=%q: expected: %+v, got: %+v", table.name, table.val, table.expected, c)
+		}
+	}
+}
+
+// Test that the variable named after a setting takes precedence over its alias
+func TestApplyEnvAlias(t *testing.T) {
+	t.Setenv("GNSS_SHARE_BAUD_RATE", "4800")
+	t.Setenv("GNSS_SHARE_DEVICE_BAUD_RATE", "9600")
+
+	c := Config{}
+	applied, err := applyEnv(&c)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if c.BaudRate != 9600 {
+		t.Errorf("expected baud rate: 9600, got: %d", c.BaudRate)
+	}
+	if name := applied["device_baud_rate"]; name != "GNSS_SHARE_DEVICE_BAUD_RATE" {
+		t.Errorf("expected GNSS_SHARE_DEVICE_BAUD_RATE to be applied, got: %q", name)
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// SystemFile is the config file used by the system service
+const SystemFile = "/etc/gnss-share.conf"
+
+// DefaultFile returns the config file to use when none was given. This is
+// SystemFile if it exists, otherwise the first one of
+// $XDG_CONFIG_HOME/gnss-share/config.toml and ~/.config/gnss-share/config.toml
+// that exists, so that users can run it in their own session. SystemFile is
+// returned if none of them exist.
+func DefaultFile() string {
+	for _, file := range defaultFiles() {
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+	}
+
+	return SystemFile
+}
+
+// defaultFiles returns the config files that are tried when none was given,
+// in order of preference
+func defaultFiles() (files []string) {
+	files = append(files, SystemFile)
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		files = append(files, filepath.Join(dir, "gnss-share", "config.toml"))
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".config", "gnss-share", "config.toml"))
+	}
+
+	return
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package gnss
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/tarm/serial"
+	"gitlab.com/postmarketOS/gnss-share/internal/nmea"
+)
+
+// Baud rates to try, in order, when detecting the baud rate of a device
+var baudRates = []int{4800, 9600, 19200, 38400, 57600, 115200}
+
+const (
+	// Number of valid NMEA sentences that must be read before a baud rate
+	// is considered to be the correct one
+	baudProbeSentences = 3
+	// How long to try reading sentences at each baud rate
+	baudProbeWindow = 3 * time.Second
+)
+
+// DetectBaudRate tries to read valid NMEA sentences from the serial device at
+// the given path using common baud rates, and returns the first baud rate that
+// works.
+func DetectBaudRate(path string) (baud int, err error) {
+	for _, b := range baudRates {
+		var ok bool
+		ok, err = probeBaudRate(path, b)
+		if err != nil {
+			err = fmt.Errorf("gnss.DetectBaudRate: %w", err)
+			return
+		}
+		if ok {
+			baud = b
+			return
+		}
+	}
+
+	err = fmt.Errorf("gnss.DetectBaudRate: %w: no valid NMEA sentences received at any baud rate: %v", ErrDeviceNotReady, baudRates)
+	return
+}
+
+func probeBaudRate(path string, baud int) (ok bool, err error) {
+	port, err := serial.OpenPort(&serial.Config{
+		Name:        path,
+		Baud:        baud,
+		ReadTimeout: 500 * time.Millisecond,
+	})
+	if err != nil {
+		return
+	}
+	defer port.Close()
+
+	reader := bufio.NewReader(port)
+	deadline := time.Now().Add(baudProbeWindow)
+	valid := 0
+	var partial string
+	for time.Now().Before(deadline) {
+		line, rerr := reader.ReadString('\n')
+		if rerr == io.EOF {
+			// read timed out, keep whatever was read so far
+			partial += line
+			continue
+		} else if rerr != nil {
+			err = rerr
+			return
+		}
+		line = partial + line
+		partial = ""
+
+		if _, perr := nmea.Parse(line); perr == nil {
+			valid++
+		}
+		if valid >= baudProbeSentences {
+			ok = true
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package gnss
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// CompressedExt is appended to the names of AGPS data files that are stored
+// gzip-compressed, see AgpsCache.Compress
+const CompressedExt = ".gz"
+
+// cacheFile is an AGPS data file, with a reader or writer that compresses or
+// decompresses it if needed
+type cacheFile struct {
+	fd *os.File
+	r  io.Reader
+	w  io.WriteCloser
+}
+
+func (f *cacheFile) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+func (f *cacheFile) Write(p []byte) (int, error) {
+	return f.w.Write(p)
+}
+
+// Close flushes the compressed data, if the file was created compressed, and
+// closes the file
+func (f *cacheFile) Close() (err error) {
+	if f.w != nil {
+		err = f.w.Close()
+	}
+	if cerr := f.fd.Close(); err == nil {
+		err = cerr
+	}
+	return
+}
+
+// createCacheFile creates the AGPS data file at path, which is written
+// gzip-compressed if compress is set
+func createCacheFile(path string, compress bool) (io.WriteCloser, error) {
+	fd, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &cacheFile{fd: fd}
+	if compress {
+		f.w = gzip.NewWriter(fd)
+	} else {
+		f.w = nopWriteCloser{fd}
+	}
+	return f, nil
+}
+
+// openCacheFile opens the AGPS data file at path for reading, and decompresses
+// it if it is gzip-compressed. The format is detected from the contents, so
+// that files are read correctly regardless of their name.
+func openCacheFile(path string) (io.ReadCloser, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(fd)
+	f := &cacheFile{fd: fd, r: br}
+	// gzip magic bytes
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+		f.r = gz
+	}
+	return f, nil
+}
+
+// existingCacheFile returns path if it exists, otherwise the same path with or
+// without CompressedExt if that exists, so that data stored before
+// compression was enabled or disabled is still loaded. path is returned if
+// neither exists.
+func existingCacheFile(path string) string {
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		return path
+	}
+
+	alt := path + CompressedExt
+	if strings.HasSuffix(path, CompressedExt) {
+		alt = strings.TrimSuffix(path, CompressedExt)
+	}
+	if _, err := os.Stat(alt); err == nil {
+		return alt
+	}
+	return path
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
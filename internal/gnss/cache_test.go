@@ -0,0 +1,40 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package gnss
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test that data stored plain or compressed is found either way
+func TestExistingCacheFile(t *testing.T) {
+	tables := []struct {
+		existing []string
+		path     string
+		expected string
+	}{
+		{[]string{"ephemeris.txt"}, "ephemeris.txt", "ephemeris.txt"},
+		{[]string{"ephemeris.txt"}, "ephemeris.txt.gz", "ephemeris.txt"},
+		{[]string{"ephemeris.txt.gz"}, "ephemeris.txt", "ephemeris.txt.gz"},
+		{[]string{"ephemeris.txt", "ephemeris.txt.gz"}, "ephemeris.txt.gz", "ephemeris.txt.gz"},
+		{[]string{"ephemeris.txt", "ephemeris.txt.gz"}, "ephemeris.txt", "ephemeris.txt"},
+		{nil, "ephemeris.txt.gz", "ephemeris.txt.gz"},
+	}
+
+	for _, table := range tables {
+		dir := t.TempDir()
+		for _, name := range table.existing {
+			if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+				t.Fatalf("unable to write file: %s", err)
+			}
+		}
+
+		got := existingCacheFile(filepath.Join(dir, table.path))
+		if got != filepath.Join(dir, table.expected) {
+			t.Errorf("%q, %q expected: %q, got: %q", table.existing, table.path, table.expected, filepath.Base(got))
+		}
+	}
+}
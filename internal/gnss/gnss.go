@@ -3,14 +3,227 @@
 
 package gnss
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// ErrDisconnected is returned by GnssDriver.Start if the device is not present,
+// e.g. because it was unplugged
+var ErrDisconnected = errors.New("device disconnected")
+
+// Errors returned by drivers, wrapped with more details about what failed.
+// They can be checked with errors.Is.
+var (
+	// The device was opened, but did not send what was expected in time,
+	// e.g. because it is still booting or the baud rate is wrong
+	ErrDeviceNotReady = errors.New("device not ready")
+	// The device is already opened by another process
+	ErrDeviceBusy = errors.New("device busy")
+	// The module did not respond to a command in time
+	ErrTimeout = errors.New("timed out")
+	// The module rejected setting or getting a configuration parameter
+	ErrParamSet = errors.New("error setting parameter")
+	ErrParamGet = errors.New("error getting parameter")
+	// The driver does not support the operation, e.g. because the device
+	// has no way to do it
+	ErrUnsupported = errors.New("not supported by the driver")
+	// The device was opened read-only, since the user is not allowed to
+	// write to it, so commands can't be sent to it
+	ErrReadOnly = errors.New("device is opened read-only")
+	// The device is not open, e.g. because it is only opened while clients
+	// are connected
+	ErrNotOpen = errors.New("device is not open")
+	// There is no AGPS data of any type stored to load
+	ErrNoAgpsData = errors.New("no AGPS data stored")
+)
+
+// Names of the files in the AGPS data directory used to store ephemeris and
+// almanac data
+const (
+	EphemerisFile = "ephemeris.txt"
+	AlmanacFile   = "almanac.txt"
+)
+
+// AgpsCache describes where AGPS data is stored, and how old the data can be
+// before it is considered stale and should not be loaded.
+type AgpsCache struct {
+	Dir string
+	// Names of the files in Dir, EphemerisFile and AlmanacFile are used if
+	// these are empty
+	EphemerisName   string
+	AlmanacName     string
+	EphemerisMaxAge time.Duration
+	AlmanacMaxAge   time.Duration
+	// Store the data gzip-compressed, in files named with CompressedExt
+	// appended. Plain and compressed files can be loaded either way.
+	Compress bool
+}
+
+// EphemerisPath returns the path of the file ephemeris data is stored in
+func (c AgpsCache) EphemerisPath() string {
+	if c.EphemerisName == "" {
+		return c.path(EphemerisFile)
+	}
+	return c.path(c.EphemerisName)
+}
+
+// AlmanacPath returns the path of the file almanac data is stored in
+func (c AgpsCache) AlmanacPath() string {
+	if c.AlmanacName == "" {
+		return c.path(AlmanacFile)
+	}
+	return c.path(c.AlmanacName)
+}
+
+func (c AgpsCache) path(name string) string {
+	if c.Compress {
+		name += CompressedExt
+	}
+	return filepath.Join(c.Dir, name)
+}
+
 type GnssDriver interface {
-	Load(dir string) (err error)
-	Save(dir string) (err error)
+	// Load AGPS data from the cache into the device. Stale data is skipped,
+	// unless force is set, and so is data that is not stored. ErrNoAgpsData
+	// is returned if there is no data at all.
+	Load(cache AgpsCache, force bool) (err error)
+	Save(cache AgpsCache) (err error)
 
-	Start(sendCh chan<- []byte, stop <-chan bool, errCh chan<- error)
+	// Start streams NMEA sentences from the device to sendCh until ctx is
+	// cancelled, or an error occurs. ErrDisconnected is returned if the
+	// device is gone.
+	Start(ctx context.Context, sendCh chan<- []byte) (err error)
+	// WriteRaw writes data to the device as-is, e.g. RTCM correction data,
+	// while it is running.
+	WriteRaw(data []byte) (err error)
+	// WriteCommand sends a NMEA command to the device, and returns the
+	// response from the device.
+	WriteCommand(cmd []byte) (out []string, err error)
 }
 
 type GnssLine struct {
 	Line  []byte
 	Error error
 }
+
+// isFresh returns true if the file at the given path was modified within
+// maxAge. A maxAge of 0 means that the file is always considered fresh.
+func isFresh(path string, maxAge time.Duration) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	return maxAge == 0 || time.Since(info.ModTime()) <= maxAge, nil
+}
+
+// openError wraps err, from opening the device, with ErrDeviceBusy if the
+// device is opened by another process
+func openError(err error) error {
+	if errors.Is(err, syscall.EBUSY) {
+		return fmt.Errorf("%w: %s", ErrDeviceBusy, err)
+	}
+	return err
+}
+
+// isPermission returns true if err, from opening the device, means that the
+// user is not allowed to open it for writing
+func isPermission(err error) bool {
+	return errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EROFS)
+}
+
+// isDisconnect returns true if err, from opening or reading the device at path,
+// indicates that the device is no longer present
+func isDisconnect(path string, err error) bool {
+	if errors.Is(err, syscall.ENODEV) || errors.Is(err, syscall.EIO) || errors.Is(err, syscall.ENXIO) {
+		return true
+	}
+
+	// reads from an unplugged device may just return EOF, but then the
+	// device node is gone too
+	if _, serr := os.Stat(path); errors.Is(serr, os.ErrNotExist) {
+		return true
+	}
+
+	return false
+}
+
+const (
+	// How many times in a row to retry a read that failed with a transient
+	// error, and how long to wait before each retry
+	transientRetries    = 10
+	transientRetryDelay = 50 * time.Millisecond
+)
+
+// retryReader retries reads that fail with a transient error, e.g. EINTR when
+// the read is interrupted by a signal, so that a scanner reading from it does
+// not stop. Other errors, e.g. ENODEV, are returned as-is.
+type retryReader struct {
+	r io.Reader
+}
+
+func (r retryReader) Read(p []byte) (n int, err error) {
+	for i := 0; ; i++ {
+		n, err = r.r.Read(p)
+		if !isTransient(err) {
+			return
+		}
+		if n > 0 {
+			return n, nil
+		}
+		if i >= transientRetries {
+			return
+		}
+		time.Sleep(transientRetryDelay)
+	}
+}
+
+// isTransient returns true if err, from reading the device, is likely to go
+// away when retrying the read
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN)
+}
+
+// How long each read from a serial port waits for data, so that a read that
+// is in progress returns soon after the port is closed
+const serialReadTimeout = 500 * time.Millisecond
+
+// timeoutReader reads from a serial port opened with serialReadTimeout, which
+// returns io.EOF from reads that receive nothing in time. These reads are
+// retried, so that a scanner reading from it does not stop, until the device
+// at path is gone.
+type timeoutReader struct {
+	r    io.Reader
+	path string
+}
+
+func (r timeoutReader) Read(p []byte) (n int, err error) {
+	for {
+		start := time.Now()
+		n, err = r.r.Read(p)
+		if n > 0 || err != io.EOF || isDisconnect(r.path, err) {
+			return
+		}
+		// reads from a port that was hung up return right away, don't
+		// spin until the device node is removed
+		if time.Since(start) < serialReadTimeout/2 {
+			time.Sleep(serialReadTimeout)
+		}
+	}
+}
+
+// serialTransport returns the reader/writer for a serial port opened with
+// serialReadTimeout, see timeoutReader
+func serialTransport(port io.ReadWriter, path string) io.ReadWriter {
+	return struct {
+		io.Reader
+		io.Writer
+	}{timeoutReader{r: port, path: path}, port}
+}
@@ -0,0 +1,224 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package gnss
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tarm/serial"
+	"gitlab.com/postmarketOS/gnss-share/internal/config"
+	"gitlab.com/postmarketOS/gnss-share/internal/nmea"
+)
+
+func init() {
+	Register("nmea_serial", func(conf *config.Config) GnssDriver {
+		s := NewNmeaSerial(conf.DevicePath, int(conf.BaudRate))
+		s.SetReadyWait(conf.ReadyTimeout, conf.ReadyRetries)
+		s.SetMaxLineLength(conf.MaxLineLength)
+		return s
+	})
+}
+
+// NmeaSerial is a generic GNSS receiver on a serial port, which only sends NMEA
+// sentences. It does not support any commands, so AGPS data can't be loaded or
+// saved. Only valid sentences received from it are sent to clients.
+type NmeaSerial struct {
+	path    string
+	serConf serial.Config
+	// the baud rate is detected each time the device is opened
+	autoBaud bool
+	// how long to wait for a valid sentence after opening the device, and
+	// how many times to reopen it if none is received
+	readyTimeout  time.Duration
+	readyRetries  int
+	maxLineLength int
+
+	// mu protects port, which is set while the device is open
+	mu   sync.Mutex
+	port *serial.Port
+	// writeMu is held while writing to the device
+	writeMu sync.Mutex
+}
+
+// NewNmeaSerial creates a new NmeaSerial for the device at the given path. If
+// baud is 0, the baud rate is detected automatically when the device is opened.
+func NewNmeaSerial(path string, baud int) *NmeaSerial {
+	return &NmeaSerial{
+		path: path,
+		serConf: serial.Config{
+			Name:        path,
+			Baud:        baud,
+			ReadTimeout: serialReadTimeout,
+		},
+		autoBaud: baud == 0,
+	}
+}
+
+// SetReadyWait sets how long to wait for a valid sentence each time the device
+// is opened, and how many more times to try opening it if none is received. The
+// default timeout is used if timeout is 0.
+func (n *NmeaSerial) SetReadyWait(timeout time.Duration, retries int) {
+	n.readyTimeout = timeout
+	n.readyRetries = retries
+}
+
+// SetMaxLineLength sets the length of the longest line that is read from the
+// device, longer lines are skipped. The default is used if max is 0.
+func (n *NmeaSerial) SetMaxLineLength(max int) {
+	n.maxLineLength = max
+}
+
+func (n *NmeaSerial) Load(cache AgpsCache, force bool) (err error) {
+	return fmt.Errorf("gnss/NmeaSerial.Load: loading AGPS data is %w", ErrUnsupported)
+}
+
+func (n *NmeaSerial) Save(cache AgpsCache) (err error) {
+	return fmt.Errorf("gnss/NmeaSerial.Save: saving AGPS data is %w", ErrUnsupported)
+}
+
+// WriteRaw writes data to the device as-is, e.g. RTCM correction data. The
+// device must already be open by Start, otherwise ErrNotOpen is returned.
+func (n *NmeaSerial) WriteRaw(data []byte) (err error) {
+	n.mu.Lock()
+	port := n.port
+	n.mu.Unlock()
+
+	if port == nil {
+		return fmt.Errorf("gnss/NmeaSerial.WriteRaw: %w", ErrNotOpen)
+	}
+
+	n.writeMu.Lock()
+	defer n.writeMu.Unlock()
+	if err = writeAll(port, data); err != nil {
+		err = fmt.Errorf("gnss/NmeaSerial.WriteRaw: %w", err)
+	}
+
+	return
+}
+
+func (n *NmeaSerial) WriteCommand(cmd []byte) (out []string, err error) {
+	err = fmt.Errorf("gnss/NmeaSerial.WriteCommand: commands are %w", ErrUnsupported)
+	return
+}
+
+func (n *NmeaSerial) Start(ctx context.Context, sendCh chan<- []byte) (err error) {
+	reader, err := n.open()
+	if err != nil {
+		if isDisconnect(n.path, err) {
+			return fmt.Errorf("gnss/NmeaSerial.Start: %w: %s", ErrDisconnected, err)
+		}
+		return fmt.Errorf("gnss/NmeaSerial.Start: %w", err)
+	}
+	defer n.close()
+
+	return n.stream(ctx, reader, sendCh)
+}
+
+// stream sends the valid sentences read by reader to sendCh, until ctx is
+// cancelled or reading fails. ctx is checked even if nothing is received.
+func (n *NmeaSerial) stream(ctx context.Context, reader *lineReader, sendCh chan<- []byte) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		line, err := reader.readline(time.Now().Add(streamReadTimeout))
+		if errors.Is(err, ErrTimeout) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err == io.EOF || isDisconnect(n.path, err) {
+				return fmt.Errorf("gnss/NmeaSerial.Start: %w: %s", ErrDisconnected, err)
+			}
+			return fmt.Errorf("gnss/NmeaSerial.Start: %w", err)
+		}
+		if _, err := nmea.Parse(line); err != nil {
+			continue
+		}
+
+		select {
+		case sendCh <- []byte(line):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// open opens the device, and returns a reader for lines from it once a valid
+// sentence has been received
+func (n *NmeaSerial) open() (reader *lineReader, err error) {
+	timeout := n.readyTimeout
+	if timeout == 0 {
+		timeout = defaultReadyTimeout
+	}
+
+	for attempt := 0; ; attempt++ {
+		if n.autoBaud {
+			if n.serConf.Baud, err = DetectBaudRate(n.path); err != nil {
+				return nil, err
+			}
+			fmt.Printf("Detected baud rate for %q: %d\n", n.path, n.serConf.Baud)
+		}
+
+		port, err := serial.OpenPort(&n.serConf)
+		if err != nil {
+			return nil, openError(err)
+		}
+
+		reader = newLineReader(newLineScanner(serialTransport(port, n.path), n.maxLineLength))
+		if err = waitForSentence(reader, timeout); err == nil {
+			n.mu.Lock()
+			n.port = port
+			n.mu.Unlock()
+			return reader, nil
+		}
+		port.Close()
+
+		if attempt >= n.readyRetries {
+			return nil, fmt.Errorf("device not ready after %d attempt(s): %w", attempt+1, err)
+		}
+		fmt.Printf("Device %q not ready, retrying: %s\n", n.path, err)
+		time.Sleep(readyRetryDelay)
+	}
+}
+
+func (n *NmeaSerial) close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.port != nil {
+		n.port.Close()
+		n.port = nil
+	}
+}
+
+// waitForSentence reads lines until a valid NMEA sentence is received, and
+// returns an error if none is received within timeout, or reading fails
+func waitForSentence(reader *lineReader, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		line, err := reader.readline(deadline)
+		if errors.Is(err, ErrTimeout) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := nmea.Parse(line); err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: no valid NMEA sentences received within %s", ErrDeviceNotReady, timeout)
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package gnss
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Test waiting for the first valid sentence, which is checked until the timeout
+// even if the device sends nothing
+func TestWaitForSentence(t *testing.T) {
+	tables := []struct {
+		name     string
+		lines    []string
+		stalled  bool
+		expected error
+	}{
+		{"valid", []string{"garbage", sentence("GPGGA")}, false, nil},
+		{"closed", []string{"garbage", "$GPGGA,*00"}, false, io.EOF},
+		{"stalled", nil, true, ErrDeviceNotReady},
+	}
+
+	for _, table := range tables {
+		module := &fakeModule{}
+		for _, l := range table.lines {
+			module.out.WriteString(l + "\r\n")
+		}
+		if table.stalled {
+			module.stalled = make(chan struct{})
+		}
+
+		start := time.Now()
+		err := waitForSentence(newLineReader(newLineScanner(module, 0)), 50*time.Millisecond)
+		if !errors.Is(err, table.expected) {
+			t.Errorf("%s: expected error: %v, got: %v", table.name, table.expected, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: expected to time out after 50ms, took: %s", table.name, elapsed)
+		}
+		if module.stalled != nil {
+			close(module.stalled)
+		}
+	}
+}
+
+// Test that only valid sentences are streamed, and how errors reading from the
+// device are returned
+func TestNmeaSerialStream(t *testing.T) {
+	present := filepath.Join(t.TempDir(), "ttyUSB0")
+	if err := os.WriteFile(present, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	gga := sentence("GPGGA")
+
+	tables := []struct {
+		name     string
+		path     string
+		reads    []scriptedRead
+		expected []string
+		err      error
+	}{
+		{"closed", present, []scriptedRead{{"garbage\r\n" + gga + "\r\n", nil}, {"", io.EOF}}, []string{gga}, ErrDisconnected},
+		{"unplugged", present, []scriptedRead{{gga + "\r\n", nil}}, []string{gga}, ErrDisconnected},
+		{"gone", present + ".gone", []scriptedRead{{gga + "\r\n", nil}, {"", syscall.EINVAL}}, []string{gga}, ErrDisconnected},
+		{"error", present, []scriptedRead{{gga + "\r\n", nil}, {"", syscall.EINVAL}}, []string{gga}, syscall.EINVAL},
+	}
+
+	for _, table := range tables {
+		n := NewNmeaSerial(table.path, 9600)
+		reader := newLineReader(newLineScanner(&scriptedReader{reads: table.reads}, 0))
+		sendCh := make(chan []byte, len(table.expected)+1)
+
+		err := n.stream(context.Background(), reader, sendCh)
+		if !errors.Is(err, table.err) {
+			t.Errorf("%s: expected error: %v, got: %v", table.name, table.err, err)
+		}
+		if table.err != ErrDisconnected && errors.Is(err, ErrDisconnected) {
+			t.Errorf("%s: unexpected error: %v", table.name, err)
+		}
+		close(sendCh)
+		var out []string
+		for line := range sendCh {
+			out = append(out, string(line))
+		}
+		if strings.Join(out, "\n") != strings.Join(table.expected, "\n") {
+			t.Errorf("%s: expected: %q, got: %q", table.name, table.expected, out)
+		}
+	}
+}
+
+// Test that streaming stops when cancelled, even if the device sends nothing
+func TestNmeaSerialStreamCancel(t *testing.T) {
+	module := &fakeModule{stalled: make(chan struct{})}
+	defer close(module.stalled)
+	n := NewNmeaSerial("/dev/null", 9600)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := n.stream(ctx, newLineReader(newLineScanner(module, 0)), make(chan []byte)); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*streamReadTimeout {
+		t.Errorf("expected to stop after 50ms, took: %s", elapsed)
+	}
+}
+
+// Test that operations that need commands fail with ErrUnsupported
+func TestNmeaSerialUnsupported(t *testing.T) {
+	n := NewNmeaSerial("/dev/null", 9600)
+	_, cmdErr := n.WriteCommand([]byte(sentence("PSTMGPSSUSPEND")))
+
+	tables := []struct {
+		name string
+		err  error
+	}{
+		{"Load", n.Load(AgpsCache{Dir: t.TempDir()}, false)},
+		{"Save", n.Save(AgpsCache{Dir: t.TempDir()})},
+		{"WriteCommand", cmdErr},
+	}
+
+	for _, table := range tables {
+		if !errors.Is(table.err, ErrUnsupported) {
+			t.Errorf("%s: expected error: %v, got: %v", table.name, ErrUnsupported, table.err)
+		}
+	}
+
+	if err := n.WriteRaw([]byte("data")); err == nil {
+		t.Errorf("WriteRaw: expected error when the device is not open")
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package gnss
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// ConfigBlock is a configuration data block of the module. Each block has its
+// own copy of every CDB-ID, and the block is selected by the leading digit of
+// the parameter ID in PSTMGETPAR and PSTMSETPAR, e.g. 1201 is CDB-ID 201 in
+// the current configuration. CDB-IDs have up to three digits, so parameter IDs
+// 1000-1999 are in BlockCurrent, 2000-2999 in BlockDefault and 3000-3999 in
+// BlockNVM. Reading a parameter uses the block of its ID, while setting one
+// with PSTMSETPAR changes BlockCurrent for IDs 1000-1999, and BlockNVM for IDs
+// 3000-3999, which is only used once saved with PSTMSAVEPAR and the module is
+// reset.
+type ConfigBlock int
+
+const (
+	// The configuration currently used by the module. Changes are lost when
+	// the module is reset, unless they are saved with PSTMSAVEPAR.
+	BlockCurrent ConfigBlock = 1
+	// The factory default configuration, which can only be read
+	BlockDefault ConfigBlock = 2
+	// The configuration stored in NVM, which is used after the module is
+	// reset
+	BlockNVM ConfigBlock = 3
+)
+
+// ID returns the parameter ID for the CDB-ID in this block
+func (b ConfigBlock) ID(cdbId int) int {
+	return int(b)*1000 + cdbId
+}
+
+// ParamValue is the value of a configuration parameter, as returned by the
+// module. The module may return values as decimal or hex integers, as well as
+// decimal numbers that can be negative, fractional or in scientific notation,
+// so methods are provided for converting the value to the expected type.
+type ParamValue struct {
+	// Raw is the value exactly as it was returned by the module
+	Raw string
+	num *big.Float
+}
+
+func parseParamValue(raw string) (v ParamValue, err error) {
+	v.Raw = raw
+
+	str := strings.TrimSpace(raw)
+	neg := strings.HasPrefix(str, "-")
+	digits := strings.TrimPrefix(strings.TrimPrefix(str, "-"), "+")
+
+	if strings.HasPrefix(digits, "0x") || strings.HasPrefix(digits, "0X") {
+		i, ok := new(big.Int).SetString(digits[2:], 16)
+		if !ok {
+			err = fmt.Errorf("gnss.parseParamValue: invalid hex value: %q", raw)
+			return
+		}
+		if neg {
+			i.Neg(i)
+		}
+		v.num = new(big.Float).SetInt(i)
+		return
+	}
+
+	v.num, _, err = big.ParseFloat(str, 10, 0, big.ToNearestEven)
+	if err != nil {
+		err = fmt.Errorf("gnss.parseParamValue: invalid value: %q: %w", raw, err)
+	}
+
+	return
+}
+
+func (v ParamValue) String() string {
+	return v.Raw
+}
+
+// Uint64 returns the value as an unsigned integer. An error is returned if the
+// value is negative, fractional, or does not fit in a uint64.
+func (v ParamValue) Uint64() (uint64, error) {
+	if v.num.Sign() < 0 {
+		return 0, fmt.Errorf("gnss.ParamValue: value is negative: %q", v.Raw)
+	}
+	if !v.num.IsInt() {
+		return 0, fmt.Errorf("gnss.ParamValue: value is not an integer: %q", v.Raw)
+	}
+	u, acc := v.num.Uint64()
+	if acc != big.Exact {
+		return 0, fmt.Errorf("gnss.ParamValue: value does not fit in uint64: %q", v.Raw)
+	}
+
+	return u, nil
+}
+
+// Int64 returns the value as a signed integer. An error is returned if the
+// value is fractional, or does not fit in an int64.
+func (v ParamValue) Int64() (int64, error) {
+	if !v.num.IsInt() {
+		return 0, fmt.Errorf("gnss.ParamValue: value is not an integer: %q", v.Raw)
+	}
+	i, acc := v.num.Int64()
+	if acc != big.Exact {
+		return 0, fmt.Errorf("gnss.ParamValue: value does not fit in int64: %q", v.Raw)
+	}
+
+	return i, nil
+}
+
+// Float64 returns the value as a float, which may be an approximation of the
+// value returned by the module.
+func (v ParamValue) Float64() float64 {
+	f, _ := v.num.Float64()
+	return f
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package gnss
+
+import (
+	"testing"
+)
+
+// Test parsing parameter values in the formats returned by the module
+func TestParseParamValue(t *testing.T) {
+	tables := []struct {
+		in          string
+		expectErr   bool
+		uint64Ok    bool
+		uint64Value uint64
+		int64Ok     bool
+		int64Value  int64
+		float64     float64
+	}{
+		{"42", false, true, 42, true, 42, 42},
+		{"010", false, true, 10, true, 10, 10},
+		{"0x0000001F", false, true, 31, true, 31, 31},
+		{"0XFF", false, true, 255, true, 255, 255},
+		{"1.5e+01", false, true, 15, true, 15, 15},
+		{"1.500000e+00", false, false, 0, false, 0, 1.5},
+		{"-3", false, false, 0, true, -3, -3},
+		{"-0x10", false, false, 0, true, -16, -16},
+		{"-2.5", false, false, 0, false, 0, -2.5},
+		{"18446744073709551615", false, true, 18446744073709551615, false, 0, 18446744073709551615},
+		{"", true, false, 0, false, 0, 0},
+		{"0xZZ", true, false, 0, false, 0, 0},
+		{"abc", true, false, 0, false, 0, 0},
+	}
+
+	for _, table := range tables {
+		v, err := parseParamValue(table.in)
+		if table.expectErr {
+			if err == nil {
+				t.Errorf("%q expected error", table.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q unexpected error: %s", table.in, err)
+			continue
+		}
+		if v.Raw != table.in {
+			t.Errorf("%q expected raw value to be kept, got: %q", table.in, v.Raw)
+		}
+
+		u, err := v.Uint64()
+		if (err == nil) != table.uint64Ok || u != table.uint64Value {
+			t.Errorf("%q Uint64() expected: %d (ok: %t), got: %d (err: %v)", table.in, table.uint64Value, table.uint64Ok, u, err)
+		}
+		i, err := v.Int64()
+		if (err == nil) != table.int64Ok || i != table.int64Value {
+			t.Errorf("%q Int64() expected: %d (ok: %t), got: %d (err: %v)", table.in, table.int64Value, table.int64Ok, i, err)
+		}
+		if f := v.Float64(); f != table.float64 {
+			t.Errorf("%q Float64() expected: %f, got: %f", table.in, table.float64, f)
+		}
+	}
+}
+
+// Test finding the parameter value in the module response to PSTMGETPAR
+func TestParseGetParamResponse(t *testing.T) {
+	tables := []struct {
+		cdbId     int
+		in        []string
+		expected  string
+		expectErr bool
+	}{
+		{201, []string{"$GPGGA,,,,,,0,00,99.0,,,,,,*66", "$PSTMSETPAR,201,0x00000041*2A"}, "0x00000041", false},
+		{303, []string{"$PSTMSETPAR,303,1.000000e+00*03"}, "1.000000e+00", false},
+		{201, []string{"$PSTMGETPARERROR*58"}, "", true},
+		{201, []string{"$PSTMSETPAR,201*3E"}, "", true},
+		{201, []string{"$PSTMSETPAR,200,0x1*3E"}, "", true},
+		{201, []string{}, "", true},
+	}
+
+	for _, table := range tables {
+		v, err := parseGetParamResponse(table.cdbId, table.in)
+		if table.expectErr {
+			if err == nil {
+				t.Errorf("%d, %q expected error, got: %q", table.cdbId, table.in, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d, %q unexpected error: %s", table.cdbId, table.in, err)
+			continue
+		}
+		if v.Raw != table.expected {
+			t.Errorf("%d, %q expected: %q, got: %q", table.cdbId, table.in, table.expected, v.Raw)
+		}
+	}
+}
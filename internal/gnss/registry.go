@@ -0,0 +1,48 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package gnss
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/config"
+)
+
+// Factory creates a driver using the settings in the config
+type Factory func(conf *config.Config) GnssDriver
+
+var drivers = make(map[string]Factory)
+
+// Register makes a driver available with the given name, which is used for
+// the device_driver setting. It is meant to be called from the init function
+// of the file implementing the driver, and panics if the name is already
+// registered.
+func Register(name string, factory Factory) {
+	if _, ok := drivers[name]; ok {
+		panic(fmt.Sprintf("gnss.Register: driver %q registered twice", name))
+	}
+	drivers[name] = factory
+}
+
+// Drivers returns the names of all registered drivers, sorted
+func Drivers() (names []string) {
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return
+}
+
+// New creates the driver selected in the config
+func New(conf *config.Config) (GnssDriver, error) {
+	factory, ok := drivers[conf.Driver]
+	if !ok {
+		return nil, fmt.Errorf("gnss.New: unknown device_driver %q, must be one of: %s", conf.Driver, strings.Join(Drivers(), ", "))
+	}
+
+	return factory(conf), nil
+}
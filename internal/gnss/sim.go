@@ -0,0 +1,157 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package gnss
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/config"
+	"gitlab.com/postmarketOS/gnss-share/internal/nmea"
+)
+
+func init() {
+	Register("sim", func(conf *config.Config) GnssDriver {
+		return NewSim(conf.SimLatitude, conf.SimLongitude, conf.SimSpeed, conf.SimHeading)
+	})
+}
+
+const earthRadius = 6371000.0 // meters
+
+// Satellites reported in view by the simulator: PRN, elevation, azimuth, SNR
+var simSatellites = [][4]int{
+	{2, 45, 120, 38}, {5, 70, 45, 42}, {12, 30, 210, 35}, {15, 15, 300, 28},
+	{18, 55, 80, 40}, {21, 25, 160, 33}, {25, 60, 250, 41}, {29, 10, 20, 25},
+}
+
+// Sim is a simulated GNSS device, which reports a fix that moves from a start
+// position at a constant speed and heading. It is useful for testing clients
+// without any hardware.
+type Sim struct {
+	latitude  float64
+	longitude float64
+	speed     float64
+	heading   float64
+}
+
+// NewSim creates a new Sim starting at the given latitude and longitude in
+// decimal degrees, moving at speed (meters/second) in the direction of heading
+// (degrees from true north).
+func NewSim(latitude float64, longitude float64, speed float64, heading float64) *Sim {
+	return &Sim{
+		latitude:  latitude,
+		longitude: longitude,
+		speed:     speed,
+		heading:   heading,
+	}
+}
+
+func (s *Sim) Load(cache AgpsCache, force bool) (err error) {
+	return
+}
+
+func (s *Sim) Save(cache AgpsCache) (err error) {
+	return
+}
+
+func (s *Sim) WriteRaw(data []byte) (err error) {
+	return fmt.Errorf("gnss/Sim.WriteRaw: not supported by the simulator")
+}
+
+func (s *Sim) WriteCommand(cmd []byte) (out []string, err error) {
+	err = fmt.Errorf("gnss/Sim.WriteCommand: not supported by the simulator")
+	return
+}
+
+func (s *Sim) Start(ctx context.Context, sendCh chan<- []byte) (err error) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	start := time.Now()
+	for {
+		lat, lon := s.position(time.Since(start))
+		for _, sentence := range s.sentences(time.Now().UTC(), lat, lon) {
+			select {
+			case sendCh <- sentence.Bytes():
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// position returns the position after moving for the given duration
+func (s *Sim) position(elapsed time.Duration) (lat float64, lon float64) {
+	// angular distance travelled
+	dist := s.speed * elapsed.Seconds() / earthRadius
+	heading := s.heading * math.Pi / 180
+	lat1 := s.latitude * math.Pi / 180
+	lon1 := s.longitude * math.Pi / 180
+
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(dist) + math.Cos(lat1)*math.Sin(dist)*math.Cos(heading))
+	lon2 := lon1 + math.Atan2(math.Sin(heading)*math.Sin(dist)*math.Cos(lat1), math.Cos(dist)-math.Sin(lat1)*math.Sin(lat2))
+
+	lat = lat2 * 180 / math.Pi
+	// normalize to -180..180
+	lon = math.Mod(lon2*180/math.Pi+540, 360) - 180
+	return
+}
+
+func (s *Sim) sentences(now time.Time, lat float64, lon float64) (sentences []nmea.Sentence) {
+	fixTime := fmt.Sprintf("%s.%03d", now.Format("150405"), now.Nanosecond()/int(time.Millisecond))
+	latStr, latHemi := simCoordinate(lat, 2, "N", "S")
+	lonStr, lonHemi := simCoordinate(lon, 3, "E", "W")
+
+	sentences = append(sentences, nmea.Sentence{
+		Talker: "GP",
+		Type:   "GGA",
+		Data: []string{fixTime, latStr, latHemi, lonStr, lonHemi, "1",
+			fmt.Sprintf("%02d", len(simSatellites)), "0.9", "100.0", "M", "0.0", "M", "", ""},
+	})
+
+	// speed in knots
+	speed := s.speed * 1.943844
+	sentences = append(sentences, nmea.Sentence{
+		Talker: "GP",
+		Type:   "RMC",
+		Data: []string{fixTime, "A", latStr, latHemi, lonStr, lonHemi,
+			fmt.Sprintf("%.1f", speed), fmt.Sprintf("%.1f", s.heading), now.Format("020106"), "", "", "A"},
+	})
+
+	msgs := (len(simSatellites) + 3) / 4
+	for i := 0; i < msgs; i++ {
+		data := []string{fmt.Sprintf("%d", msgs), fmt.Sprintf("%d", i+1), fmt.Sprintf("%02d", len(simSatellites))}
+		for j := i * 4; j < len(simSatellites) && j < (i+1)*4; j++ {
+			sat := simSatellites[j]
+			data = append(data, fmt.Sprintf("%02d", sat[0]), fmt.Sprintf("%02d", sat[1]),
+				fmt.Sprintf("%03d", sat[2]), fmt.Sprintf("%02d", sat[3]))
+		}
+		sentences = append(sentences, nmea.Sentence{Talker: "GP", Type: "GSV", Data: data})
+	}
+
+	return
+}
+
+// simCoordinate formats decimal degrees as (d)ddmm.mmmm, with the number of
+// degree digits given by width, and returns it with its hemisphere
+func simCoordinate(deg float64, width int, pos string, neg string) (string, string) {
+	// rounded to the precision that is printed first, so that e.g. 59.99999
+	// minutes is carried over to the degrees instead of printed as 60.0000
+	minutes := math.Round(math.Abs(deg)*60*10000) / 10000
+	hemisphere := pos
+	if deg < 0 && minutes != 0 {
+		hemisphere = neg
+	}
+
+	whole := math.Floor(minutes / 60)
+	return fmt.Sprintf("%0*d%07.4f", width, int(whole), minutes-whole*60), hemisphere
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package gnss
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/nmea"
+)
+
+// Test formatting coordinates, including minutes that round up to a whole
+// degree
+func TestSimCoordinate(t *testing.T) {
+	tables := []struct {
+		deg        float64
+		width      int
+		expected   string
+		hemisphere string
+	}{
+		{48.1173, 2, "4807.0380", "N"},
+		{-48.1173, 2, "4807.0380", "S"},
+		{11.516666667, 3, "01131.0000", "N"},
+		{-0.5, 3, "00030.0000", "S"},
+		{0, 2, "0000.0000", "N"},
+		// 59.999994 minutes
+		{47.9999999, 2, "4800.0000", "N"},
+		{-179.9999999, 3, "18000.0000", "S"},
+		// rounds to 0
+		{-0.0000000001, 2, "0000.0000", "N"},
+	}
+
+	for _, table := range tables {
+		got, hemisphere := simCoordinate(table.deg, table.width, "N", "S")
+		if got != table.expected || hemisphere != table.hemisphere {
+			t.Errorf("%v: expected: %s %s, got: %s %s", table.deg, table.expected, table.hemisphere, got, hemisphere)
+		}
+	}
+}
+
+// Test that the simulated sentences are valid and report the position
+func TestSimSentences(t *testing.T) {
+	s := NewSim(47.9999999, -122.5, 0, 0)
+	now := time.Date(2021, 6, 1, 12, 30, 15, 250*int(time.Millisecond), time.UTC)
+
+	var types []string
+	for _, sentence := range s.sentences(now, s.latitude, s.longitude) {
+		parsed, err := nmea.Parse(sentence.String())
+		if err != nil {
+			t.Fatalf("invalid sentence %q: %s", sentence, err)
+		}
+		types = append(types, parsed.Type)
+
+		if parsed.Type != "GGA" {
+			continue
+		}
+		pos, err := parsed.Position()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if math.Abs(pos.Latitude-48) > 1e-6 || math.Abs(pos.Longitude+122.5) > 1e-6 {
+			t.Errorf("expected position: 48, -122.5, got: %v, %v", pos.Latitude, pos.Longitude)
+		}
+	}
+
+	expected := []string{"GGA", "RMC", "GSV", "GSV"}
+	if len(types) != len(expected) {
+		t.Fatalf("expected sentences: %q, got: %q", expected, types)
+	}
+	for i := range expected {
+		if types[i] != expected[i] {
+			t.Errorf("expected sentences: %q, got: %q", expected, types)
+			break
+		}
+	}
+}
+
+// Test moving from the start position
+func TestSimPosition(t *testing.T) {
+	tables := []struct {
+		lat, lon, speed, heading float64
+		elapsed                  time.Duration
+		expectedLat, expectedLon float64
+	}{
+		{48, 11, 0, 0, time.Hour, 48, 11},
+		// 1 degree of latitude is about 111.2 km
+		{0, 0, 111195, 0, time.Second, 1, 0},
+		{0, 0, 111195, 90, time.Second, 0, 1},
+		// wraps around the antimeridian
+		{0, 179.5, 111195, 90, time.Second, 0, -179.5},
+	}
+
+	for _, table := range tables {
+		s := NewSim(table.lat, table.lon, table.speed, table.heading)
+		lat, lon := s.position(table.elapsed)
+		if math.Abs(lat-table.expectedLat) > 1e-3 || math.Abs(lon-table.expectedLon) > 1e-3 {
+			t.Errorf("%v, %v at %v m/s heading %v: expected: %v, %v, got: %v, %v", table.lat, table.lon,
+				table.speed, table.heading, table.expectedLat, table.expectedLon, lat, lon)
+		}
+	}
+}
@@ -5,45 +5,214 @@ package gnss
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"math/big"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/tarm/serial"
+	"gitlab.com/postmarketOS/gnss-share/internal/config"
 	"gitlab.com/postmarketOS/gnss-share/internal/nmea"
 )
 
+func init() {
+	Register("stm", func(conf *config.Config) GnssDriver {
+		s := NewStmGnss(conf.DevicePath)
+		s.SetReadyWait(conf.ReadyTimeout, conf.ReadyRetries)
+		s.SetMaxLineLength(conf.MaxLineLength)
+		s.SetLoadRetries(conf.AgpsLoadRetries)
+		s.SetOperationTimeout(conf.AgpsTimeout)
+		s.SetCommandTimeout(conf.CommandTimeout)
+		s.SetVerbose(conf.Verbose)
+		return s
+	})
+	Register("stm_serial", func(conf *config.Config) GnssDriver {
+		s := NewStmSerial(conf.DevicePath, int(conf.BaudRate))
+		s.SetReadyWait(conf.ReadyTimeout, conf.ReadyRetries)
+		s.SetMaxLineLength(conf.MaxLineLength)
+		s.SetLoadRetries(conf.AgpsLoadRetries)
+		s.SetOperationTimeout(conf.AgpsTimeout)
+		s.SetCommandTimeout(conf.CommandTimeout)
+		s.SetVerbose(conf.Verbose)
+		return s
+	})
+}
+
 type Stm interface {
-	open() (err error)
+	open(mode openMode) (err error)
 	close() (err error)
 	ready() (bool, error)
 	Restore() (err error)
 	Reset() (err error)
-	SetParam(cdbId int, value uint64) (err error)
-	GetParam(cdbId int) (val uint64, err error)
+	SetParam(cdbId int, value uint64, save bool) (err error)
+	SetParams(params []Param, save bool) (errs []error, err error)
+	GetParam(cdbId int) (val ParamValue, err error)
+	GetParams(cdbIds []int) (vals []ParamValue, errs []error, err error)
+	SendCommand(cmd string, isAcked bool) (out []string, err error)
+	SetDryRun(dryRun bool)
+	SetVerbose(verbose bool)
 }
 
 type StmCommon struct {
 	Stm
-	path     string
-	scanner  *bufio.Scanner
-	writer   io.Writer
-	devMu    sync.Mutex
+	path   string
+	reader *lineReader
+	writer io.Writer
+	// devMu is held for the duration of each read in Start, and for the
+	// duration of commands like Save/Load, so that the device can be shared
+	// between streaming to clients and running commands
+	devMu sync.Mutex
+	// writeMu is held while writing to the device, so that raw data written
+	// by WriteRaw is not interleaved with commands
+	writeMu sync.Mutex
+	// refMu protects openRefs, which counts users of the opened device
 	refMu    sync.Mutex
 	openRefs int
+	// how long to wait for the device to be ready after opening it, and how
+	// many times to reopen it if it is not
+	readyTimeout time.Duration
+	readyRetries int
+	// longest line read from the device, 0 for the default
+	maxLineLength int
+	// how many more times to send AGPS data records that fail to load
+	loadRetries int
+	// how long Save and Load can take in total, not limited if 0, and the
+	// deadline of the one that is running. opDeadline is protected by devMu.
+	opTimeout  time.Duration
+	opDeadline time.Time
+	// how long to wait for the module to echo each command, 0 for the
+	// default
+	cmdTimeout time.Duration
+	// set if the device was opened read-only, see openStream
+	readOnly bool
+	// if set, commands that change the module configuration print the
+	// sentences they would send instead of sending them
+	dryRun bool
+	// if set, the sentences written to and read from the device while
+	// running commands are not printed
+	quiet bool
+}
+
+// SetDryRun sets whether SetParam(s), Restore and Reset only print the
+// sentences they would send, without opening the device.
+func (s *StmCommon) SetDryRun(dryRun bool) {
+	s.dryRun = dryRun
+}
+
+// SetVerbose sets whether the sentences written to and read from the device
+// while running commands are printed, which they are by default.
+func (s *StmCommon) SetVerbose(verbose bool) {
+	s.quiet = !verbose
+}
+
+// acquire opens the device for a command that changes the module
+// configuration, unless in dry-run mode
+func (s *StmCommon) acquire() error {
+	if s.dryRun {
+		return nil
+	}
+	return s.open(openCommand)
+}
+
+// release closes the device opened by acquire
+func (s *StmCommon) release() {
+	if s.dryRun {
+		return
+	}
+	s.close()
 }
 
+const (
+	defaultReadyTimeout = 10 * time.Second
+	// delay before reopening a device that was not ready
+	readyRetryDelay = time.Second
+	// number of lines received while waiting for the device to be ready
+	// that are included in the error if it never is
+	readyLogLines = 5
+	// longest line read from the device by default, which is much longer
+	// than any valid sentence
+	defaultMaxLineLength = 64 * 1024
+	// how long to wait for the module to echo a command by default
+	defaultCommandTimeout = 30 * time.Second
+	// how long Start waits for a line while holding devMu, so that commands
+	// can run and ctx is checked even if the module sends nothing
+	streamReadTimeout = time.Second
+	// number of writes in a row that write nothing before giving up
+	writeRetries = 5
+)
+
+// SetLoadRetries sets how many more times to try sending each AGPS data record
+// to the module when loading it, if sending it fails.
+func (s *StmCommon) SetLoadRetries(retries int) {
+	s.loadRetries = retries
+}
+
+// SetOperationTimeout sets how long Save and Load can take in total. Once the
+// timeout is over, they fail with ErrTimeout and the module is resumed. It is
+// not limited if timeout is 0.
+func (s *StmCommon) SetOperationTimeout(timeout time.Duration) {
+	s.opTimeout = timeout
+}
+
+// SetCommandTimeout sets how long to wait for the module to respond to each
+// command, after which it fails with ErrTimeout. During Save and Load, it is
+// also limited by the operation timeout. The default is used if timeout is 0.
+func (s *StmCommon) SetCommandTimeout(timeout time.Duration) {
+	s.cmdTimeout = timeout
+}
+
+// startOperation starts the timeout for Save or Load, devMu must be held. The
+// returned function ends it.
+func (s *StmCommon) startOperation() (end func()) {
+	if s.opTimeout > 0 {
+		s.opDeadline = time.Now().Add(s.opTimeout)
+	}
+	return func() {
+		s.opDeadline = time.Time{}
+	}
+}
+
+// opExpired returns true if the timeout for the running Save or Load is over,
+// devMu must be held
+func (s *StmCommon) opExpired() bool {
+	return !s.opDeadline.IsZero() && time.Now().After(s.opDeadline)
+}
+
+// SetReadyWait sets how long to wait for the device to be ready each time it is
+// opened, and how many more times to try opening it if it is not. The default
+// timeout is used if timeout is 0.
+func (s *StmCommon) SetReadyWait(timeout time.Duration, retries int) {
+	s.readyTimeout = timeout
+	s.readyRetries = retries
+}
+
+// openMode is what the device is opened for
+type openMode int
+
+const (
+	// openStream is for streaming sentences from the device. If the user is
+	// not allowed to write to the device, it is opened read-only, and
+	// commands fail with ErrReadOnly while it is open.
+	openStream openMode = iota
+	// openCommand is for sending commands, which requires writing to the
+	// device
+	openCommand
+)
+
 // StmGnss is a STM module connected through the GNSS subsystem in the Linux
 // kernel. It is commonly available through /dev/gnssN
 type StmGnss struct {
 	StmCommon
 	device *os.File
+	// opens the device and returns its fd, syscall.Open if nil
+	openFile func(path string, flag int) (fd int, err error)
 }
 
 // StmSerial is a STM module accessed directly over a serial interface on the
@@ -53,14 +222,21 @@ type StmSerial struct {
 	StmCommon
 	serConf serial.Config
 	serPort *serial.Port
+	// the baud rate is detected when the device is first opened, and again
+	// if it is not ready
+	autoBaud bool
 }
 
+// NewStmSerial creates a new StmSerial for the device at the given path. If baud
+// is 0, the baud rate is detected automatically when the device is opened.
 func NewStmSerial(path string, baud int) *StmSerial {
 	s := StmSerial{
 		serConf: serial.Config{
-			Name: path,
-			Baud: baud,
+			Name:        path,
+			Baud:        baud,
+			ReadTimeout: serialReadTimeout,
 		},
+		autoBaud: baud == 0,
 		StmCommon: StmCommon{
 			path: path,
 		},
@@ -70,7 +246,8 @@ func NewStmSerial(path string, baud int) *StmSerial {
 	return &s
 }
 
-func (s *StmSerial) open() (err error) {
+// open opens the serial port, which is always opened for reading and writing
+func (s *StmSerial) open(mode openMode) (err error) {
 	s.refMu.Lock()
 	defer s.refMu.Unlock()
 
@@ -78,13 +255,42 @@ func (s *StmSerial) open() (err error) {
 		s.openRefs++
 		return
 	}
-	s.serPort, err = serial.OpenPort(&s.serConf)
-	if err != nil {
-		err = fmt.Errorf("gnss/StmSerial.Open(): %w", err)
-		return
+
+	for attempt := 0; ; attempt++ {
+		if s.autoBaud && (s.serConf.Baud == 0 || attempt > 0) {
+			// detected again when retrying, in case the detected baud
+			// rate was wrong
+			s.serConf.Baud, err = DetectBaudRate(s.path)
+			if err != nil {
+				err = fmt.Errorf("gnss/StmSerial.Open(): %w", err)
+				return
+			}
+			fmt.Printf("Detected baud rate for %q: %d\n", s.path, s.serConf.Baud)
+		}
+		s.serPort, err = serial.OpenPort(&s.serConf)
+		if err != nil {
+			err = fmt.Errorf("gnss/StmSerial.Open(): %w", openError(err))
+			return
+		}
+		s.setTransport(serialTransport(s.serPort, s.path))
+
+		var ready bool
+		if ready, err = s.ready(); ready {
+			break
+		}
+		s.serPort.Close()
+		s.serPort = nil
+
+		if attempt >= s.readyRetries {
+			if s.autoBaud {
+				// detect it again the next time the device is opened
+				s.serConf.Baud = 0
+			}
+			return fmt.Errorf("gnss/StmSerial.open: device not ready after %d attempt(s): %w", attempt+1, err)
+		}
+		fmt.Printf("Device %q not ready, retrying: %s\n", s.path, err)
+		time.Sleep(readyRetryDelay)
 	}
-	s.scanner = bufio.NewScanner(s.serPort)
-	s.writer = s.serPort
 	s.openRefs++
 
 	return
@@ -95,6 +301,7 @@ func (s *StmSerial) close() (err error) {
 	defer s.refMu.Unlock()
 
 	if s.openRefs > 1 {
+		s.openRefs--
 		return
 	}
 
@@ -109,8 +316,44 @@ func (s *StmSerial) close() (err error) {
 	return
 }
 
+// ready checks that valid NMEA sentences are received, since nothing but
+// garbage is received if the baud rate is wrong
 func (s *StmSerial) ready() (bool, error) {
-	return true, nil
+	s.devMu.Lock()
+	defer s.devMu.Unlock()
+
+	timeout := s.readyTimeout
+	if timeout == 0 {
+		timeout = defaultReadyTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	valid := 0
+	var last []string
+	for {
+		line, err := s.readline(deadline)
+		if errors.Is(err, ErrTimeout) {
+			break
+		}
+		if err != nil {
+			return false, fmt.Errorf("gnss/StmSerial.ready: %w", err)
+		}
+		if _, err := nmea.Parse(line); err == nil {
+			valid++
+			if valid >= baudProbeSentences {
+				return true, nil
+			}
+			continue
+		}
+
+		last = append(last, line)
+		if len(last) > readyLogLines {
+			last = last[1:]
+		}
+	}
+
+	return false, fmt.Errorf("gnss/StmSerial.ready: %w: no valid NMEA sentences received within %s at %d baud, check that the baud rate is correct, last invalid lines received: %q",
+		ErrDeviceNotReady, timeout, s.serConf.Baud, last)
 }
 
 func NewStmGnss(path string) *StmGnss {
@@ -124,31 +367,62 @@ func NewStmGnss(path string) *StmGnss {
 	return &s
 }
 
-func (s *StmGnss) open() (err error) {
+// open opens the device for reading and writing. For openStream, it is opened
+// read-only instead if the user is only allowed to read it.
+func (s *StmGnss) open(mode openMode) (err error) {
 	s.refMu.Lock()
 	defer s.refMu.Unlock()
 
 	if s.openRefs > 0 {
+		if mode == openCommand && s.readOnly {
+			return fmt.Errorf("gnss/StmGnss.open: %w", ErrReadOnly)
+		}
 		s.openRefs++
 		return
 	}
-	// Using syscall.Open will open the file in non-pollable mode, which
-	// results in a significant reduction in CPU usage on ARM64 systems,
-	// and no noticeable impact on x86_64. We don't need to poll the file
-	// since it's just a constant stream of new data from the kernel's GNSS
-	// subsystem
-	fd, err := syscall.Open(s.path, os.O_RDWR, 0666)
-	if err != nil {
-		err = fmt.Errorf("gnss/Stm.Open(): %w", err)
-		return
-	}
-	s.device = os.NewFile(uintptr(fd), s.path)
 
-	s.scanner = bufio.NewScanner(s.device)
-	s.writer = s.device
+	for attempt := 0; ; attempt++ {
+		// Using syscall.Open will open the file in non-pollable mode, which
+		// results in a significant reduction in CPU usage on ARM64 systems,
+		// and no noticeable impact on x86_64. We don't need to poll the file
+		// since it's just a constant stream of new data from the kernel's GNSS
+		// subsystem
+		openFile := s.openFile
+		if openFile == nil {
+			openFile = func(path string, flag int) (int, error) {
+				return syscall.Open(path, flag, 0666)
+			}
+		}
+		var fd int
+		fd, err = openFile(s.path, os.O_RDWR)
+		s.readOnly = false
+		if mode == openStream && isPermission(err) {
+			fd, err = openFile(s.path, os.O_RDONLY)
+			if err == nil && attempt == 0 {
+				fmt.Printf("Opened %q read-only, commands can't be sent to it\n", s.path)
+			}
+			s.readOnly = err == nil
+		}
+		if err != nil {
+			err = fmt.Errorf("gnss/Stm.Open(): %w", openError(err))
+			return
+		}
+		s.device = os.NewFile(uintptr(fd), s.path)
+
+		s.setTransport(s.device)
+
+		var ready bool
+		if ready, err = s.ready(); ready {
+			break
+		}
+		s.device.Close()
+		s.device = nil
 
-	if ready, err := s.ready(); !ready {
-		return fmt.Errorf("gnss/StmCommon.Start: device not ready: %s", err)
+		if attempt >= s.readyRetries {
+			return fmt.Errorf("gnss/StmGnss.open: device not ready after %d attempt(s): %w", attempt+1, err)
+		}
+		fmt.Printf("Device %q not ready, retrying: %s\n", s.path, err)
+		time.Sleep(readyRetryDelay)
 	}
 
 	s.openRefs++
@@ -161,6 +435,7 @@ func (s *StmGnss) close() (err error) {
 	defer s.refMu.Unlock()
 
 	if s.openRefs > 1 {
+		s.openRefs--
 		return
 	}
 
@@ -174,33 +449,202 @@ func (s *StmGnss) close() (err error) {
 	return
 }
 
-func (s *StmCommon) readline() (line string, err error) {
-	for s.scanner.Scan() {
-		line = s.scanner.Text()
-		break
+// setTransport sets the reader/writer used to communicate with the module. This
+// is called when the device is opened.
+func (s *StmCommon) setTransport(rw io.ReadWriter) {
+	s.reader = newLineReader(newLineScanner(rw, s.maxLineLength))
+	s.writer = rw
+}
+
+// newLineScanner returns a scanner for lines from r, which skips lines longer
+// than max. The default is used if max is 0. Reads from r that fail with a
+// transient error are retried.
+func newLineScanner(r io.Reader, max int) *bufio.Scanner {
+	if max == 0 {
+		max = defaultMaxLineLength
 	}
+	splitter := &lineSplitter{max: max}
 
-	err = s.scanner.Err()
-	return
+	scanner := bufio.NewScanner(retryReader{r: r})
+	scanner.Buffer(make([]byte, 0, 4096), max)
+	scanner.Split(splitter.split)
+	return scanner
+}
+
+// SetMaxLineLength sets the length of the longest line that is read from the
+// device, longer lines are skipped. The default is used if max is 0. It must
+// be called before the device is opened.
+func (s *StmCommon) SetMaxLineLength(max int) {
+	s.maxLineLength = max
+}
+
+// lineSplitter splits lines like bufio.ScanLines, but skips lines that are
+// longer than max instead of failing, e.g. when garbage without any newlines
+// is received. Lines are also cleaned up with firstSentence, so that each
+// token is a single sentence.
+type lineSplitter struct {
+	max int
+	// set while skipping the rest of a line that is too long
+	skipping bool
+}
+
+func (l *lineSplitter) split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	// skipped lines are consumed along with the next line, since the scanner
+	// stops at EOF if no token is returned
+	for {
+		i := bytes.IndexByte(data[advance:], '\n')
+		if i < 0 {
+			break
+		}
+		if !l.skipping && i <= l.max {
+			n, token, err := bufio.ScanLines(data[advance:], atEOF)
+			token, n = firstSentence(token, n)
+			return advance + n, token, err
+		}
+		if !l.skipping {
+			fmt.Printf("Skipping line longer than %d bytes\n", l.max)
+		}
+		l.skipping = false
+		advance += i + 1
+	}
+
+	rest := data[advance:]
+	if len(rest) >= l.max || (l.skipping && len(rest) > 0) {
+		if !l.skipping {
+			fmt.Printf("Skipping line longer than %d bytes\n", l.max)
+			l.skipping = true
+		}
+		return len(data), nil, nil
+	}
+
+	n, token, err := bufio.ScanLines(rest, atEOF)
+	if token == nil && n == 0 {
+		// nothing more to return, but the skipped lines are consumed
+		return advance, nil, err
+	}
+	token, n = firstSentence(token, n)
+	return advance + n, token, err
+}
+
+// firstSentence trims the NULs and other control characters that the module
+// sends around some sentences from the line, and splits it before the start of
+// the next sentence if there is more than one sentence in it. n is the number
+// of bytes consumed for the line, and the number of bytes consumed for the
+// returned token is returned.
+func firstSentence(line []byte, n int) ([]byte, int) {
+	start := 0
+	for start < len(line) && isControl(line[start]) {
+		start++
+	}
+	if start == len(line) {
+		return line[start:], n
+	}
+
+	end := len(line)
+	if i := bytes.IndexByte(line[start+1:], '$'); i >= 0 {
+		end = start + 1 + i
+		n = end
+	}
+	for end > start && isControl(line[end-1]) {
+		end--
+	}
+	return line[start:end], n
+}
+
+func isControl(b byte) bool {
+	return b < 0x20 || b == 0x7f
+}
+
+// lineReader reads lines from a scanner in a goroutine, so that waiting for a
+// line can be given up at a deadline even though reads from the device can't
+// be interrupted. A line that is received after giving up is returned by the
+// next call to readline, so no lines are lost.
+type lineReader struct {
+	scanner *bufio.Scanner
+	// receives the result of the read in progress, if pending is set
+	result  chan GnssLine
+	pending bool
+}
+
+func newLineReader(scanner *bufio.Scanner) *lineReader {
+	return &lineReader{
+		scanner: scanner,
+		result:  make(chan GnssLine, 1),
+	}
+}
+
+// readline returns the next line, or ErrTimeout if none is received before
+// deadline. It waits without a limit if deadline is zero. io.EOF is returned
+// once the scanner stops without an error. It must not be called
+// concurrently.
+func (l *lineReader) readline(deadline time.Time) (line string, err error) {
+	if !l.pending {
+		l.pending = true
+		go func() {
+			if l.scanner.Scan() {
+				l.result <- GnssLine{Line: []byte(l.scanner.Text())}
+				return
+			}
+			err := l.scanner.Err()
+			if err == nil {
+				err = io.EOF
+			}
+			l.result <- GnssLine{Error: err}
+		}()
+	}
+
+	var r GnssLine
+	select {
+	case r = <-l.result:
+	default:
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case r = <-l.result:
+		case <-timeout:
+			return "", ErrTimeout
+		}
+	}
+
+	l.pending = false
+	return string(r.Line), r.Error
+}
+
+// readline returns the next line from the module, see lineReader.readline.
+// devMu must be held.
+func (s *StmCommon) readline(deadline time.Time) (line string, err error) {
+	return s.reader.readline(deadline)
 }
 
 func (s *StmGnss) ready() (bool, error) {
 	// device sends this message when it has booted
 	resp := nmea.Sentence{
-		Type: "GPTXT",
-		Data: []string{"DEFAULT LIV CONFIGURATION"},
+		Talker: "GP",
+		Type:   "TXT",
+		Data:   []string{"DEFAULT LIV CONFIGURATION"},
 	}.String()
 
-	tries := 100
-	c := 0
+	s.devMu.Lock()
+	defer s.devMu.Unlock()
+
+	timeout := s.readyTimeout
+	if timeout == 0 {
+		timeout = defaultReadyTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	// the last few lines received, to help figuring out why the device is
+	// not ready
+	var last []string
 	for {
-		if c > tries {
-			return false, fmt.Errorf("gnss/StmCommon.open: timed out waiting for device")
+		line, err := s.readline(deadline)
+		if errors.Is(err, ErrTimeout) {
+			break
 		}
-
-		s.devMu.Lock()
-		defer s.devMu.Unlock()
-		line, err := s.readline()
 		if err != nil {
 			err = fmt.Errorf("gnss/StmGnss.ready: %w", err)
 			return false, err
@@ -208,53 +652,79 @@ func (s *StmGnss) ready() (bool, error) {
 		if strings.Contains(line, resp) {
 			return true, nil
 		}
-		c++
+
+		last = append(last, line)
+		if len(last) > readyLogLines {
+			last = last[1:]
+		}
 	}
+
+	return false, fmt.Errorf("gnss/StmGnss.ready: %w: timed out after %s waiting for device, last lines received: %q", ErrDeviceNotReady, timeout, last)
 }
 
-func (s *StmCommon) Start(sendCh chan<- []byte, stop <-chan bool, errCh chan<- error) {
-	err := s.open()
+func (s *StmCommon) Start(ctx context.Context, sendCh chan<- []byte) (err error) {
+	err = s.open(openStream)
 	if err != nil {
-		errCh <- fmt.Errorf("gnss/stm.Start: %w", err)
-		return
+		if isDisconnect(s.path, err) {
+			return fmt.Errorf("gnss/stm.Start: %w: %s", ErrDisconnected, err)
+		}
+		return fmt.Errorf("gnss/stm.Start: %w", err)
 	}
 	defer s.close()
 
 	for {
 		select {
-		case <-stop:
-			return
+		case <-ctx.Done():
+			return nil
 		default:
 			s.devMu.Lock()
-			line, err := s.readline()
+			line, err := s.readline(time.Now().Add(streamReadTimeout))
 			s.devMu.Unlock()
+			if errors.Is(err, ErrTimeout) {
+				continue
+			}
 			if err != nil {
-				errCh <- fmt.Errorf("gnss/stm.Start: %w", err)
-				return
+				if isDisconnect(s.path, err) {
+					return fmt.Errorf("gnss/stm.Start: %w: %s", ErrDisconnected, err)
+				}
+				return fmt.Errorf("gnss/stm.Start: %w", err)
+			}
+
+			// line is a copy of the scanner's buffer, so it can be sent as-is
+			select {
+			case sendCh <- []byte(line):
+			case <-ctx.Done():
+				return nil
 			}
-			sendCh <- []byte(line)
 		}
 	}
 }
 
-func (s *StmCommon) Save(dir string) (err error) {
-	s.open()
+func (s *StmCommon) Save(cache AgpsCache) (err error) {
+	if err = s.open(openCommand); err != nil {
+		return fmt.Errorf("gnss/StmCommon.Save: %w", err)
+	}
 	defer s.close()
 
-	err = os.MkdirAll(dir, 0755)
-	if err != nil {
-		return
+	// file names may include subdirectories
+	for _, path := range []string{cache.EphemerisPath(), cache.AlmanacPath()} {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return
+		}
 	}
 
 	// get a lock to prevent the Start() goroutine from intercepting responses
 	s.devMu.Lock()
 	defer s.devMu.Unlock()
-	err = s.saveEphemeris(filepath.Join(dir, "ephemeris.txt"))
+	defer s.startOperation()()
+
+	err = s.saveEphemeris(cache.EphemerisPath())
 	if err != nil {
 		return
 	}
 
-	err = s.saveAlamanac(filepath.Join(dir, "almanac.txt"))
+	err = s.saveAlamanac(cache.AlmanacPath())
 	if err != nil {
 		return
 	}
@@ -262,21 +732,52 @@ func (s *StmCommon) Save(dir string) (err error) {
 	return
 }
 
-func (s *StmCommon) Load(dir string) (err error) {
-	s.open()
+func (s *StmCommon) Load(cache AgpsCache, force bool) (err error) {
+	if err = s.open(openCommand); err != nil {
+		return fmt.Errorf("gnss/StmCommon.Load: %w", err)
+	}
 	defer s.close()
 
 	// get a lock to prevent the Start() goroutine from intercepting responses
 	s.devMu.Lock()
 	defer s.devMu.Unlock()
-	err = s.loadEphemeris(filepath.Join(dir, "ephemeris.txt"))
-	if err != nil {
-		return
+	defer s.startOperation()()
+
+	// each type of data is skipped if there is none stored, and it is only
+	// an error if there is no data at all
+	missing := 0
+	path := existingCacheFile(cache.EphemerisPath())
+	if fresh, err := isFresh(path, cache.EphemerisMaxAge); errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("No ephemerides in %q to load\n", path)
+		missing++
+	} else if err != nil {
+		return fmt.Errorf("gnss/StmCommon.Load: %w", err)
+	} else if fresh || force {
+		err = s.loadEphemeris(path)
+		if err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("Ephemerides in %q are older than %s, not loading them\n", path, cache.EphemerisMaxAge)
 	}
 
-	err = s.loadAlmanac(filepath.Join(dir, "almanac.txt"))
-	if err != nil {
-		return
+	path = existingCacheFile(cache.AlmanacPath())
+	if fresh, err := isFresh(path, cache.AlmanacMaxAge); errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("No almanac in %q to load\n", path)
+		missing++
+	} else if err != nil {
+		return fmt.Errorf("gnss/StmCommon.Load: %w", err)
+	} else if fresh || force {
+		err = s.loadAlmanac(path)
+		if err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("Almanac in %q is older than %s, not loading it\n", path, cache.AlmanacMaxAge)
+	}
+
+	if missing == 2 {
+		return fmt.Errorf("gnss/StmCommon.Load: %w in %q", ErrNoAgpsData, cache.Dir)
 	}
 
 	return
@@ -285,75 +786,168 @@ func (s *StmCommon) Load(dir string) (err error) {
 // GetParam returns the parameter value for the given CDB ID. See the STM Teseo
 // Liv3f gps software manual sections for PSTMSETPAR and relevant CBD for
 // possible IDs/values to use.
-func (s *StmCommon) GetParam(cdbId int) (val uint64, err error) {
-	if err = s.open(); err != nil {
-		err = fmt.Errorf("gnss/stmCommon.GetParam: %w", err)
+func (s *StmCommon) GetParam(cdbId int) (val ParamValue, err error) {
+	vals, errs, err := s.GetParams([]int{cdbId})
+	if err == nil {
+		val, err = vals[0], errs[0]
+	}
+	if err != nil {
+		err = fmt.Errorf("gnss/StmCommon.GetParam: %w", err)
+	}
+
+	return
+}
+
+// GetParams returns the values for multiple CDB IDs, opening and pausing the
+// module only once. The value and error for each ID are returned in vals and
+// errs, in the same order as cdbIds. err is only set if the module could not
+// be opened.
+func (s *StmCommon) GetParams(cdbIds []int) (vals []ParamValue, errs []error, err error) {
+	if err = s.open(openCommand); err != nil {
+		err = fmt.Errorf("gnss/stmCommon.GetParams: %w", err)
 		return
 	}
 	defer s.close()
 
+	// get a lock to prevent the Start() goroutine from intercepting responses
+	s.devMu.Lock()
+	defer s.devMu.Unlock()
+
 	s.pause()
 	defer s.resume()
 
-	out, err := s.sendCmd(nmea.Sentence{Type: "PSTMGETPAR", Data: []string{fmt.Sprintf("%d", cdbId)}}.String(), true)
-	if err != nil {
-		err = fmt.Errorf("gnss/stmCommon.GetParam: %w", err)
-		return
+	for _, cdbId := range cdbIds {
+		var val ParamValue
+		out, perr := s.sendCmd(nmea.Sentence{Type: "PSTMGETPAR", Data: []string{fmt.Sprintf("%d", cdbId)}}.String(), true)
+		if perr == nil {
+			val, perr = parseGetParamResponse(cdbId, out)
+		}
+		vals = append(vals, val)
+		errs = append(errs, perr)
 	}
 
+	return
+}
+
+// parseGetParamResponse finds the value for the given CDB ID in the output from
+// the module after sending PSTMGETPAR.
+func parseGetParamResponse(cdbId int, out []string) (val ParamValue, err error) {
 	for _, l := range out {
 		if strings.Contains(l, "PSTMGETPARERROR") {
-			err = fmt.Errorf("gnss/StmCommon.GetParam: PSTMGETPARERROR returned by module")
+			err = fmt.Errorf("%w: PSTMGETPARERROR returned by module", ErrParamGet)
 			return
 		}
 		if strings.Contains(l, fmt.Sprintf("PSTMSETPAR,%d", cdbId)) {
 			msg := strings.Split(l, "*")[0]
 			fields := strings.Split(msg, ",")
 			if len(fields) < 3 {
-				err = fmt.Errorf("gnss/StmCommon.GetParam: not enough fields in response from module")
-				return
-			}
-			// try to parse with big.Parse first, sometimes module response is
-			// in scientific notation..
-			var valBig *big.Float
-			valBig, _, err = big.ParseFloat(fields[2], 10, 0, big.ToNearestEven)
-			if err == nil {
-				val, _ = valBig.Uint64()
-				return
-			}
-			// try parsing with strconv next
-			val, err = strconv.ParseUint(fields[2], 0, 64)
-			if err == nil {
+				err = fmt.Errorf("not enough fields in response from module")
 				return
 			}
 
-			// value is in a format that needs to be handled..
-			err = fmt.Errorf("gnss/StmCommon.GetParam: Unable to parse returned value: %q", fields[2])
-			return
+			return parseParamValue(fields[2])
 		}
 	}
-	err = fmt.Errorf("gnss/StmCommon.GetParam: no response sent by module")
+	err = fmt.Errorf("no response sent by module")
 	return
 }
 
-// SetParam sets parameters in the given configuration data block. See the STM
-// Teseo Liv3f gps software manual sections for PSTMSETPAR and relevant CBD for
+// SetParam sets a parameter in the NVM configuration data block, so that it is
+// used once the module is reset. If save is false, it is set in the current
+// configuration block instead, without writing to flash or resetting the
+// module, so it is only used until the module is reset. See the STM Teseo
+// Liv3f gps software manual sections for PSTMSETPAR and relevant CBD for
 // possible IDs/values to use.
-func (s *StmCommon) SetParam(cdbId int, value uint64) (err error) {
-	if err = s.open(); err != nil {
-		err = fmt.Errorf("gnss/stmCommon.GetParam: %w", err)
+func (s *StmCommon) SetParam(cdbId int, value uint64, save bool) (err error) {
+	block := BlockNVM
+	if !save {
+		block = BlockCurrent
+	}
+	errs, err := s.SetParams([]Param{{CdbId: cdbId, Value: value, Block: block}}, save)
+	if err == nil {
+		err = errs[0]
+	}
+	if err != nil {
+		err = fmt.Errorf("gnss/StmCommon.SetParam: %w", err)
+	}
+
+	return
+}
+
+// Param is a configuration parameter value to set with SetParams
+type Param struct {
+	CdbId int
+	Value uint64
+	// Block to set the parameter in, BlockNVM if 0
+	Block ConfigBlock
+	// Text is sent instead of Value if set, for parameters that are not
+	// integers, e.g. "0.2" for the fix period in seconds
+	Text string
+}
+
+// value returns the parameter value as it is sent in PSTMSETPAR
+func (p Param) value() string {
+	if p.Text != "" {
+		return p.Text
+	}
+	return fmt.Sprintf("0x%08x", p.Value)
+}
+
+// SetParams sets multiple parameters, then saves them and resets the module
+// once if any of them were set successfully. If save is false, the
+// configuration is not saved to flash and the module is not reset, e.g. to try
+// out parameters set in BlockCurrent. The error for setting each parameter is
+// returned in errs, in the same order as params. err is only set if the module
+// could not be opened, saved or reset.
+func (s *StmCommon) SetParams(params []Param, save bool) (errs []error, err error) {
+	if err = s.acquire(); err != nil {
+		err = fmt.Errorf("gnss/StmCommon.SetParams: %w", err)
 		return
 	}
-	defer s.close()
+	defer s.release()
+
+	// get a lock to prevent the Start() goroutine from intercepting responses
+	s.devMu.Lock()
+	defer s.devMu.Unlock()
 
 	s.pause()
 	// resume only on error, since system is reset on success
 
+	set := 0
+	for _, p := range params {
+		perr := s.setParam(p)
+		errs = append(errs, perr)
+		if perr == nil {
+			set++
+		}
+	}
+	if set == 0 || !save {
+		s.resume()
+		return
+	}
+
+	_, err = s.sendCmd(nmea.Sentence{Type: "PSTMSAVEPAR"}.String(), true)
+	if err != nil {
+		err = fmt.Errorf("gnss/StmCommon.SetParams: %w", err)
+		s.resume()
+		return
+	}
+	_, err = s.sendCmd(nmea.Sentence{Type: "PSTMSRR"}.String(), false)
+	return
+}
+
+// setParam sends PSTMSETPAR for the parameter, without saving the
+// configuration or resetting the module.
+func (s *StmCommon) setParam(p Param) (err error) {
+	block := p.Block
+	if block == 0 {
+		block = BlockNVM
+	}
 	msgListCmd := nmea.Sentence{
 		Type: "PSTMSETPAR",
 		Data: []string{
-			fmt.Sprintf("%d%d", 3, cdbId),
-			fmt.Sprintf("0x%08x", value),
+			fmt.Sprintf("%d", block.ID(p.CdbId)),
+			p.value(),
 			// TODO: exposing the OR and AND functionality in the 4th optional
 			// parameter to STMSETPAR would be nice
 			fmt.Sprintf("%d", 0),
@@ -361,46 +955,47 @@ func (s *StmCommon) SetParam(cdbId int, value uint64) (err error) {
 	}
 	out, err := s.sendCmd(msgListCmd.String(), true)
 	if err != nil {
-		err = fmt.Errorf("gnss/StmCommon.SetParam: %w", err)
-		s.resume()
 		return
 	}
 
 	for _, o := range out {
 		if strings.Contains(o, "PSTMSETPARERROR") {
-			s.resume()
-			return fmt.Errorf("error setting parameter at conf block %d, id %d: %d", 1, cdbId, value)
+			return fmt.Errorf("%w in conf block %d, id %d: %s", ErrParamSet, block, p.CdbId, p.value())
 		}
 	}
 
-	_, err = s.sendCmd(nmea.Sentence{Type: "PSTMSAVEPAR"}.String(), true)
-	if err != nil {
-		s.resume()
-		return
-	}
-	_, err = s.sendCmd(nmea.Sentence{Type: "PSTMSRR"}.String(), false)
 	return
 }
 
 func (s *StmCommon) Reset() (err error) {
-	if err = s.open(); err != nil {
+	if err = s.acquire(); err != nil {
 		err = fmt.Errorf("gnss/stmCommon.Reset: %w", err)
 		return
 	}
 
-	defer s.close()
+	defer s.release()
+
+	// get a lock to prevent the Start() goroutine from intercepting responses
+	s.devMu.Lock()
+	defer s.devMu.Unlock()
+
 	s.pause()
 	_, err = s.sendCmd(nmea.Sentence{Type: "PSTMSRR"}.String(), false)
 	return
 }
 
 func (s *StmCommon) Restore() (err error) {
-	if err = s.open(); err != nil {
-		err = fmt.Errorf("gnss/stmCommon.GetParam: %w", err)
+	if err = s.acquire(); err != nil {
+		err = fmt.Errorf("gnss/stmCommon.Restore: %w", err)
 		return
 	}
 
-	defer s.close()
+	defer s.release()
+
+	// get a lock to prevent the Start() goroutine from intercepting responses
+	s.devMu.Lock()
+	defer s.devMu.Unlock()
+
 	s.pause()
 	// resume only on error, since system is reset on success
 
@@ -414,63 +1009,119 @@ func (s *StmCommon) Restore() (err error) {
 }
 
 func (s *StmCommon) saveEphemeris(path string) (err error) {
-	fmt.Printf("Storing ephemerides to: %q\n", path)
+	if err = s.saveRecords(path, "PSTMDUMPEPHEMS", "PSTMEPHEM", "ephemeris"); err != nil {
+		err = fmt.Errorf("gnss/StmCommon.saveEphemeris: %w", err)
+	}
+
+	return
+}
+
+func (s *StmCommon) saveAlamanac(path string) (err error) {
+	if err = s.saveRecords(path, "PSTMDUMPALMANAC", "PSTMALMANAC", "almanac"); err != nil {
+		err = fmt.Errorf("gnss/StmCommon.saveAlamanac: %w", err)
+	}
 
+	return
+}
+
+// saveRecords dumps the AGPS data records of the given type from the module
+// with dumpCmd, and writes them to the file at path, name is used in messages
+// about them. The dump is complete once the module echoes dumpCmd. The file is
+// only replaced if the dump is complete and all of the records in it are
+// valid, so that a truncated dump does not replace the stored data, and it is
+// kept if the module has no records.
+func (s *StmCommon) saveRecords(path string, dumpCmd string, sType string, name string) (err error) {
+	fmt.Printf("Storing %s records to: %q\n", name, path)
+
+	// resumed even if pausing fails, since the module may have been paused
+	// without echoing the command in time
+	defer s.resume()
 	err = s.pause()
 	if err != nil {
 		return
 	}
-	defer s.resume()
 
-	out, err := s.sendCmd(nmea.Sentence{Type: "PSTMDUMPEPHEMS"}.String(), true)
+	out, err := s.sendCmd(nmea.Sentence{Type: dumpCmd}.String(), true)
 	if err != nil {
-		return fmt.Errorf("gnss/StmCommon.saveEphemeris: %w", err)
+		return fmt.Errorf("incomplete %s dump: %w", name, err)
 	}
 
-	fd, err := os.Create(path)
-	if err != nil {
-		err = fmt.Errorf("gnss/StmCommon.Save: error saving to file %q: %w", path, err)
+	records, invalid := dumpedRecords(out, sType)
+	if invalid > 0 {
+		return fmt.Errorf("incomplete %s dump: %d of %d records are invalid, not saving them", name, invalid, len(records)+invalid)
+	}
+	if len(records) == 0 {
+		fmt.Printf("No %s records to store, keeping %q\n", name, path)
 		return
 	}
-	defer fd.Close()
 
+	if err = writeRecords(path, records); err != nil {
+		return fmt.Errorf("error saving to file %q: %w", path, err)
+	}
+	fmt.Printf("Stored %d %s records\n", len(records), name)
+
+	return
+}
+
+// dumpedRecords returns the records of the given type in the output of a dump
+// command, and counts the records that are invalid, e.g. because they were cut
+// off
+func dumpedRecords(out []string, sType string) (records []string, invalid int) {
 	for _, l := range out {
-		if strings.HasPrefix(l, "$PSTMEPHEM,") {
-			fd.Write([]byte(fmt.Sprintf("%s\n", l)))
+		if !strings.HasPrefix(l, "$"+sType+",") {
+			continue
+		}
+		if sentence, err := nmea.Parse(l); err != nil || sentence.Type != sType {
+			invalid++
+			continue
 		}
+		records = append(records, l)
 	}
+
 	return
 }
 
-func (s *StmCommon) saveAlamanac(path string) (err error) {
-	fmt.Printf("Storing almanac to: %q\n", path)
-
-	err = s.pause()
+// writeRecords writes the records to the AGPS data file at path, compressed if
+// path ends with CompressedExt. The file is written to a temporary file first,
+// so that it is not left half-written if writing fails.
+func writeRecords(path string, records []string) (err error) {
+	tmp := path + ".tmp"
+	fd, err := createCacheFile(tmp, strings.HasSuffix(path, CompressedExt))
 	if err != nil {
 		return
 	}
-	defer s.resume()
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
 
-	out, err := s.sendCmd(nmea.Sentence{Type: "PSTMDUMPALMANAC"}.String(), true)
-	if err != nil {
-		return fmt.Errorf("gnss/StmCommon.saveAlmanac: %w", err)
+	for _, r := range records {
+		if _, err = fmt.Fprintf(fd, "%s\n", r); err != nil {
+			fd.Close()
+			return
+		}
 	}
-
-	fd, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("gnss/StmCommon.saveAlamanac: error saving to file %q: %w", path, err)
+	if err = fd.Close(); err != nil {
+		return
 	}
-	defer fd.Close()
 
-	for _, l := range out {
-		if strings.HasPrefix(l, "$PSTMALMANAC,") {
-			fd.Write([]byte(fmt.Sprintf("%s\n", l)))
-		}
-	}
-	return
+	return os.Rename(tmp, path)
 }
 
 func (s *StmCommon) sendCmd(cmd string, isAcked bool) (out []string, err error) {
+	if s.dryRun {
+		fmt.Printf("dry-run: %s\n", cmd)
+		return
+	}
+
+	// commands that are not acked, e.g. resuming the module, are still sent
+	// once the operation timed out
+	if isAcked && s.opExpired() {
+		err = fmt.Errorf("gnss/StmCommon.sendCmd: %w: operation took longer than %s, not sending %q", ErrTimeout, s.opTimeout, cmd)
+		return
+	}
+
 	err = s.write([]byte(cmd))
 	if err != nil {
 		err = fmt.Errorf("gnss/StmCommon.sendCmd: %w", err)
@@ -481,28 +1132,123 @@ func (s *StmCommon) sendCmd(cmd string, isAcked bool) (out []string, err error)
 		return
 	}
 
-	// TODO: time out at some point..
-	c := 0
+	timeout := s.cmdTimeout
+	if timeout == 0 {
+		timeout = defaultCommandTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	if !s.opDeadline.IsZero() && s.opDeadline.Before(deadline) {
+		deadline = s.opDeadline
+	}
 	var line string
 	for {
-		line, err = s.readline()
+		line, err = s.readline(deadline)
+		if errors.Is(err, ErrTimeout) {
+			if s.opExpired() {
+				err = fmt.Errorf("gnss/StmCommon.sendCmd: %w: operation took longer than %s waiting for %q to be echoed", ErrTimeout, s.opTimeout, cmd)
+			} else {
+				err = fmt.Errorf("gnss/StmCommon.sendCmd: %w after %s waiting for %q to be echoed", ErrTimeout, timeout, cmd)
+			}
+			return
+		}
 		if err != nil {
 			err = fmt.Errorf("gnss/StmCommon.sendCmd: %w", err)
 			return
 		}
-		fmt.Printf("read: %s\n", line)
+		if !s.quiet {
+			fmt.Printf("read: %s\n", line)
+		}
 
 		// Command it echo'd back when it is complete.
-		if line == cmd {
+		if isEcho(line, cmd) {
 			break
 		}
 
 		out = append(out, line)
-		c++
 	}
 	return
 }
 
+// isEcho returns true if line is the echo of cmd. The echo may have NULLs or
+// other garbage before it, and trailing whitespace.
+func isEcho(line string, cmd string) bool {
+	line = strings.TrimRight(line, " \t\r\n\x00")
+	return strings.HasSuffix(line, cmd)
+}
+
+// SendCommand sends an arbitrary NMEA sentence to the module, and returns the
+// lines received until the module echoes it back, if isAcked is set. The
+// checksum is added to the sentence if it does not have one.
+func (s *StmCommon) SendCommand(cmd string, isAcked bool) (out []string, err error) {
+	cmd, err = rawCommand(cmd)
+	if err != nil {
+		err = fmt.Errorf("gnss/StmCommon.SendCommand: %w", err)
+		return
+	}
+
+	if err = s.open(openCommand); err != nil {
+		err = fmt.Errorf("gnss/StmCommon.SendCommand: %w", err)
+		return
+	}
+	defer s.close()
+
+	// get a lock to prevent the Start() goroutine from intercepting responses
+	s.devMu.Lock()
+	defer s.devMu.Unlock()
+
+	out, err = s.sendCmd(cmd, isAcked)
+	if err != nil {
+		err = fmt.Errorf("gnss/StmCommon.SendCommand: %w", err)
+	}
+
+	return
+}
+
+// WriteCommand sends the command to the module, and returns the lines received
+// until the module echoes it back
+func (s *StmCommon) WriteCommand(cmd []byte) (out []string, err error) {
+	out, err = s.SendCommand(string(cmd), true)
+	if err != nil {
+		err = fmt.Errorf("gnss/StmCommon.WriteCommand: %w", err)
+	}
+
+	return
+}
+
+// rawCommand validates a sentence given by the user, and adds the checksum to
+// it if it is missing
+func rawCommand(cmd string) (string, error) {
+	cmd = strings.TrimSpace(cmd)
+	if strings.Contains(cmd, "*") {
+		if _, err := nmea.Parse(cmd); err != nil {
+			return "", err
+		}
+		return cmd, nil
+	}
+
+	if !strings.HasPrefix(cmd, "$") {
+		return "", fmt.Errorf("sentence does not start with '$': %q", cmd)
+	}
+	body := cmd[1:]
+	for _, c := range body {
+		if c < ' ' || c > '~' || c == '$' || c == '!' {
+			return "", fmt.Errorf("invalid character in sentence: %q", cmd)
+		}
+	}
+	fields := strings.Split(body, ",")
+	for _, c := range fields[0] {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return "", fmt.Errorf("invalid sentence type: %q", fields[0])
+		}
+	}
+	if fields[0] == "" {
+		return "", fmt.Errorf("missing sentence type: %q", cmd)
+	}
+
+	// the whole address field is used as the type, so it is kept as-is
+	return nmea.Sentence{Type: fields[0], Data: fields[1:]}.String(), nil
+}
+
 func (s *StmCommon) pause() (err error) {
 	_, err = s.sendCmd(nmea.Sentence{Type: "PSTMGPSSUSPEND"}.String(), true)
 	if err != nil {
@@ -522,10 +1268,16 @@ func (s *StmCommon) resume() (err error) {
 }
 
 func (s *StmCommon) write(data []byte) (err error) {
-	fmt.Printf("write: %s\n", string(data))
-	// add crlf
-	_, err = s.writer.Write(append(data, 0x0D, 0x0A))
-	if err != nil {
+	if !s.quiet {
+		fmt.Printf("write: %s\n", string(data))
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	// add crlf, in a new buffer so that the caller's buffer is not modified
+	line := make([]byte, len(data)+2)
+	copy(line, data)
+	copy(line[len(data):], "\r\n")
+	if err = writeAll(s.writer, line); err != nil {
 		err = fmt.Errorf("gnss/StmCommon.write: %w", err)
 		return
 	}
@@ -533,73 +1285,190 @@ func (s *StmCommon) write(data []byte) (err error) {
 	return
 }
 
-func (s *StmCommon) batchSendCmd(cmds []string, strict bool) (out []string, err error) {
+// writeAll writes all of data, retrying after short writes, which are possible
+// on serial ports. io.ErrShortWrite is returned if nothing could be written
+// after several attempts.
+func writeAll(w io.Writer, data []byte) error {
+	stalled := 0
+	for len(data) > 0 {
+		n, err := w.Write(data)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+
+		if n > 0 {
+			stalled = 0
+			continue
+		}
+		stalled++
+		if stalled >= writeRetries {
+			return fmt.Errorf("%w: %d bytes not written", io.ErrShortWrite, len(data))
+		}
+	}
+
+	return nil
+}
+
+// WriteRaw writes data to the device as-is, e.g. RTCM correction data. The
+// device must already be open, e.g. by Start, otherwise ErrNotOpen is
+// returned. The device can be closed while the data is written, which then
+// fails.
+func (s *StmCommon) WriteRaw(data []byte) (err error) {
+	s.refMu.Lock()
+	open, readOnly, w := s.openRefs > 0, s.readOnly, s.writer
+	s.refMu.Unlock()
+
+	if !open {
+		return fmt.Errorf("gnss/StmCommon.WriteRaw: %w", ErrNotOpen)
+	}
+	if readOnly {
+		return fmt.Errorf("gnss/StmCommon.WriteRaw: %w", ErrReadOnly)
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err = writeAll(w, data); err != nil {
+		err = fmt.Errorf("gnss/StmCommon.WriteRaw: %w", err)
+	}
+
+	return
+}
+
+// batchResult is the result of sending a batch of commands with batchSendCmd
+type batchResult struct {
+	total  int
+	loaded int
+	// errors for the commands that failed after all retries
+	errs []error
+	// set if the remaining commands were not sent because the operation
+	// timed out
+	timedOut bool
+}
 
+// batchSendCmd sends each command, retrying commands that fail up to retries
+// more times. Commands that still fail are skipped.
+func (s *StmCommon) batchSendCmd(cmds []string, retries int) (res batchResult) {
+	res.total = len(cmds)
 	for _, c := range cmds {
-		out, err = s.sendCmd(c, true)
-		if err != nil {
-			err = fmt.Errorf("gnss/StmCommon.batchSendCmd: %s", err)
-			if strict {
+		var err error
+		for attempt := 0; attempt <= retries; attempt++ {
+			if err = s.sendRecord(c); err == nil {
+				break
+			}
+			if s.opExpired() {
+				res.errs = append(res.errs, err)
+				res.timedOut = true
 				return
 			}
-			fmt.Println(err)
+			fmt.Printf("gnss/StmCommon.batchSendCmd: attempt %d of %d: %s\n", attempt+1, retries+1, err)
 		}
+		if err != nil {
+			res.errs = append(res.errs, err)
+			continue
+		}
+		res.loaded++
 	}
+
 	return
 }
 
-func (s *StmCommon) loadEphemeris(path string) (err error) {
-	fd, err := os.Open(path)
+// sendRecord sends a command with AGPS data, and returns an error if the module
+// did not echo it or responded with an error for it
+func (s *StmCommon) sendRecord(cmd string) (err error) {
+	out, err := s.sendCmd(cmd, true)
 	if err != nil {
-		err = fmt.Errorf("gnss/StmCommon.loadEphemeris: %w", err)
 		return
 	}
-	defer fd.Close()
 
-	err = s.pause()
+	sentence, err := nmea.Parse(cmd)
 	if err != nil {
 		return
 	}
-	defer s.resume()
+	for _, o := range out {
+		if strings.Contains(o, sentence.Type+"ERROR") {
+			return fmt.Errorf("%s returned by module", sentence.Type+"ERROR")
+		}
+	}
 
-	var lines []string
-	scanner := bufio.NewScanner(fd)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+	return
+}
+
+// loadRecords sends the AGPS data records of the given type from the file at
+// path to the module, name is used in messages about them. An error is
+// returned if none of them could be loaded.
+func (s *StmCommon) loadRecords(path string, sType string, name string) (err error) {
+	lines, skipped, err := readRecords(path, sType)
+	if err != nil {
+		return
 	}
+	fmt.Printf("Loading %d %s records from %q, skipped %d invalid lines\n", len(lines), name, path, skipped)
 
-	_, err = s.batchSendCmd(lines, false)
+	// resumed even if pausing fails, since the module may have been paused
+	// without echoing the command in time
+	defer s.resume()
+	err = s.pause()
 	if err != nil {
-		return fmt.Errorf("gnss/StmCommon.loadEphemeris: %w", err)
+		return
+	}
+
+	res := s.batchSendCmd(lines, s.loadRetries)
+	fmt.Printf("Loaded %d/%d %s records, %d failed\n", res.loaded, res.total, name, len(res.errs))
+	if res.timedOut {
+		return fmt.Errorf("stopped loading %s records: %w", name, res.errs[len(res.errs)-1])
+	}
+	if res.loaded == 0 {
+		return fmt.Errorf("no %s records loaded: %w", name, res.errs[len(res.errs)-1])
+	}
+
+	return
+}
+
+func (s *StmCommon) loadEphemeris(path string) (err error) {
+	if err = s.loadRecords(path, "PSTMEPHEM", "ephemeris"); err != nil {
+		err = fmt.Errorf("gnss/StmCommon.loadEphemeris: %w", err)
 	}
 
 	return
 }
 
 func (s *StmCommon) loadAlmanac(path string) (err error) {
-	fd, err := os.Open(path)
-	if err != nil {
+	if err = s.loadRecords(path, "PSTMALMANAC", "almanac"); err != nil {
 		err = fmt.Errorf("gnss/StmCommon.loadAlmanac: %w", err)
-		return
 	}
-	defer fd.Close()
 
-	err = s.pause()
+	return
+}
+
+// readRecords reads the lines from the AGPS data file at path that are valid
+// sentences of the given type, and counts the lines that are skipped. The file
+// may be gzip-compressed. An error is returned if there are no valid lines,
+// e.g. because the file is empty, or has the wrong type of data.
+func readRecords(path string, sType string) (lines []string, skipped int, err error) {
+	fd, err := openCacheFile(path)
 	if err != nil {
 		return
 	}
-	defer s.resume()
-
-	var lines []string
+	defer fd.Close()
 
 	scanner := bufio.NewScanner(fd)
 	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if sentence, perr := nmea.Parse(line); perr != nil || sentence.Type != sType {
+			skipped++
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err = scanner.Err(); err != nil {
+		return
 	}
 
-	_, err = s.batchSendCmd(lines, false)
-	if err != nil {
-		return fmt.Errorf("gnss/StmCommon.loadAlmanac: %w", err)
+	if len(lines) == 0 {
+		err = fmt.Errorf("no %s records found in %q, skipped %d invalid lines", sType, path, skipped)
 	}
 
 	return
@@ -0,0 +1,1148 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package gnss
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/nmea"
+)
+
+// fakeModule is a transport that responds to commands written to it with
+// canned responses, followed by the echoed command.
+type fakeModule struct {
+	// lines sent by the module in response to a command type
+	responses map[string][]string
+	// commands written to the module
+	written []string
+	out     bytes.Buffer
+	// protects out, which is read by the goroutine reading lines
+	mu sync.Mutex
+	// sent before and after each echo, e.g. to simulate noise
+	echoPrefix string
+	echoSuffix string
+	// how long each write takes, to simulate a slow module
+	delay time.Duration
+	// command types that are not echoed, e.g. because the module stopped
+	// responding
+	noEcho map[string]bool
+	// if set, reads block until it is closed, like reads from a module that
+	// stopped sending anything
+	stalled chan struct{}
+}
+
+func (f *fakeModule) Write(p []byte) (int, error) {
+	time.Sleep(f.delay)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmd := strings.TrimRight(string(p), "\r\n")
+	f.written = append(f.written, cmd)
+
+	s, err := nmea.Parse(cmd)
+	if err == nil {
+		for _, l := range f.responses[s.Type] {
+			f.out.WriteString(l + "\r\n")
+		}
+	}
+	if !f.noEcho[s.Type] {
+		f.out.WriteString(f.echoPrefix + cmd + f.echoSuffix + "\r\n")
+	}
+
+	return len(p), nil
+}
+
+func (f *fakeModule) Read(p []byte) (int, error) {
+	if f.stalled != nil {
+		<-f.stalled
+		return 0, io.EOF
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.out.Read(p)
+}
+
+// writtenTypes returns the sentence types of the commands written to the
+// module
+func (f *fakeModule) writtenTypes() (types []string) {
+	for _, w := range f.written {
+		s, _ := nmea.Parse(w)
+		types = append(types, s.Type)
+	}
+	return
+}
+
+// stmFake is a STM module using a fake transport
+type stmFake struct {
+	StmCommon
+	// returned by open
+	openErr error
+}
+
+func newStmFake(module *fakeModule) *stmFake {
+	s := stmFake{}
+	s.StmCommon.Stm = &s
+	s.setTransport(module)
+
+	return &s
+}
+
+func (s *stmFake) open(mode openMode) (err error) {
+	return s.openErr
+}
+
+func (s *stmFake) close() (err error) {
+	return
+}
+
+func (s *stmFake) ready() (bool, error) {
+	return true, nil
+}
+
+func sentence(sType string, data ...string) string {
+	return nmea.Sentence{Type: sType, Data: data}.String()
+}
+
+// Test sending commands and collecting the output until the echo
+func TestSendCmd(t *testing.T) {
+	tables := []struct {
+		cmd       string
+		responses map[string][]string
+		expected  []string
+	}{
+		{sentence("PSTMGPSSUSPEND"), nil, nil},
+		{sentence("PSTMGETPAR", "201"), map[string][]string{
+			"PSTMGETPAR": {sentence("GPGGA"), sentence("PSTMSETPAR", "201", "0x1")},
+		}, []string{sentence("GPGGA"), sentence("PSTMSETPAR", "201", "0x1")}},
+	}
+
+	for _, table := range tables {
+		module := &fakeModule{responses: table.responses}
+		stm := newStmFake(module)
+
+		out, err := stm.sendCmd(table.cmd, true)
+		if err != nil {
+			t.Errorf("%q unexpected error: %s", table.cmd, err)
+			continue
+		}
+		if strings.Join(out, "\n") != strings.Join(table.expected, "\n") {
+			t.Errorf("%q expected: %q, got: %q", table.cmd, table.expected, out)
+		}
+	}
+}
+
+// Test that the echo is found when there is noise around it
+func TestSendCmdNoisyEcho(t *testing.T) {
+	tables := []struct {
+		prefix string
+		suffix string
+		// output returned besides the responses
+		extra []string
+	}{
+		{"\x00\x00", "", nil},
+		{"", " \r", nil},
+		{"\x00", "\x00\x00", nil},
+		{sentence("GPGGA") + "\r\n\x00", "\t", []string{sentence("GPGGA")}},
+		{"$GPG", "", []string{"$GPG"}},
+	}
+
+	for _, table := range tables {
+		module := &fakeModule{
+			responses: map[string][]string{
+				"PSTMGETPAR": {sentence("GPGSV"), sentence("PSTMSETPAR", "201", "0x1")},
+			},
+			echoPrefix: table.prefix,
+			echoSuffix: table.suffix,
+		}
+		stm := newStmFake(module)
+
+		out, err := stm.sendCmd(sentence("PSTMGETPAR", "201"), true)
+		if err != nil {
+			t.Errorf("%q, %q unexpected error: %s", table.prefix, table.suffix, err)
+			continue
+		}
+		// noise on lines before the echo, or before it on the same line,
+		// is returned as output
+		expected := append([]string{sentence("GPGSV"), sentence("PSTMSETPAR", "201", "0x1")}, table.extra...)
+		if strings.Join(out, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("%q, %q expected: %q, got: %q", table.prefix, table.suffix, expected, out)
+		}
+	}
+}
+
+// Test that sendCmd fails if the module never echoes the command
+func TestSendCmdNoEcho(t *testing.T) {
+	stm := newStmFake(&fakeModule{})
+	// replace the writer so that nothing is echoed
+	stm.writer = &bytes.Buffer{}
+
+	if _, err := stm.sendCmd(sentence("PSTMGPSSUSPEND"), true); err == nil {
+		t.Errorf("expected error when command is not echoed")
+	}
+}
+
+// Test that sendCmd fails after the command timeout if the module stopped
+// sending anything
+func TestSendCmdStalled(t *testing.T) {
+	module := &fakeModule{stalled: make(chan struct{})}
+	defer close(module.stalled)
+	stm := newStmFake(module)
+	stm.SetCommandTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := stm.sendCmd(sentence("PSTMGPSSUSPEND"), true); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected error: %v, got: %v", ErrTimeout, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected to time out after 50ms, took: %s", elapsed)
+	}
+}
+
+// shortWriter writes at most max bytes at a time, and nothing once stall
+// writes have been made
+type shortWriter struct {
+	bytes.Buffer
+	max    int
+	writes int
+	stall  int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.stall > 0 && w.writes > w.stall {
+		return 0, nil
+	}
+	if len(p) > w.max {
+		p = p[:w.max]
+	}
+	return w.Buffer.Write(p)
+}
+
+// Test that commands are written completely when the writer only writes part
+// of them at a time
+func TestWriteShort(t *testing.T) {
+	cmd := []byte(sentence("PSTMGPSSUSPEND"))
+	// with spare capacity, so that appending to it would modify the
+	// backing array
+	data := make([]byte, len(cmd), len(cmd)+10)
+	copy(data, cmd)
+
+	tables := []struct {
+		writer    *shortWriter
+		expected  string
+		expectErr bool
+	}{
+		{&shortWriter{max: 3}, string(cmd) + "\r\n", false},
+		{&shortWriter{max: 1}, string(cmd) + "\r\n", false},
+		{&shortWriter{max: 3, stall: 2}, string(cmd[:6]), true},
+	}
+
+	for _, table := range tables {
+		stm := newStmFake(&fakeModule{})
+		stm.writer = table.writer
+
+		err := stm.write(data)
+		if table.expectErr != (err != nil) {
+			t.Errorf("max %d, stall %d: expected error: %t, got: %v", table.writer.max, table.writer.stall, table.expectErr, err)
+		}
+		if got := table.writer.String(); got != table.expected {
+			t.Errorf("max %d, stall %d: expected: %q, got: %q", table.writer.max, table.writer.stall, table.expected, got)
+		}
+		if string(data[:cap(data)][len(cmd):len(cmd)+2]) == "\r\n" {
+			t.Errorf("caller's buffer was modified")
+		}
+	}
+}
+
+// Test waiting for the boot message, which is checked until the ready timeout
+// even if the module sends nothing
+func TestStmGnssReady(t *testing.T) {
+	booted := nmea.Sentence{Talker: "GP", Type: "TXT", Data: []string{"DEFAULT LIV CONFIGURATION"}}.String()
+
+	tables := []struct {
+		name     string
+		lines    []string
+		stalled  bool
+		ready    bool
+		expected error
+	}{
+		{"booted", []string{sentence("GPGGA"), booted}, false, true, nil},
+		{"closed", []string{sentence("GPGGA")}, false, false, io.EOF},
+		{"stalled", nil, true, false, ErrDeviceNotReady},
+	}
+
+	for _, table := range tables {
+		module := &fakeModule{}
+		for _, l := range table.lines {
+			module.out.WriteString(l + "\r\n")
+		}
+		if table.stalled {
+			module.stalled = make(chan struct{})
+		}
+		stm := NewStmGnss("/dev/null")
+		stm.SetReadyWait(50*time.Millisecond, 0)
+		stm.setTransport(module)
+
+		start := time.Now()
+		ready, err := stm.ready()
+		if ready != table.ready {
+			t.Errorf("%s: expected ready: %t, got: %t", table.name, table.ready, ready)
+		}
+		if !errors.Is(err, table.expected) {
+			t.Errorf("%s: expected error: %v, got: %v", table.name, table.expected, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: expected to time out after 50ms, took: %s", table.name, elapsed)
+		}
+		if module.stalled != nil {
+			close(module.stalled)
+		}
+	}
+}
+
+// Test that the device is opened read-only for streaming if the user is not
+// allowed to write to it, and that writing to it then fails with ErrReadOnly,
+// while opening it for commands fails with the permission error
+func TestOpenReadOnly(t *testing.T) {
+	booted := nmea.Sentence{Talker: "GP", Type: "TXT", Data: []string{"DEFAULT LIV CONFIGURATION"}}.String()
+	path := filepath.Join(t.TempDir(), "gnss0")
+	if err := os.WriteFile(path, []byte(booted+"\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []struct {
+		name string
+		// returned when opening the device for writing
+		writeErr error
+		mode     openMode
+		// expected from open
+		expected error
+		readOnly bool
+	}{
+		{"stream EACCES", syscall.EACCES, openStream, nil, true},
+		{"stream EPERM", syscall.EPERM, openStream, nil, true},
+		{"stream EROFS", syscall.EROFS, openStream, nil, true},
+		{"stream ENOENT", syscall.ENOENT, openStream, syscall.ENOENT, false},
+		{"stream writable", nil, openStream, nil, false},
+		{"command EACCES", syscall.EACCES, openCommand, syscall.EACCES, false},
+		{"command EROFS", syscall.EROFS, openCommand, syscall.EROFS, false},
+		{"command writable", nil, openCommand, nil, false},
+	}
+
+	for _, table := range tables {
+		stm := NewStmGnss(path)
+		stm.SetReadyWait(time.Second, 0)
+		writeErr := table.writeErr
+		stm.openFile = func(path string, flag int) (int, error) {
+			if flag&(os.O_WRONLY|os.O_RDWR) != 0 && writeErr != nil {
+				return -1, writeErr
+			}
+			return syscall.Open(path, os.O_RDONLY, 0)
+		}
+
+		err := stm.open(table.mode)
+		if !errors.Is(err, table.expected) || (table.expected == nil && err != nil) {
+			t.Errorf("%s: expected error: %v, got: %v", table.name, table.expected, err)
+		}
+		if err != nil {
+			continue
+		}
+		if stm.readOnly != table.readOnly {
+			t.Errorf("%s: expected read-only: %t, got: %t", table.name, table.readOnly, stm.readOnly)
+		}
+
+		// the device is already open, so nothing is written to it
+		rawErr := stm.WriteRaw(nil)
+		_, cmdErr := stm.SendCommand("$PSTMGPSSUSPEND", false)
+		if table.readOnly {
+			if !errors.Is(rawErr, ErrReadOnly) {
+				t.Errorf("%s: WriteRaw expected error: %v, got: %v", table.name, ErrReadOnly, rawErr)
+			}
+			if !errors.Is(cmdErr, ErrReadOnly) {
+				t.Errorf("%s: SendCommand expected error: %v, got: %v", table.name, ErrReadOnly, cmdErr)
+			}
+		} else if errors.Is(rawErr, ErrReadOnly) || errors.Is(cmdErr, ErrReadOnly) {
+			t.Errorf("%s: unexpected errors: %v, %v", table.name, rawErr, cmdErr)
+		}
+		stm.close()
+	}
+}
+
+// Test waiting for valid sentences on a serial port, which is checked until
+// the ready timeout even if the module sends nothing
+func TestStmSerialReady(t *testing.T) {
+	tables := []struct {
+		name     string
+		lines    []string
+		stalled  bool
+		ready    bool
+		expected error
+	}{
+		{"valid", []string{"garbage", sentence("GPGGA"), sentence("GPRMC"), sentence("GPGSV")}, false, true, nil},
+		{"closed", []string{"garbage", sentence("GPGGA")}, false, false, io.EOF},
+		{"stalled", nil, true, false, ErrDeviceNotReady},
+	}
+
+	for _, table := range tables {
+		module := &fakeModule{}
+		for _, l := range table.lines {
+			module.out.WriteString(l + "\r\n")
+		}
+		if table.stalled {
+			module.stalled = make(chan struct{})
+		}
+		stm := NewStmSerial("/dev/null", 9600)
+		stm.SetReadyWait(50*time.Millisecond, 0)
+		stm.setTransport(module)
+
+		start := time.Now()
+		ready, err := stm.ready()
+		if ready != table.ready {
+			t.Errorf("%s: expected ready: %t, got: %t", table.name, table.ready, ready)
+		}
+		if !errors.Is(err, table.expected) {
+			t.Errorf("%s: expected error: %v, got: %v", table.name, table.expected, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: expected to time out after 50ms, took: %s", table.name, elapsed)
+		}
+		if module.stalled != nil {
+			close(module.stalled)
+		}
+	}
+}
+
+// scriptedRead is the result of a read from scriptedReader
+type scriptedRead struct {
+	data string
+	err  error
+}
+
+// scriptedReader returns the given reads in order, then fails with ENODEV
+type scriptedReader struct {
+	reads []scriptedRead
+}
+
+func (r *scriptedReader) Read(p []byte) (n int, err error) {
+	if len(r.reads) == 0 {
+		return 0, syscall.ENODEV
+	}
+	n = copy(p, r.reads[0].data)
+	err = r.reads[0].err
+	r.reads = r.reads[1:]
+	return
+}
+
+// Test that reads from a serial port that timed out are retried while the
+// device is present
+func TestTimeoutReader(t *testing.T) {
+	present := filepath.Join(t.TempDir(), "ttyUSB0")
+	if err := os.WriteFile(present, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	gga := sentence("GPGGA")
+
+	tables := []struct {
+		path     string
+		reads    []scriptedRead
+		expected []string
+		err      error
+	}{
+		{present, []scriptedRead{{gga[:5], nil}, {"", io.EOF}, {gga[5:] + "\r\n", nil}}, []string{gga}, syscall.ENODEV},
+		{present + ".gone", []scriptedRead{{gga + "\r\n", nil}, {"", io.EOF}, {gga + "\r\n", nil}}, []string{gga}, io.EOF},
+	}
+
+	for _, table := range tables {
+		stm := newStmFake(&fakeModule{})
+		stm.setTransport(serialTransport(struct {
+			io.Reader
+			io.Writer
+		}{&scriptedReader{reads: table.reads}, io.Discard}, table.path))
+
+		var out []string
+		var err error
+		for {
+			var line string
+			line, err = stm.readline(time.Time{})
+			if err != nil {
+				break
+			}
+			out = append(out, line)
+		}
+		if !errors.Is(err, table.err) {
+			t.Errorf("%s: expected error: %v, got: %v", table.path, table.err, err)
+		}
+		if strings.Join(out, "\n") != strings.Join(table.expected, "\n") {
+			t.Errorf("%s: expected: %q, got: %q", table.path, table.expected, out)
+		}
+	}
+}
+
+// blockingWriter blocks writes until unblock is closed
+type blockingWriter struct {
+	bytes.Buffer
+	writing chan struct{}
+	unblock chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	close(w.writing)
+	<-w.unblock
+	return w.Buffer.Write(p)
+}
+
+// Test writing raw data, which requires the device to be open for writing
+func TestWriteRaw(t *testing.T) {
+	tables := []struct {
+		name     string
+		openRefs int
+		readOnly bool
+		err      error
+	}{
+		{"closed", 0, false, ErrNotOpen},
+		{"read-only", 1, true, ErrReadOnly},
+		{"open", 1, false, nil},
+	}
+
+	for _, table := range tables {
+		stm := newStmFake(&fakeModule{})
+		w := &bytes.Buffer{}
+		stm.writer = w
+		stm.openRefs = table.openRefs
+		stm.readOnly = table.readOnly
+
+		err := stm.WriteRaw([]byte("\xd3\x00\x13"))
+		if !errors.Is(err, table.err) {
+			t.Errorf("%s: expected error: %v, got: %v", table.name, table.err, err)
+		}
+		expected := ""
+		if table.err == nil {
+			expected = "\xd3\x00\x13"
+		}
+		if w.String() != expected {
+			t.Errorf("%s: expected written: %q, got: %q", table.name, expected, w.String())
+		}
+	}
+}
+
+// Test that the device can be closed while raw data is being written
+func TestWriteRawBlocked(t *testing.T) {
+	stm := newStmFake(&fakeModule{})
+	w := &blockingWriter{writing: make(chan struct{}), unblock: make(chan struct{})}
+	stm.writer = w
+	stm.openRefs = 1
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- stm.WriteRaw([]byte("data"))
+	}()
+	<-w.writing
+
+	locked := make(chan struct{})
+	go func() {
+		stm.refMu.Lock()
+		stm.openRefs = 0
+		stm.refMu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Errorf("refMu is held while writing")
+	}
+
+	close(w.unblock)
+	if err := <-errCh; err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	<-locked
+}
+
+// Test validating and adding checksums to commands given by the user
+func TestRawCommand(t *testing.T) {
+	tables := []struct {
+		in        string
+		expected  string
+		expectErr bool
+	}{
+		{"$PSTMGPSSUSPEND", "$PSTMGPSSUSPEND,*38", false},
+		{"$PSTMGPSSUSPEND,", "$PSTMGPSSUSPEND,*38", false},
+		{" $PSTMGPSSUSPEND,*38\n", "$PSTMGPSSUSPEND,*38", false},
+		{"$PSTMGETPAR,1201", sentence("PSTMGETPAR", "1201"), false},
+		{"$PSTMGPSSUSPEND,*39", "", true},
+		{"PSTMGPSSUSPEND", "", true},
+		{"$", "", true},
+		{"$pstmsrr", "", true},
+		{"$PSTMGETPAR,1201\r\n$PSTMSRR", "", true},
+		{"$PSTMGETPAR,$1201", "", true},
+	}
+
+	for _, table := range tables {
+		out, err := rawCommand(table.in)
+		if table.expectErr {
+			if err == nil {
+				t.Errorf("%q expected error, got: %q", table.in, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q unexpected error: %s", table.in, err)
+			continue
+		}
+		if out != table.expected {
+			t.Errorf("%q expected: %q, got: %q", table.in, table.expected, out)
+		}
+	}
+}
+
+// Test that lines that are too long are skipped
+func TestReadlineTooLong(t *testing.T) {
+	module := &fakeModule{}
+	module.out.WriteString(sentence("GPGGA") + "\r\n")
+	module.out.WriteString(strings.Repeat("\xff", 250) + "\r\n")
+	module.out.WriteString(strings.Repeat("x", 101) + "\n")
+	module.out.WriteString(strings.Repeat("x", 99) + "\r\n")
+	module.out.WriteString(sentence("GPRMC") + "\r\n")
+	module.out.WriteString(strings.Repeat("\x00", 300))
+
+	stm := newStmFake(module)
+	stm.SetMaxLineLength(100)
+	stm.setTransport(module)
+
+	expected := []string{sentence("GPGGA"), strings.Repeat("x", 99), sentence("GPRMC")}
+	var out []string
+	for {
+		line, err := stm.readline(time.Time{})
+		if err != nil {
+			break
+		}
+		out = append(out, line)
+	}
+	if strings.Join(out, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected: %q, got: %q", expected, out)
+	}
+}
+
+// Test that each line is split into clean sentences
+func TestReadlineSentences(t *testing.T) {
+	gga := sentence("GPGGA")
+	rmc := sentence("GPRMC")
+	tables := []struct {
+		in       string
+		expected []string
+	}{
+		{"\x00\x00" + gga + "\r\n" + rmc + "\r\n", []string{gga, rmc}},
+		{gga + rmc + "\r\n", []string{gga, rmc}},
+		{"\x00" + gga + "\x00" + rmc + "\x00\r\n\x00\r\n", []string{gga, rmc, ""}},
+		{"garbage" + gga + "\n", []string{"garbage", gga}},
+		// at EOF without a newline
+		{"\x00\x00" + gga + rmc, []string{gga, rmc}},
+	}
+
+	for _, table := range tables {
+		module := &fakeModule{}
+		module.out.WriteString(table.in)
+		stm := newStmFake(module)
+
+		var out []string
+		for {
+			line, err := stm.readline(time.Time{})
+			if err != nil {
+				break
+			}
+			out = append(out, line)
+		}
+		if strings.Join(out, "\n") != strings.Join(table.expected, "\n") {
+			t.Errorf("%q expected: %q, got: %q", table.in, table.expected, out)
+		}
+	}
+}
+
+// flakyReader returns the given errors from reads, in order, before reading
+// the rest of the buffer. The first read returns the first partial bytes along
+// with the first error, so that the error interrupts a line.
+type flakyReader struct {
+	bytes.Buffer
+	errs    []error
+	partial int
+}
+
+func (r *flakyReader) Read(p []byte) (n int, err error) {
+	if len(r.errs) == 0 {
+		return r.Buffer.Read(p)
+	}
+	if r.partial > 0 {
+		n, _ = r.Buffer.Read(p[:r.partial])
+		r.partial = 0
+	}
+	err = r.errs[0]
+	r.errs = r.errs[1:]
+	return
+}
+
+// Test that reading lines continues after transient errors, and stops on
+// other errors
+func TestReadlineTransientError(t *testing.T) {
+	tables := []struct {
+		errs     []error
+		partial  int
+		expected []string
+		err      error
+	}{
+		{[]error{syscall.EINTR, syscall.EAGAIN, &os.PathError{Op: "read", Path: "/dev/gnss0", Err: syscall.EINTR}}, 5, []string{sentence("GPGGA"), sentence("GPRMC")}, io.EOF},
+		{[]error{syscall.EINTR}, 0, []string{sentence("GPGGA"), sentence("GPRMC")}, io.EOF},
+		{[]error{syscall.ENODEV}, 0, nil, syscall.ENODEV},
+	}
+
+	for _, table := range tables {
+		reader := &flakyReader{errs: table.errs, partial: table.partial}
+		reader.WriteString(sentence("GPGGA") + "\r\n" + sentence("GPRMC") + "\r\n")
+		stm := newStmFake(&fakeModule{})
+		stm.setTransport(struct {
+			io.Reader
+			io.Writer
+		}{reader, &bytes.Buffer{}})
+
+		var out []string
+		var err error
+		for {
+			var line string
+			line, err = stm.readline(time.Time{})
+			if err != nil {
+				break
+			}
+			out = append(out, line)
+		}
+		if !errors.Is(err, table.err) {
+			t.Errorf("errors %v: expected error: %v, got: %v", table.errs, table.err, err)
+		}
+		if strings.Join(out, "\n") != strings.Join(table.expected, "\n") {
+			t.Errorf("errors %v: expected: %q, got: %q", table.errs, table.expected, out)
+		}
+	}
+}
+
+// Test getting parameters from the module
+func TestGetParam(t *testing.T) {
+	tables := []struct {
+		cdbId     int
+		responses []string
+		expected  string
+		expectErr bool
+	}{
+		{201, []string{sentence("PSTMSETPAR", "201", "0x00000041")}, "0x00000041", false},
+		{303, []string{sentence("GPRMC"), sentence("PSTMSETPAR", "303", "1.000000e+00")}, "1.000000e+00", false},
+		{201, []string{sentence("PSTMGETPARERROR")}, "", true},
+		{201, nil, "", true},
+	}
+
+	for _, table := range tables {
+		module := &fakeModule{responses: map[string][]string{"PSTMGETPAR": table.responses}}
+		stm := newStmFake(module)
+
+		val, err := stm.GetParam(table.cdbId)
+		if table.expectErr {
+			if err == nil {
+				t.Errorf("%d, %q expected error, got: %q", table.cdbId, table.responses, val)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d, %q unexpected error: %s", table.cdbId, table.responses, err)
+			continue
+		}
+		if val.Raw != table.expected {
+			t.Errorf("%d, %q expected: %q, got: %q", table.cdbId, table.responses, table.expected, val.Raw)
+		}
+	}
+}
+
+// Test setting parameters, which are saved and the module reset on success,
+// unless they should not be saved
+func TestSetParam(t *testing.T) {
+	tables := []struct {
+		responses map[string][]string
+		save      bool
+		expected  []string
+		expectErr error
+	}{
+		{nil, true, []string{"PSTMGPSSUSPEND", "PSTMSETPAR", "PSTMSAVEPAR", "PSTMSRR"}, nil},
+		{nil, false, []string{"PSTMGPSSUSPEND", "PSTMSETPAR", "PSTMGPSRESTART"}, nil},
+		{map[string][]string{
+			"PSTMSETPAR": {sentence("PSTMSETPARERROR")},
+		}, true, []string{"PSTMGPSSUSPEND", "PSTMSETPAR", "PSTMGPSRESTART"}, ErrParamSet},
+	}
+
+	for _, table := range tables {
+		module := &fakeModule{responses: table.responses}
+		stm := newStmFake(module)
+
+		err := stm.SetParam(201, 0x41, table.save)
+		if table.expectErr != nil && !errors.Is(err, table.expectErr) {
+			t.Errorf("%q expected error: %v, got: %v", table.responses, table.expectErr, err)
+		} else if table.expectErr == nil && err != nil {
+			t.Errorf("%q unexpected error: %s", table.responses, err)
+		}
+
+		written := module.writtenTypes()
+		if strings.Join(written, ",") != strings.Join(table.expected, ",") {
+			t.Errorf("%q expected commands: %q, got: %q", table.responses, table.expected, written)
+		}
+	}
+}
+
+// Test that parameters are set in the given configuration block
+func TestSetParamsBlock(t *testing.T) {
+	tables := []struct {
+		param    Param
+		expected string
+	}{
+		{Param{CdbId: 201, Value: 0x41}, sentence("PSTMSETPAR", "3201", "0x00000041", "0")},
+		{Param{CdbId: 201, Value: 0x41, Block: BlockCurrent}, sentence("PSTMSETPAR", "1201", "0x00000041", "0")},
+		{Param{CdbId: 303, Text: "0.2"}, sentence("PSTMSETPAR", "3303", "0.2", "0")},
+	}
+
+	for _, table := range tables {
+		module := &fakeModule{}
+		stm := newStmFake(module)
+
+		if _, err := stm.SetParams([]Param{table.param}, true); err != nil {
+			t.Errorf("%+v unexpected error: %s", table.param, err)
+			continue
+		}
+		if len(module.written) < 2 || module.written[1] != table.expected {
+			t.Errorf("%+v expected: %q, got: %q", table.param, table.expected, module.written)
+		}
+	}
+}
+
+// Test that records that fail to load are retried, and counted
+func TestBatchSendCmd(t *testing.T) {
+	records := []string{sentence("PSTMEPHEM", "1", "64", "0a0bfe01"), sentence("PSTMEPHEM", "2", "64", "0a0bfe01")}
+
+	tables := []struct {
+		responses map[string][]string
+		retries   int
+		loaded    int
+		writes    int
+	}{
+		{nil, 2, 2, 2},
+		{map[string][]string{"PSTMEPHEM": {sentence("PSTMEPHEMERROR")}}, 2, 0, 6},
+		{map[string][]string{"PSTMEPHEM": {sentence("PSTMEPHEMERROR")}}, 0, 0, 2},
+	}
+
+	for _, table := range tables {
+		module := &fakeModule{responses: table.responses}
+		stm := newStmFake(module)
+
+		res := stm.batchSendCmd(records, table.retries)
+		if res.total != len(records) || res.loaded != table.loaded || len(res.errs) != len(records)-table.loaded {
+			t.Errorf("%q, %d retries: expected %d/%d loaded, got: %+v", table.responses, table.retries, table.loaded, len(records), res)
+		}
+		if len(module.written) != table.writes {
+			t.Errorf("%q, %d retries: expected %d writes, got: %d", table.responses, table.retries, table.writes, len(module.written))
+		}
+	}
+}
+
+// Test that only ephemeris/almanac records from dumps are saved
+func TestSave(t *testing.T) {
+	ephem := []string{
+		sentence("PSTMEPHEM", "1", "64", "0a0bfe01"),
+		sentence("PSTMEPHEM", "2", "64", "0a0bfe02"),
+	}
+	almanac := []string{
+		sentence("PSTMALMANAC", "1", "32", "0a0b"),
+	}
+
+	for _, compress := range []bool{false, true} {
+		module := &fakeModule{responses: map[string][]string{
+			"PSTMDUMPEPHEMS":  append([]string{sentence("GPGGA")}, ephem...),
+			"PSTMDUMPALMANAC": append(almanac, sentence("GPRMC")),
+		}}
+		stm := newStmFake(module)
+
+		cache := AgpsCache{Dir: t.TempDir(), Compress: compress}
+		if err := stm.Save(cache); err != nil {
+			t.Fatalf("compress %t unexpected error: %s", compress, err)
+		}
+
+		for path, expected := range map[string][]string{cache.EphemerisPath(): ephem, cache.AlmanacPath(): almanac} {
+			contents, err := readFile(path, compress)
+			if err != nil {
+				t.Errorf("%q unable to read saved file: %s", path, err)
+				continue
+			}
+			if string(contents) != strings.Join(expected, "\n")+"\n" {
+				t.Errorf("%q expected: %q, got: %q", path, expected, string(contents))
+			}
+		}
+	}
+}
+
+// readFile reads the file at path, decompressing it if compressed is set
+func readFile(path string, compressed bool) ([]byte, error) {
+	if !compressed {
+		return os.ReadFile(path)
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	gz, err := gzip.NewReader(fd)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(gz)
+}
+
+// Test that saving stops once it took longer than the operation timeout, and
+// that the module is resumed
+func TestSaveTimeout(t *testing.T) {
+	module := &fakeModule{
+		responses: map[string][]string{
+			"PSTMDUMPEPHEMS": {"$PSTMEPHEM,1,64,0a0bfe01*05"},
+		},
+		delay: 40 * time.Millisecond,
+	}
+	stm := newStmFake(module)
+	stm.SetOperationTimeout(60 * time.Millisecond)
+
+	err := stm.Save(AgpsCache{Dir: t.TempDir()})
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected error: %v, got: %v", ErrTimeout, err)
+	}
+	expected := []string{"PSTMGPSSUSPEND", "PSTMDUMPEPHEMS", "PSTMGPSRESTART"}
+	if written := module.writtenTypes(); strings.Join(written, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected commands: %q, got: %q", expected, written)
+	}
+}
+
+// Test that saving stops at the operation timeout when the module stopped
+// sending anything, and that the module is resumed
+func TestSaveStalled(t *testing.T) {
+	module := &fakeModule{stalled: make(chan struct{})}
+	defer close(module.stalled)
+	stm := newStmFake(module)
+	stm.SetOperationTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	err := stm.Save(AgpsCache{Dir: t.TempDir()})
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected error: %v, got: %v", ErrTimeout, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected to time out after 50ms, took: %s", elapsed)
+	}
+	expected := []string{"PSTMGPSSUSPEND", "PSTMGPSRESTART"}
+	if written := module.writtenTypes(); strings.Join(written, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected commands: %q, got: %q", expected, written)
+	}
+}
+
+// Test that a line received after readline timed out is returned by the next
+// call
+func TestReadlineDeadline(t *testing.T) {
+	r, w := io.Pipe()
+	stm := newStmFake(&fakeModule{})
+	stm.setTransport(struct {
+		io.Reader
+		io.Writer
+	}{r, io.Discard})
+
+	if _, err := stm.readline(time.Now().Add(20 * time.Millisecond)); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected error: %v, got: %v", ErrTimeout, err)
+	}
+
+	line := sentence("GPGGA")
+	go w.Write([]byte(line + "\r\n"))
+	got, err := stm.readline(time.Time{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != line {
+		t.Errorf("expected: %q, got: %q", line, got)
+	}
+
+	w.Close()
+	if _, err := stm.readline(time.Time{}); err != io.EOF {
+		t.Errorf("expected error: %v, got: %v", io.EOF, err)
+	}
+}
+
+// Test that stored data is only replaced by complete dumps
+func TestSaveIncomplete(t *testing.T) {
+	ephem := sentence("PSTMEPHEM", "1", "64", "0a0bfe01")
+	tables := []struct {
+		dump      []string
+		echo      bool
+		expectErr bool
+	}{
+		{[]string{ephem}, true, false},
+		// cut off
+		{[]string{ephem, ephem[:12]}, true, true},
+		// the module stopped responding before the end of the dump
+		{[]string{ephem}, false, true},
+		// no data, the stored data is kept
+		{nil, true, false},
+	}
+
+	for _, table := range tables {
+		module := &fakeModule{
+			responses: map[string][]string{"PSTMDUMPEPHEMS": table.dump},
+			noEcho:    map[string]bool{"PSTMDUMPEPHEMS": !table.echo},
+		}
+		stm := newStmFake(module)
+
+		path := filepath.Join(t.TempDir(), EphemerisFile)
+		if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+			t.Fatalf("unable to write file: %s", err)
+		}
+
+		err := stm.saveEphemeris(path)
+		if table.expectErr != (err != nil) {
+			t.Errorf("%q expected error: %t, got: %v", table.dump, table.expectErr, err)
+		}
+
+		contents, _ := os.ReadFile(path)
+		expected := "old\n"
+		if !table.expectErr && len(table.dump) > 0 {
+			expected = strings.Join(table.dump, "\n") + "\n"
+		}
+		if string(contents) != expected {
+			t.Errorf("%q expected file: %q, got: %q", table.dump, expected, contents)
+		}
+		if _, err := os.Stat(path + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%q temporary file left behind: %v", table.dump, err)
+		}
+	}
+}
+
+// Test that AGPS data is not stored or loaded if the device can't be opened
+func TestSaveLoadOpenError(t *testing.T) {
+	openErr := syscall.ENOENT
+	module := &fakeModule{}
+	stm := newStmFake(module)
+	stm.openErr = openErr
+
+	dir := t.TempDir()
+	cache := AgpsCache{Dir: filepath.Join(dir, "cache")}
+	if err := stm.Save(cache); !errors.Is(err, openErr) {
+		t.Errorf("Save expected error: %v, got: %v", openErr, err)
+	}
+	if err := stm.Load(cache, true); !errors.Is(err, openErr) {
+		t.Errorf("Load expected error: %v, got: %v", openErr, err)
+	}
+
+	if len(module.written) != 0 {
+		t.Errorf("expected no commands, got: %q", module.written)
+	}
+	if _, err := os.Stat(cache.Dir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected %q to not be created, got: %v", cache.Dir, err)
+	}
+}
+
+// Test that each type of AGPS data that is not stored is skipped when loading
+func TestLoadMissing(t *testing.T) {
+	ephem := sentence("PSTMEPHEM", "1", "64", "0a0bfe01")
+	alm := sentence("PSTMALMANAC", "1", "64", "0a0bfe01")
+
+	tables := []struct {
+		ephemeris bool
+		almanac   bool
+		expected  []string
+		err       error
+	}{
+		{true, true, []string{"PSTMGPSSUSPEND", "PSTMEPHEM", "PSTMGPSRESTART", "PSTMGPSSUSPEND", "PSTMALMANAC", "PSTMGPSRESTART"}, nil},
+		{false, true, []string{"PSTMGPSSUSPEND", "PSTMALMANAC", "PSTMGPSRESTART"}, nil},
+		{true, false, []string{"PSTMGPSSUSPEND", "PSTMEPHEM", "PSTMGPSRESTART"}, nil},
+		{false, false, nil, ErrNoAgpsData},
+	}
+
+	for _, table := range tables {
+		cache := AgpsCache{Dir: t.TempDir()}
+		if table.ephemeris {
+			if err := os.WriteFile(cache.EphemerisPath(), []byte(ephem+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if table.almanac {
+			if err := os.WriteFile(cache.AlmanacPath(), []byte(alm+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		module := &fakeModule{}
+		stm := newStmFake(module)
+
+		err := stm.Load(cache, false)
+		if !errors.Is(err, table.err) {
+			t.Errorf("ephemeris %t, almanac %t: expected error: %v, got: %v", table.ephemeris, table.almanac, table.err, err)
+		}
+		if written := module.writtenTypes(); strings.Join(written, ",") != strings.Join(table.expected, ",") {
+			t.Errorf("ephemeris %t, almanac %t: expected commands: %q, got: %q", table.ephemeris, table.almanac, table.expected, written)
+		}
+	}
+}
+
+// Test that only valid records of the expected type are read from AGPS data
+// files
+func TestReadRecords(t *testing.T) {
+	ephem := "$PSTMEPHEM,1,64,0a0bfe01*51"
+	almanac := "$PSTMALMANAC,1,32,0a0b*48"
+	tables := []struct {
+		contents  string
+		expected  []string
+		skipped   int
+		expectErr bool
+	}{
+		{ephem + "\n" + ephem + "\n", []string{ephem, ephem}, 0, false},
+		{ephem + "\n\n" + almanac + "\n$PSTMEPHEM,1,64,0a0bfe01*05\n" + ephem[:10], []string{ephem}, 3, false},
+		{almanac + "\n", nil, 1, true},
+		{"", nil, 0, true},
+	}
+
+	for _, table := range tables {
+		// compressed files are detected by their contents, not the name
+		for _, compress := range []bool{false, true} {
+			path := filepath.Join(t.TempDir(), EphemerisFile)
+			contents := []byte(table.contents)
+			if compress {
+				var buf bytes.Buffer
+				gz := gzip.NewWriter(&buf)
+				gz.Write(contents)
+				gz.Close()
+				contents = buf.Bytes()
+			}
+			if err := os.WriteFile(path, contents, 0644); err != nil {
+				t.Fatalf("unable to write file: %s", err)
+			}
+
+			lines, skipped, err := readRecords(path, "PSTMEPHEM")
+			if table.expectErr {
+				if err == nil {
+					t.Errorf("%q compress %t expected error, got: %q", table.contents, compress, lines)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%q compress %t unexpected error: %s", table.contents, compress, err)
+				continue
+			}
+			if strings.Join(lines, "\n") != strings.Join(table.expected, "\n") || skipped != table.skipped {
+				t.Errorf("%q compress %t expected: %q, %d skipped, got: %q, %d skipped", table.contents, compress, table.expected, table.skipped, lines, skipped)
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package gnss
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// ErrGaveUp is returned by the Start method of a supervised driver once it was
+// restarted Backoff.MaxAttempts times in a row
+var ErrGaveUp = errors.New("gave up restarting the driver")
+
+// The restarts in a row are counted from 0 again once the driver has run for
+// this long without failing
+const supervisedResetAfter = time.Minute
+
+// Backoff is the policy for restarting a supervised driver that failed
+type Backoff struct {
+	// Delay before the first restart, which is doubled for each restart in
+	// a row up to Max
+	Initial time.Duration
+	Max     time.Duration
+	// Fraction of the delay that is randomly added or removed, e.g. 0.2 for
+	// up to 20%, so that multiple drivers don't restart in lockstep
+	Jitter float64
+	// Restarts in a row before giving up, not limited if 0
+	MaxAttempts int
+}
+
+// delay returns the delay before the given restart, counted from 1
+func (b Backoff) delay(attempt int) time.Duration {
+	d := b.Initial
+	for i := 1; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	if b.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * b.Jitter * float64(d))
+	}
+
+	return d
+}
+
+type supervised struct {
+	GnssDriver
+	policy Backoff
+}
+
+// Supervised wraps the driver, so that Start restarts it according to the
+// policy when it fails, until ctx is cancelled. Once it was restarted
+// policy.MaxAttempts times in a row, Start gives up and returns ErrGaveUp.
+func Supervised(driver GnssDriver, policy Backoff) GnssDriver {
+	return &supervised{GnssDriver: driver, policy: policy}
+}
+
+func (s *supervised) Start(ctx context.Context, sendCh chan<- []byte) (err error) {
+	attempt := 0
+	var lastErr string
+	for {
+		started := time.Now()
+		err = s.GnssDriver.Start(ctx, sendCh)
+		if ctx.Err() != nil || err == nil {
+			return
+		}
+		if time.Since(started) >= supervisedResetAfter {
+			attempt = 0
+		}
+		attempt++
+		if s.policy.MaxAttempts > 0 && attempt > s.policy.MaxAttempts {
+			return fmt.Errorf("gnss.Supervised: %w after %d attempts: %s", ErrGaveUp, s.policy.MaxAttempts, err)
+		}
+
+		delay := s.policy.delay(attempt)
+		// only log once while the device stays disconnected
+		if !errors.Is(err, ErrDisconnected) {
+			fmt.Printf("error reading from device: %s, restarting in %s\n", err, delay.Round(time.Millisecond))
+		} else if err.Error() != lastErr {
+			fmt.Printf("%s, waiting for it to be reconnected\n", err)
+		}
+		lastErr = err.Error()
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
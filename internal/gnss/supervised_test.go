@@ -0,0 +1,94 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package gnss
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// failingDriver fails to start the first fails times, then streams a sentence
+// until ctx is cancelled
+type failingDriver struct {
+	Sim
+	fails  int
+	starts int
+}
+
+func (f *failingDriver) Start(ctx context.Context, sendCh chan<- []byte) error {
+	f.starts++
+	if f.starts <= f.fails {
+		return ErrDeviceNotReady
+	}
+	select {
+	case sendCh <- []byte("$GPGGA,*7A"):
+	case <-ctx.Done():
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// Test that a supervised driver is restarted until it works, or until the
+// maximum number of attempts
+func TestSupervised(t *testing.T) {
+	tables := []struct {
+		fails       int
+		maxAttempts int
+		expectErr   error
+	}{
+		{0, 0, nil},
+		{3, 0, nil},
+		{3, 3, nil},
+		{3, 2, ErrGaveUp},
+	}
+
+	policy := Backoff{Initial: time.Millisecond, Max: 4 * time.Millisecond, Jitter: 0.5}
+	for _, table := range tables {
+		driver := &failingDriver{fails: table.fails}
+		policy.MaxAttempts = table.maxAttempts
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		sendCh := make(chan []byte)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- Supervised(driver, policy).Start(ctx, sendCh)
+		}()
+
+		var err error
+		select {
+		case <-sendCh:
+			cancel()
+			err = <-errCh
+		case err = <-errCh:
+		}
+		cancel()
+
+		if !errors.Is(err, table.expectErr) {
+			t.Errorf("%d fails, %d attempts: expected error: %v, got: %v", table.fails, table.maxAttempts, table.expectErr, err)
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			t.Errorf("%d fails, %d attempts: timed out", table.fails, table.maxAttempts)
+		}
+	}
+}
+
+// Test that the delay grows up to the maximum
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 5 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, e := range expected {
+		if got := b.delay(i + 1); got != e {
+			t.Errorf("attempt %d: expected: %s, got: %s", i+1, e, got)
+		}
+	}
+
+	b.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		if got := b.delay(1); got < 800*time.Millisecond || got > 1200*time.Millisecond {
+			t.Errorf("expected delay within 20%% of 1s, got: %s", got)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package nmea
+
+import (
+	"bytes"
+	"strings"
+)
+
+// CycleDetector detects the start of each fix cycle in a stream of sentences.
+// Modules send a set of sentences for each fix, so the type of the first GGA or
+// RMC sentence seen (e.g. "GNRMC") is used to mark the start of each cycle.
+type CycleDetector struct {
+	leader string
+}
+
+// Start returns true if the given sentence starts a new fix cycle
+func (c *CycleDetector) Start(line []byte) bool {
+	sType := sentenceType(line)
+	if c.leader == "" {
+		if strings.HasSuffix(sType, "GGA") || strings.HasSuffix(sType, "RMC") {
+			c.leader = sType
+		}
+	}
+
+	return c.leader != "" && sType == c.leader
+}
+
+// Reset forgets the sentence type used to mark the start of each cycle, e.g.
+// when the device has been restarted
+func (c *CycleDetector) Reset() {
+	c.leader = ""
+}
+
+// sentenceType returns the type of the sentence in line, e.g. "GPGGA", without
+// validating the rest of the sentence
+func sentenceType(line []byte) string {
+	line = bytes.TrimLeft(line, "\x00")
+	if len(line) == 0 || line[0] != '$' {
+		return ""
+	}
+	line = line[1:]
+	if i := bytes.IndexAny(line, ",*"); i >= 0 {
+		line = line[:i]
+	}
+
+	return string(line)
+}
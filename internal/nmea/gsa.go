@@ -0,0 +1,88 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package nmea
+
+import (
+	"fmt"
+)
+
+// FixMode is the fix mode reported in GSA sentences
+type FixMode int
+
+const (
+	FixModeNone FixMode = iota + 1
+	FixMode2D
+	FixMode3D
+)
+
+func (m FixMode) String() string {
+	switch m {
+	case FixModeNone:
+		return "none"
+	case FixMode2D:
+		return "2D"
+	case FixMode3D:
+		return "3D"
+	}
+	return fmt.Sprintf("unknown(%d)", int(m))
+}
+
+// DOP is the dilution of precision, and the satellites used for the fix, as
+// reported in a GSA sentence
+type DOP struct {
+	Mode FixMode
+	// PRNs of the satellites used for the fix
+	Satellites []int
+	PDOP       float64
+	HDOP       float64
+	VDOP       float64
+}
+
+// DOP parses the dilution of precision in a GSA sentence. Fields that are
+// empty, e.g. when there is no fix, are left at their zero value.
+func (s Sentence) DOP() (d DOP, err error) {
+	if s.Type != "GSA" {
+		err = fmt.Errorf("nmea.DOP: not a GSA sentence: %q", s.Talker+s.Type)
+		return
+	}
+	// selection mode, fix mode, 12 satellites, PDOP, HDOP, VDOP
+	if len(s.Data) < 17 {
+		err = fmt.Errorf("nmea.DOP: not enough fields in GSA sentence: %d", len(s.Data))
+		return
+	}
+
+	mode, err := parseInt(s.Data[1])
+	if err != nil {
+		err = fmt.Errorf("nmea.DOP: invalid fix mode: %w", err)
+		return
+	}
+	d.Mode = FixMode(mode)
+
+	for _, field := range s.Data[2:14] {
+		if field == "" {
+			continue
+		}
+		var prn int
+		if prn, err = parseInt(field); err != nil {
+			err = fmt.Errorf("nmea.DOP: invalid PRN: %w", err)
+			return
+		}
+		d.Satellites = append(d.Satellites, prn)
+	}
+
+	if d.PDOP, err = parseFloat(s.Data[14]); err != nil {
+		err = fmt.Errorf("nmea.DOP: invalid PDOP: %w", err)
+		return
+	}
+	if d.HDOP, err = parseFloat(s.Data[15]); err != nil {
+		err = fmt.Errorf("nmea.DOP: invalid HDOP: %w", err)
+		return
+	}
+	if d.VDOP, err = parseFloat(s.Data[16]); err != nil {
+		err = fmt.Errorf("nmea.DOP: invalid VDOP: %w", err)
+		return
+	}
+
+	return
+}
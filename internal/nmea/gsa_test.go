@@ -0,0 +1,70 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package nmea
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Test parsing the dilution of precision from GSA sentences
+func TestDOP(t *testing.T) {
+	tables := []struct {
+		in        string
+		expected  DOP
+		expectErr bool
+	}{
+		{"$GPGSA,A,3,04,05,,09,12,,,24,,,,,2.5,1.3,2.1*39", DOP{
+			Mode:       FixMode3D,
+			Satellites: []int{4, 5, 9, 12, 24},
+			PDOP:       2.5,
+			HDOP:       1.3,
+			VDOP:       2.1,
+		}, false},
+		{"$GNGSA,A,3,04,05,,09,12,,,24,,,,,2.5,1.3,2.1,1*3A", DOP{
+			Mode:       FixMode3D,
+			Satellites: []int{4, 5, 9, 12, 24},
+			PDOP:       2.5,
+			HDOP:       1.3,
+			VDOP:       2.1,
+		}, false},
+		{"$GNGSA,A,2,65,72,,,,,,,,,,,3.1,2.0,*05", DOP{
+			Mode:       FixMode2D,
+			Satellites: []int{65, 72},
+			PDOP:       3.1,
+			HDOP:       2.0,
+		}, false},
+		{"$GNGSA,A,1,,,,,,,,,,,,,99.0,99.0,99.0*1E", DOP{
+			Mode: FixModeNone,
+			PDOP: 99.0,
+			HDOP: 99.0,
+			VDOP: 99.0,
+		}, false},
+		{"$GPGSA,A,3,04,XX,,,,,,,,,,,2.5,1.3,2.1*30", DOP{}, true},
+		{"$GPGSA,A,3,04*18", DOP{}, true},
+		{"$GPGGA,,,,,,0,,,,,,,,*66", DOP{}, true},
+	}
+
+	for _, table := range tables {
+		s, err := Parse(table.in)
+		if err != nil {
+			t.Errorf("%q unexpected error parsing sentence: %s", table.in, err)
+			continue
+		}
+		out, err := s.DOP()
+		if table.expectErr {
+			if err == nil {
+				t.Errorf("%q expected error, got: %+v", table.in, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q unexpected error: %s", table.in, err)
+			continue
+		}
+		if fmt.Sprintf("%+v", out) != fmt.Sprintf("%+v", table.expected) {
+			t.Errorf("%q expected: %+v, got: %+v", table.in, table.expected, out)
+		}
+	}
+}
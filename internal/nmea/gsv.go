@@ -0,0 +1,115 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package nmea
+
+import (
+	"fmt"
+)
+
+// Satellite is a satellite in view, as reported in GSV sentences
+type Satellite struct {
+	// Talker ID of the GSV sentence, which identifies the constellation
+	Talker string
+	PRN    int
+	// Elevation and azimuth in degrees
+	Elevation int
+	Azimuth   int
+	// Signal to noise ratio in dB-Hz, 0 if the satellite is not tracked
+	SNR int
+}
+
+// SatellitesInView accumulates the satellites reported in groups of GSV
+// sentences. Each talker (e.g. "GP", "GL") sends its own group, so groups from
+// different talkers can be interleaved.
+type SatellitesInView struct {
+	groups map[string]*gsvGroup
+}
+
+type gsvGroup struct {
+	total      int
+	next       int
+	satellites []Satellite
+}
+
+// Add adds a GSV sentence to the group for its talker. Once the last sentence
+// of a group is added, complete is true and all satellites in the group are
+// returned.
+func (v *SatellitesInView) Add(s Sentence) (satellites []Satellite, complete bool, err error) {
+	if s.Type != "GSV" {
+		err = fmt.Errorf("nmea.SatellitesInView.Add: not a GSV sentence: %q", s.Talker+s.Type)
+		return
+	}
+	if len(s.Data) < 3 {
+		err = fmt.Errorf("nmea.SatellitesInView.Add: not enough fields in GSV sentence: %d", len(s.Data))
+		return
+	}
+
+	total, terr := parseInt(s.Data[0])
+	num, nerr := parseInt(s.Data[1])
+	if terr != nil || nerr != nil || total < 1 || num < 1 || num > total {
+		err = fmt.Errorf("nmea.SatellitesInView.Add: invalid message number: %q of %q", s.Data[1], s.Data[0])
+		return
+	}
+
+	if v.groups == nil {
+		v.groups = make(map[string]*gsvGroup)
+	}
+	group := v.groups[s.Talker]
+	if num == 1 {
+		group = &gsvGroup{total: total, next: 1}
+		v.groups[s.Talker] = group
+	} else if group == nil || group.total != total || group.next != num {
+		// a sentence was missed, wait for the next group to start
+		delete(v.groups, s.Talker)
+		err = fmt.Errorf("nmea.SatellitesInView.Add: unexpected message %d of %d", num, total)
+		return
+	}
+
+	// satellites are in blocks of 4 fields, newer NMEA versions may add a
+	// signal ID at the end
+	for i := 3; i+4 <= len(s.Data); i += 4 {
+		if s.Data[i] == "" {
+			continue
+		}
+		var sat Satellite
+		sat, err = parseSatellite(s.Talker, s.Data[i:i+4])
+		if err != nil {
+			delete(v.groups, s.Talker)
+			err = fmt.Errorf("nmea.SatellitesInView.Add: %w", err)
+			return
+		}
+		group.satellites = append(group.satellites, sat)
+	}
+	group.next++
+
+	if num == total {
+		delete(v.groups, s.Talker)
+		satellites = group.satellites
+		complete = true
+	}
+
+	return
+}
+
+func parseSatellite(talker string, fields []string) (sat Satellite, err error) {
+	sat.Talker = talker
+	if sat.PRN, err = parseInt(fields[0]); err != nil {
+		err = fmt.Errorf("invalid PRN: %q", fields[0])
+		return
+	}
+	if sat.Elevation, err = parseInt(fields[1]); err != nil {
+		err = fmt.Errorf("invalid elevation: %q", fields[1])
+		return
+	}
+	if sat.Azimuth, err = parseInt(fields[2]); err != nil {
+		err = fmt.Errorf("invalid azimuth: %q", fields[2])
+		return
+	}
+	if sat.SNR, err = parseInt(fields[3]); err != nil {
+		err = fmt.Errorf("invalid SNR: %q", fields[3])
+		return
+	}
+
+	return
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package nmea
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func gsv(talker string, data string) Sentence {
+	return Sentence{Talker: talker, Type: "GSV", Data: strings.Split(data, ",")}
+}
+
+// Test accumulating satellites in view from groups of GSV sentences
+func TestSatellitesInView(t *testing.T) {
+	type result struct {
+		satellites string
+		complete   bool
+		expectErr  bool
+	}
+	tables := []struct {
+		in       []Sentence
+		expected []result
+	}{
+		// interleaved groups from multiple talkers
+		{
+			[]Sentence{
+				gsv("GP", "2,1,05,02,45,120,38,05,70,045,42,12,30,210,,15,15,300,28"),
+				gsv("GL", "1,1,02,65,20,100,30,72,,,"),
+				gsv("GP", "2,2,05,18,55,080,40"),
+			},
+			[]result{
+				{"", false, false},
+				{"GL65/20/100/30 GL72/0/0/0", true, false},
+				{"GP2/45/120/38 GP5/70/45/42 GP12/30/210/0 GP15/15/300/28 GP18/55/80/40", true, false},
+			},
+		},
+		// a missed sentence discards the partial group
+		{
+			[]Sentence{
+				gsv("GA", "3,1,09,01,10,010,20"),
+				gsv("GA", "3,3,09,09,10,010,20"),
+				gsv("GA", "1,1,01,04,10,010,20,1"),
+			},
+			[]result{
+				{"", false, false},
+				{"", false, true},
+				{"GA4/10/10/20", true, false},
+			},
+		},
+		// group that starts part way through
+		{
+			[]Sentence{
+				gsv("BD", "2,2,06,11,10,010,20"),
+				gsv("BD", "0,1,00"),
+			},
+			[]result{
+				{"", false, true},
+				{"", false, true},
+			},
+		},
+	}
+
+	for _, table := range tables {
+		var v SatellitesInView
+		for i, in := range table.in {
+			sats, complete, err := v.Add(in)
+			expected := table.expected[i]
+			if expected.expectErr {
+				if err == nil {
+					t.Errorf("%q expected error", in)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%q unexpected error: %s", in, err)
+				continue
+			}
+
+			var out []string
+			for _, s := range sats {
+				out = append(out, fmt.Sprintf("%s%d/%d/%d/%d", s.Talker, s.PRN, s.Elevation, s.Azimuth, s.SNR))
+			}
+			if complete != expected.complete || strings.Join(out, " ") != expected.satellites {
+				t.Errorf("%q expected: %t %q, got: %t %q", in, expected.complete, expected.satellites, complete, strings.Join(out, " "))
+			}
+		}
+	}
+}
@@ -3,13 +3,36 @@
 
 package nmea
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type Sentence struct {
+	// Talker ID, e.g. "GP" or "GN", empty for proprietary sentences
+	Talker string
+	// Sentence type, e.g. "GGA", or the full address of proprietary
+	// sentences, e.g. "PSTMGETPAR"
 	Type string
 	Data []string
 }
 
+// Proprietary returns true if the sentence is a proprietary (manufacturer
+// specific) sentence, e.g. the STM "PSTM..." commands
+func (s Sentence) Proprietary() bool {
+	return s.Talker == "" && strings.HasPrefix(s.Type, "P")
+}
+
+// splitAddress splits the address field of a sentence into the talker ID and
+// sentence type. Proprietary sentences have no talker ID.
+func splitAddress(addr string) (talker string, sType string) {
+	if strings.HasPrefix(addr, "P") || len(addr) <= 2 {
+		return "", addr
+	}
+
+	return addr[:2], addr[2:]
+}
+
 func checksum(s string) string {
 	var sum uint8
 	for i := 0; i < len(s); i++ {
@@ -20,7 +43,7 @@ func checksum(s string) string {
 }
 
 func (s Sentence) String() string {
-	sentence := s.Type
+	sentence := s.Talker + s.Type
 	for _, d := range s.Data {
 		sentence = fmt.Sprintf("%s,%s", sentence, d)
 	}
@@ -37,3 +60,32 @@ func (s Sentence) String() string {
 func (s Sentence) Bytes() []byte {
 	return []byte(s.String())
 }
+
+// Parse parses a NMEA sentence of the form "$TTYPE,DATA*CS", where TT is the
+// talker ID, and returns an error if the sentence is malformed or its checksum
+// does not match.
+func Parse(line string) (s Sentence, err error) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "$") {
+		err = fmt.Errorf("nmea.Parse: sentence does not start with '$': %q", line)
+		return
+	}
+
+	i := strings.LastIndex(line, "*")
+	if i < 0 || len(line)-i != 3 {
+		err = fmt.Errorf("nmea.Parse: sentence has no checksum: %q", line)
+		return
+	}
+
+	body := line[1:i]
+	if sum := checksum(body); !strings.EqualFold(line[i+1:], sum) {
+		err = fmt.Errorf("nmea.Parse: checksum mismatch, expected %q: %q", sum, line)
+		return
+	}
+
+	fields := strings.Split(body, ",")
+	s.Talker, s.Type = splitAddress(fields[0])
+	s.Data = fields[1:]
+
+	return
+}
@@ -4,6 +4,7 @@
 package nmea
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -29,22 +30,123 @@ func TestChecksum(t *testing.T) {
 // Test sentence stringer
 func TestStringer(t *testing.T) {
 	tables := []struct {
+		inTalker string
 		inType   string
 		inData   []string
 		expected string
 	}{
-		{"PSTMGPSSUSPEND", []string{}, "$PSTMGPSSUSPEND,*38"},
-		{"GPGGA", []string{"070319.000", "0000.00000", "N", "00000.00000", "E", "0", "00", "99.0", "100.00", "M", "0.0", "M", "", ""}, "$GPGGA,070319.000,0000.00000,N,00000.00000,E,0,00,99.0,100.00,M,0.0,M,,*60"},
+		{"", "PSTMGPSSUSPEND", []string{}, "$PSTMGPSSUSPEND,*38"},
+		{"GP", "GGA", []string{"070319.000", "0000.00000", "N", "00000.00000", "E", "0", "00", "99.0", "100.00", "M", "0.0", "M", "", ""}, "$GPGGA,070319.000,0000.00000,N,00000.00000,E,0,00,99.0,100.00,M,0.0,M,,*60"},
 	}
 
 	for _, table := range tables {
 		s := Sentence{
-			Type: table.inType,
-			Data: table.inData,
+			Talker: table.inTalker,
+			Type:   table.inType,
+			Data:   table.inData,
 		}
 		out := s.String()
 		if out != table.expected {
-			t.Errorf("%q, %q expected: %q, got: %q", table.inType, table.inData, table.expected, out)
+			t.Errorf("%q, %q, %q expected: %q, got: %q", table.inTalker, table.inType, table.inData, table.expected, out)
+		}
+	}
+}
+
+// Test sentence parsing and checksum validation
+func TestParse(t *testing.T) {
+	tables := []struct {
+		in             string
+		expectedTalker string
+		expectedType   string
+		expectedData   []string
+		expectErr      bool
+	}{
+		{"$PSTMGPSSUSPEND,*38", "", "PSTMGPSSUSPEND", []string{""}, false},
+		{"$GNGSA,A,1,,,,,,,,,,,,,99.0,99.0,99.0*1E\r\n", "GN", "GSA", []string{"A", "1", "", "", "", "", "", "", "", "", "", "", "", "", "99.0", "99.0", "99.0"}, false},
+		{"$gpgll,0000.00000,N,00000.00000,E,070254.000,V,N*45", "", "", nil, true},
+		{"$GPGLL,0000.00000,N,00000.00000,E,070254.000,V,N*46", "", "", nil, true},
+		{"$GPGLL,0000.00000,N,00000.00000,E,070254.000,V,N", "", "", nil, true},
+		{"GPGLL,0000.00000,N,00000.00000,E,070254.000,V,N*45", "", "", nil, true},
+		{"\x8f\x13garbage*45", "", "", nil, true},
+	}
+
+	for _, table := range tables {
+		out, err := Parse(table.in)
+		if table.expectErr {
+			if err == nil {
+				t.Errorf("%q expected error, got: %q", table.in, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q unexpected error: %s", table.in, err)
+			continue
+		}
+		if out.Talker != table.expectedTalker || out.Type != table.expectedType || strings.Join(out.Data, ",") != strings.Join(table.expectedData, ",") {
+			t.Errorf("%q expected: %q %q %q, got: %q %q %q", table.in, table.expectedTalker, table.expectedType, table.expectedData, out.Talker, out.Type, out.Data)
+		}
+	}
+}
+
+// Test splitting the talker ID from the sentence type
+func TestTalker(t *testing.T) {
+	tables := []struct {
+		in                  string
+		expectedTalker      string
+		expectedType        string
+		expectedProprietary bool
+	}{
+		{"$GPGLL,0000.00000,N,00000.00000,E,070254.000,V,N*45", "GP", "GLL", false},
+		{"$GNGSA,A,1,,,,,,,,,,,,,99.0,99.0,99.0*1E", "GN", "GSA", false},
+		{"$GLGSV,1,1,00*65", "GL", "GSV", false},
+		{"$GAGSV,1,1,00*68", "GA", "GSV", false},
+		{"$BDGSV,1,1,00*68", "BD", "GSV", false},
+		{"$PSTMGPSSUSPEND,*38", "", "PSTMGPSSUSPEND", true},
+		{"$PSTMSETPAR,1201,0x00000041*54", "", "PSTMSETPAR", true},
+	}
+
+	for _, table := range tables {
+		out, err := Parse(table.in)
+		if err != nil {
+			t.Errorf("%q unexpected error: %s", table.in, err)
+			continue
+		}
+		if out.Talker != table.expectedTalker || out.Type != table.expectedType || out.Proprietary() != table.expectedProprietary {
+			t.Errorf("%q expected: %q %q %t, got: %q %q %t", table.in, table.expectedTalker, table.expectedType,
+				table.expectedProprietary, out.Talker, out.Type, out.Proprietary())
+		}
+		if out.String() != table.in {
+			t.Errorf("%q expected round trip, got: %q", table.in, out.String())
+		}
+	}
+}
+
+// Test detecting the start of fix cycles
+func TestCycleDetector(t *testing.T) {
+	tables := []struct {
+		in       []string
+		expected []bool
+	}{
+		{
+			[]string{"$GPGSV,1", "$GNRMC,1", "$GNGGA,1", "$GPGSV,2", "$GNRMC,2", "$GNGGA,2"},
+			[]bool{false, true, false, false, true, false},
+		},
+		{
+			[]string{"$GPGGA,1*00", "$GPRMC,1", "$GPGGA,2", "garbage", "$PSTMGPSSUSPEND,*38", "$GPGGA,3"},
+			[]bool{true, false, true, false, false, true},
+		},
+		{
+			[]string{"$GPGSV,1", "$GPGSA,1"},
+			[]bool{false, false},
+		},
+	}
+
+	for _, table := range tables {
+		var c CycleDetector
+		for i, in := range table.in {
+			if out := c.Start([]byte(in)); out != table.expected[i] {
+				t.Errorf("%q, %q expected: %t, got: %t", table.in, in, table.expected[i], out)
+			}
 		}
 	}
 }
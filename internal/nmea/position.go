@@ -0,0 +1,234 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package nmea
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// FixQuality is the fix quality indicator reported in GGA sentences
+type FixQuality int
+
+const (
+	FixInvalid FixQuality = iota
+	FixGPS
+	FixDGPS
+	FixPPS
+	FixRTK
+	FixFloatRTK
+	FixEstimated
+	FixManual
+	FixSimulation
+)
+
+var fixQualityNames = []string{"none", "gps", "dgps", "pps", "rtk", "float-rtk", "estimated", "manual", "simulation"}
+
+func (q FixQuality) String() string {
+	if q < 0 || int(q) >= len(fixQualityNames) {
+		return fmt.Sprintf("unknown(%d)", int(q))
+	}
+	return fixQualityNames[q]
+}
+
+// Position is a position fix, as reported in a GGA sentence
+type Position struct {
+	// UTC time of the fix. The date is not included in GGA sentences.
+	Time time.Time
+	// Latitude and longitude in decimal degrees, negative for south/west
+	Latitude  float64
+	Longitude float64
+	// Altitude above mean sea level, in meters
+	Altitude   float64
+	Quality    FixQuality
+	Satellites int
+	HDOP       float64
+}
+
+// Position parses the position fix in a GGA sentence. Fields that are empty,
+// e.g. when there is no fix, are left at their zero value.
+func (s Sentence) Position() (p Position, err error) {
+	if s.Type != "GGA" {
+		err = fmt.Errorf("nmea.Position: not a GGA sentence: %q", s.Talker+s.Type)
+		return
+	}
+	if len(s.Data) < 9 {
+		err = fmt.Errorf("nmea.Position: not enough fields in GGA sentence: %d", len(s.Data))
+		return
+	}
+
+	if p.Time, err = parseTime(s.Data[0]); err != nil {
+		err = fmt.Errorf("nmea.Position: %w", err)
+		return
+	}
+	if p.Latitude, err = parseCoordinate(s.Data[1], s.Data[2]); err != nil {
+		err = fmt.Errorf("nmea.Position: %w", err)
+		return
+	}
+	if p.Longitude, err = parseCoordinate(s.Data[3], s.Data[4]); err != nil {
+		err = fmt.Errorf("nmea.Position: %w", err)
+		return
+	}
+
+	quality, err := parseInt(s.Data[5])
+	if err != nil {
+		err = fmt.Errorf("nmea.Position: invalid fix quality: %w", err)
+		return
+	}
+	p.Quality = FixQuality(quality)
+
+	if p.Satellites, err = parseInt(s.Data[6]); err != nil {
+		err = fmt.Errorf("nmea.Position: invalid number of satellites: %w", err)
+		return
+	}
+	if p.HDOP, err = parseFloat(s.Data[7]); err != nil {
+		err = fmt.Errorf("nmea.Position: invalid HDOP: %w", err)
+		return
+	}
+	if p.Altitude, err = parseFloat(s.Data[8]); err != nil {
+		err = fmt.Errorf("nmea.Position: invalid altitude: %w", err)
+		return
+	}
+
+	return
+}
+
+// CoordinateFormat is a format for the latitude and longitude of a Position
+type CoordinateFormat int
+
+const (
+	// DecimalDegrees formats the coordinates as signed decimal degrees,
+	// negative for south/west, e.g. "48.1173000,11.5166667"
+	DecimalDegrees CoordinateFormat = iota
+	// DegreesDecimalMinutes formats the coordinates as degrees and decimal
+	// minutes with the hemisphere, e.g. "48°07.038'N 11°31.000'E"
+	DegreesDecimalMinutes
+)
+
+// Format returns the latitude and longitude of the position in the given
+// format
+func (p Position) Format(f CoordinateFormat) string {
+	switch f {
+	case DegreesDecimalMinutes:
+		return formatDDM(p.Latitude, "N", "S") + " " + formatDDM(p.Longitude, "E", "W")
+	default:
+		return fmt.Sprintf("%.7f,%.7f", p.Latitude, p.Longitude)
+	}
+}
+
+// formatDDM formats a coordinate in decimal degrees as degrees and decimal
+// minutes, with the hemisphere pos or neg depending on its sign
+func formatDDM(deg float64, pos string, neg string) string {
+	// rounded to the precision that is printed first, so that e.g. 59.9999
+	// minutes is carried over to the degrees instead of printed as 60.000
+	minutes := math.Round(math.Abs(deg)*60*1000) / 1000
+	hemisphere := pos
+	if deg < 0 && minutes != 0 {
+		hemisphere = neg
+	}
+
+	whole := math.Floor(minutes / 60)
+	return fmt.Sprintf("%d°%06.3f'%s", int(whole), minutes-whole*60, hemisphere)
+}
+
+// GeoJSONPoint is a GeoJSON Point geometry, which can be marshaled to JSON
+type GeoJSONPoint struct {
+	Type string `json:"type"`
+	// Longitude, latitude and altitude, in that order
+	Coordinates []float64 `json:"coordinates"`
+}
+
+// GeoJSON returns the position as a GeoJSON Point, with the altitude
+func (p Position) GeoJSON() GeoJSONPoint {
+	return GeoJSONPoint{
+		Type:        "Point",
+		Coordinates: []float64{p.Longitude, p.Latitude, p.Altitude},
+	}
+}
+
+// Date parses the UTC date in a RMC sentence. The zero time is returned if the
+// date is empty.
+func (s Sentence) Date() (d time.Time, err error) {
+	if s.Type != "RMC" {
+		err = fmt.Errorf("nmea.Date: not a RMC sentence: %q", s.Talker+s.Type)
+		return
+	}
+	if len(s.Data) < 9 {
+		err = fmt.Errorf("nmea.Date: not enough fields in RMC sentence: %d", len(s.Data))
+		return
+	}
+	if s.Data[8] == "" {
+		return
+	}
+
+	if d, err = time.Parse("020106", s.Data[8]); err != nil {
+		err = fmt.Errorf("nmea.Date: invalid date: %q", s.Data[8])
+	}
+	return
+}
+
+func parseInt(field string) (int, error) {
+	if field == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(field)
+}
+
+func parseFloat(field string) (float64, error) {
+	if field == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(field, 64)
+}
+
+// parseTime parses a UTC time in the form hhmmss.sss
+func parseTime(field string) (t time.Time, err error) {
+	if field == "" {
+		return
+	}
+	if len(field) < 6 {
+		err = fmt.Errorf("invalid time: %q", field)
+		return
+	}
+
+	h, herr := strconv.Atoi(field[0:2])
+	m, merr := strconv.Atoi(field[2:4])
+	sec, serr := strconv.ParseFloat(field[4:], 64)
+	if herr != nil || merr != nil || serr != nil {
+		err = fmt.Errorf("invalid time: %q", field)
+		return
+	}
+
+	t = time.Date(0, time.January, 1, h, m, 0, 0, time.UTC).Add(time.Duration(sec * float64(time.Second)))
+	return
+}
+
+// parseCoordinate converts a coordinate in the form (d)ddmm.mmmm and its
+// hemisphere (N/S/E/W) to decimal degrees
+func parseCoordinate(field string, hemisphere string) (deg float64, err error) {
+	if field == "" {
+		return
+	}
+
+	val, err := strconv.ParseFloat(field, 64)
+	if err != nil {
+		err = fmt.Errorf("invalid coordinate: %q", field)
+		return
+	}
+
+	whole := float64(int(val / 100))
+	deg = whole + (val-whole*100)/60
+
+	switch hemisphere {
+	case "N", "E":
+	case "S", "W":
+		deg = -deg
+	default:
+		err = fmt.Errorf("invalid hemisphere: %q", hemisphere)
+	}
+
+	return
+}
@@ -0,0 +1,121 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package nmea
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+// Test parsing positions from GGA sentences
+func TestPosition(t *testing.T) {
+	tables := []struct {
+		in        string
+		expected  Position
+		expectErr bool
+	}{
+		{"$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47", Position{
+			Time:       time.Date(0, time.January, 1, 12, 35, 19, 0, time.UTC),
+			Latitude:   48.1173,
+			Longitude:  11.516667,
+			Altitude:   545.4,
+			Quality:    FixGPS,
+			Satellites: 8,
+			HDOP:       0.9,
+		}, false},
+		{"$GNGGA,070319.500,3354.1234,S,07036.5678,W,2,12,0.7,-5.0,M,0.0,M,,*50", Position{
+			Time:       time.Date(0, time.January, 1, 7, 3, 19, 500000000, time.UTC),
+			Latitude:   -33.902057,
+			Longitude:  -70.609463,
+			Altitude:   -5.0,
+			Quality:    FixDGPS,
+			Satellites: 12,
+			HDOP:       0.7,
+		}, false},
+		{"$GPGGA,070319.000,0000.00000,N,00000.00000,E,0,00,99.0,100.00,M,0.0,M,,*60", Position{
+			Time:     time.Date(0, time.January, 1, 7, 3, 19, 0, time.UTC),
+			Quality:  FixInvalid,
+			HDOP:     99.0,
+			Altitude: 100.0,
+		}, false},
+		{"$GPGGA,,,,,,0,,,,,,,,*66", Position{}, false},
+		{"$GPGGA,123519,4807.038,X,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*51", Position{}, true},
+		{"$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A", Position{}, true},
+	}
+
+	for _, table := range tables {
+		s, err := Parse(table.in)
+		if err != nil {
+			t.Errorf("%q unexpected error parsing sentence: %s", table.in, err)
+			continue
+		}
+		out, err := s.Position()
+		if table.expectErr {
+			if err == nil {
+				t.Errorf("%q expected error, got: %+v", table.in, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q unexpected error: %s", table.in, err)
+			continue
+		}
+		if !out.Time.Equal(table.expected.Time) ||
+			math.Abs(out.Latitude-table.expected.Latitude) > 1e-6 ||
+			math.Abs(out.Longitude-table.expected.Longitude) > 1e-6 ||
+			out.Altitude != table.expected.Altitude ||
+			out.Quality != table.expected.Quality ||
+			out.Satellites != table.expected.Satellites ||
+			out.HDOP != table.expected.HDOP {
+			t.Errorf("%q expected: %+v, got: %+v", table.in, table.expected, out)
+		}
+	}
+}
+
+// Test formatting coordinates, including near the equator and prime meridian
+// where the hemisphere changes
+func TestPositionFormat(t *testing.T) {
+	tables := []struct {
+		lat float64
+		lon float64
+		dd  string
+		ddm string
+	}{
+		{48.1173, 11.516667, "48.1173000,11.5166670", "48°07.038'N 11°31.000'E"},
+		{-33.902057, -70.609463, "-33.9020570,-70.6094630", "33°54.123'S 70°36.568'W"},
+		{0, 0, "0.0000000,0.0000000", "0°00.000'N 0°00.000'E"},
+		{-0.0001, 0.0001, "-0.0001000,0.0001000", "0°00.006'S 0°00.006'E"},
+		{0.0001, -0.0001, "0.0001000,-0.0001000", "0°00.006'N 0°00.006'W"},
+		// rounds to 0, so the hemisphere doesn't matter
+		{-0.000001, -0.000001, "-0.0000010,-0.0000010", "0°00.000'N 0°00.000'E"},
+		// minutes that round up to a whole degree
+		{51.9999999, -179.9999999, "51.9999999,-179.9999999", "52°00.000'N 180°00.000'W"},
+	}
+
+	for _, table := range tables {
+		p := Position{Latitude: table.lat, Longitude: table.lon}
+		if got := p.Format(DecimalDegrees); got != table.dd {
+			t.Errorf("%v,%v expected: %q, got: %q", table.lat, table.lon, table.dd, got)
+		}
+		if got := p.Format(DegreesDecimalMinutes); got != table.ddm {
+			t.Errorf("%v,%v expected: %q, got: %q", table.lat, table.lon, table.ddm, got)
+		}
+	}
+}
+
+// Test that positions are marshaled as GeoJSON points, with the longitude
+// first
+func TestPositionGeoJSON(t *testing.T) {
+	p := Position{Latitude: -33.9, Longitude: 151.2, Altitude: 58.5}
+	out, err := json.Marshal(p.GeoJSON())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `{"type":"Point","coordinates":[151.2,-33.9,58.5]}`
+	if string(out) != expected {
+		t.Errorf("expected: %s, got: %s", expected, out)
+	}
+}
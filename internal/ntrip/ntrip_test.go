@@ -0,0 +1,78 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package ntrip
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test streaming correction data from a caster
+func TestStream(t *testing.T) {
+	errWrite := errors.New("write failed")
+
+	tables := []struct {
+		name     string
+		status   int
+		body     string
+		writeErr error
+		expected string
+		err      error
+	}{
+		{"ok", http.StatusOK, "\xd3\x00\x13rtcm", nil, "\xd3\x00\x13rtcm", io.EOF},
+		{"unauthorized", http.StatusUnauthorized, "", nil, "", nil},
+		{"not found", http.StatusNotFound, "SOURCETABLE 200 OK", nil, "", nil},
+		{"write error", http.StatusOK, "rtcm", errWrite, "rtcm", errWrite},
+	}
+
+	for _, table := range tables {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if v := r.Header.Get("Ntrip-Version"); v != "Ntrip/2.0" {
+				t.Errorf("%s: expected Ntrip-Version: %q, got: %q", table.name, "Ntrip/2.0", v)
+			}
+			if r.URL.Path != "/MOUNT" {
+				t.Errorf("%s: expected mountpoint: %q, got: %q", table.name, "/MOUNT", r.URL.Path)
+			}
+			w.WriteHeader(table.status)
+			io.WriteString(w, table.body)
+		}))
+
+		var written []byte
+		err := Stream(context.Background(), srv.URL+"/MOUNT", func(data []byte) error {
+			written = append(written, data...)
+			return table.writeErr
+		})
+		srv.Close()
+
+		if err == nil {
+			t.Errorf("%s: expected error", table.name)
+		} else if table.err != nil && !errors.Is(err, table.err) {
+			t.Errorf("%s: expected error: %v, got: %v", table.name, table.err, err)
+		}
+		if string(written) != table.expected {
+			t.Errorf("%s: expected written: %q, got: %q", table.name, table.expected, written)
+		}
+	}
+}
+
+// Test that streaming stops without an error when cancelled
+func TestStreamCancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := Stream(ctx, srv.URL+"/MOUNT", func(data []byte) error { return nil }); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
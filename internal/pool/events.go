@@ -0,0 +1,88 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package pool
+
+import (
+	"fmt"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/nmea"
+)
+
+// fixEvents tracks whether there is a fix, from the GGA fix quality and, if the
+// device sends GSA sentences, the fix mode. It returns a line for clients using
+// FormatEvents when the fix is acquired, e.g. "FIX_ACQUIRED 3D sats=9", or
+// lost, "FIX_LOST".
+type fixEvents struct {
+	quality nmea.FixQuality
+	sats    int
+	// fix mode from the most recent GSA sentence, 0 if none were received
+	mode  nmea.FixMode
+	fixed bool
+	// set if the last message added was a GGA sentence with a position
+	gga bool
+}
+
+// add adds a message broadcast by the pool, and returns the event line if the
+// fix was acquired or lost
+func (e *fixEvents) add(msg []byte) (line []byte) {
+	e.gga = false
+	// only GGA and GSA sentences are parsed, to keep the broadcast path cheap
+	if len(msg) < 6 || (string(msg[3:6]) != "GGA" && string(msg[3:6]) != "GSA") {
+		return
+	}
+	s, err := nmea.Parse(string(msg))
+	if err != nil {
+		return
+	}
+
+	switch s.Type {
+	case "GGA":
+		pos, err := s.Position()
+		if err != nil {
+			return
+		}
+		e.quality = pos.Quality
+		e.sats = pos.Satellites
+		e.gga = true
+	case "GSA":
+		dop, err := s.DOP()
+		if err != nil {
+			return
+		}
+		e.mode = dop.Mode
+	}
+
+	fixed := e.quality != nmea.FixInvalid && e.mode != nmea.FixModeNone
+	if fixed == e.fixed {
+		return
+	}
+	e.fixed = fixed
+
+	if !fixed {
+		return []byte("FIX_LOST\n")
+	}
+	return e.current()
+}
+
+// current returns the FIX_ACQUIRED event line if there is a fix, for clients
+// that start using FormatEvents while there is one
+func (e *fixEvents) current() (line []byte) {
+	if !e.fixed {
+		return
+	}
+	if e.mode == 0 {
+		return []byte(fmt.Sprintf("FIX_ACQUIRED sats=%d\n", e.sats))
+	}
+	return []byte(fmt.Sprintf("FIX_ACQUIRED %s sats=%d\n", e.mode, e.sats))
+}
+
+// reset forgets the fix, e.g. when the device is stopped, and returns the
+// event line if there was one
+func (e *fixEvents) reset() (line []byte) {
+	if e.fixed {
+		line = []byte("FIX_LOST\n")
+	}
+	*e = fixEvents{}
+	return
+}
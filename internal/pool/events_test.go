@@ -0,0 +1,55 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package pool
+
+import (
+	"strings"
+	"testing"
+)
+
+// Test that events are only sent when the fix is acquired or lost
+func TestFixEvents(t *testing.T) {
+	gga := "$GPGGA,123519.000,4830.000,N,01130.000,E,1,08,0.9,545.4,M,46.9,M,,*57"
+	ggaNoFix := "$GPGGA,123520.000,,,,,0,00,,,M,,M,,*7F"
+	gsa3D := "$GPGSA,A,3,04,05,,09,12,,,24,,,,,2.5,1.3,2.1*39"
+	gsa2D := "$GPGSA,A,2,04,05,,09,,,,,,,,,2.5,1.3,2.1*3D"
+	gsaNoFix := "$GPGSA,A,1,,,,,,,,,,,,,,,*1E"
+
+	tables := []struct {
+		sentences []string
+		expected  []string
+	}{
+		// without GSA sentences, only the fix quality is used
+		{[]string{ggaNoFix, gga, gga, ggaNoFix},
+			[]string{"FIX_ACQUIRED sats=8", "FIX_LOST"}},
+		{[]string{gsaNoFix, gga, gsa3D, gga, gsa2D, gsaNoFix},
+			[]string{"FIX_ACQUIRED 3D sats=8", "FIX_LOST"}},
+		{[]string{gga, gsa2D, gga},
+			[]string{"FIX_ACQUIRED sats=8"}},
+		{[]string{ggaNoFix, gsaNoFix}, nil},
+	}
+
+	for _, table := range tables {
+		var e fixEvents
+		var out []string
+		for _, s := range table.sentences {
+			if line := e.add([]byte(s)); line != nil {
+				out = append(out, strings.TrimSuffix(string(line), "\n"))
+			}
+		}
+		if strings.Join(out, "\n") != strings.Join(table.expected, "\n") {
+			t.Errorf("%q expected: %q, got: %q", table.sentences, table.expected, out)
+		}
+	}
+
+	// the fix is lost when the device is stopped
+	var e fixEvents
+	e.add([]byte(gga))
+	if line := e.reset(); string(line) != "FIX_LOST\n" {
+		t.Errorf("expected FIX_LOST on reset, got: %q", line)
+	}
+	if line := e.reset(); line != nil {
+		t.Errorf("expected nothing on reset without a fix, got: %q", line)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package pool
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/nmea"
+)
+
+// Format is the format of the messages sent to a client
+type Format int32
+
+const (
+	// FormatNMEA sends every sentence from the device as it is received
+	FormatNMEA Format = iota
+	// FormatJSON sends a JSON object on a line for each fix cycle, with the
+	// position from the GGA sentence and the date from the RMC sentence
+	FormatJSON
+	// FormatEvents only sends a line when the fix is acquired or lost, see
+	// fixEvents
+	FormatEvents
+)
+
+// ParseFormat returns the format with the given name, "nmea", "json" or
+// "events"
+func ParseFormat(name string) (f Format, err error) {
+	switch strings.ToLower(name) {
+	case "nmea", "":
+		f = FormatNMEA
+	case "json":
+		f = FormatJSON
+	case "events":
+		f = FormatEvents
+	default:
+		err = fmt.Errorf("pool.ParseFormat: unknown format %q, must be one of: nmea, json, events", name)
+	}
+
+	return
+}
+
+// jsonFix is the fix sent to clients using FormatJSON. The position is left out
+// if there is no fix, and the time if the date is not known yet.
+type jsonFix struct {
+	Time       string   `json:"t,omitempty"`
+	Latitude   *float64 `json:"lat,omitempty"`
+	Longitude  *float64 `json:"lon,omitempty"`
+	Altitude   *float64 `json:"alt,omitempty"`
+	Satellites int      `json:"sats"`
+	HDOP       float64  `json:"hdop"`
+	Fix        string   `json:"fix"`
+}
+
+// fixEncoder builds a JSON fix from the first GGA and RMC sentences of each fix
+// cycle
+type fixEncoder struct {
+	cycles nmea.CycleDetector
+	pos    *nmea.Position
+	date   time.Time
+	hasRMC bool
+	// set once the fix for the current cycle has been built
+	sent bool
+}
+
+// add adds a message broadcast by the pool, and returns the JSON line for the
+// fix once both the GGA and RMC sentences of a cycle have been seen, or once
+// the next cycle starts if the cycle had no RMC sentence.
+func (e *fixEncoder) add(msg []byte) (line []byte) {
+	if e.cycles.Start(msg) {
+		line = e.flush()
+		e.sent = false
+	}
+	if e.sent {
+		return
+	}
+
+	s, err := nmea.Parse(string(msg))
+	if err != nil {
+		return
+	}
+	switch s.Type {
+	case "GGA":
+		if e.pos != nil {
+			return
+		}
+		if pos, err := s.Position(); err == nil {
+			e.pos = &pos
+		}
+	case "RMC":
+		if e.hasRMC {
+			return
+		}
+		if date, err := s.Date(); err == nil {
+			e.date = date
+			e.hasRMC = true
+		}
+	}
+
+	if e.pos != nil && e.hasRMC {
+		line = e.flush()
+		e.sent = true
+	}
+
+	return
+}
+
+// flush returns the JSON line for the fix seen so far, if any, and forgets it
+func (e *fixEncoder) flush() (line []byte) {
+	defer func() {
+		e.pos = nil
+		e.date = time.Time{}
+		e.hasRMC = false
+	}()
+	if e.pos == nil {
+		return
+	}
+
+	fix := jsonFix{
+		Satellites: e.pos.Satellites,
+		HDOP:       e.pos.HDOP,
+		Fix:        e.pos.Quality.String(),
+	}
+	if !e.date.IsZero() && !e.pos.Time.IsZero() {
+		h, m, s := e.pos.Time.Clock()
+		t := e.date.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute +
+			time.Duration(s)*time.Second + time.Duration(e.pos.Time.Nanosecond()))
+		fix.Time = t.Format("2006-01-02T15:04:05.000Z")
+	}
+	if e.pos.Quality != nmea.FixInvalid {
+		fix.Latitude = &e.pos.Latitude
+		fix.Longitude = &e.pos.Longitude
+		fix.Altitude = &e.pos.Altitude
+	}
+
+	line, err := json.Marshal(fix)
+	if err != nil {
+		return nil
+	}
+	return append(line, '\n')
+}
+
+// reset forgets the current cycle, e.g. when the device is stopped
+func (e *fixEncoder) reset() {
+	e.cycles.Reset()
+	e.flush()
+	e.sent = false
+}
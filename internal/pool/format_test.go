@@ -0,0 +1,47 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package pool
+
+import (
+	"strings"
+	"testing"
+)
+
+// Test building JSON fixes from the GGA and RMC sentences of each cycle
+func TestFixEncoder(t *testing.T) {
+	gga := "$GPGGA,123519.000,4830.000,N,01130.000,E,1,08,0.9,545.4,M,46.9,M,,*57"
+	ggaNoFix := "$GPGGA,123520.000,,,,,0,00,,,M,,M,,*7F"
+	rmc := "$GPRMC,123519.000,A,4830.000,N,01130.000,E,022.4,084.4,230394,003.1,W*7A"
+	gsv := "$GPGSV,1,1,00*79"
+
+	tables := []struct {
+		sentences []string
+		expected  []string
+	}{
+		// fix is sent as soon as GGA and RMC are seen
+		{[]string{gga, rmc, gsv},
+			[]string{`{"t":"1994-03-23T12:35:19.000Z","lat":48.5,"lon":11.5,"alt":545.4,"sats":8,"hdop":0.9,"fix":"gps"}`}},
+		// without RMC, it is sent without the time when the next cycle starts
+		{[]string{gga, gsv, gga},
+			[]string{`{"lat":48.5,"lon":11.5,"alt":545.4,"sats":8,"hdop":0.9,"fix":"gps"}`}},
+		// no position without a fix
+		{[]string{ggaNoFix, rmc},
+			[]string{`{"t":"1994-03-23T12:35:20.000Z","sats":0,"hdop":0,"fix":"none"}`}},
+		// nothing before the first cycle is complete
+		{[]string{gsv, gga}, nil},
+	}
+
+	for _, table := range tables {
+		var e fixEncoder
+		var out []string
+		for _, s := range table.sentences {
+			if line := e.add([]byte(s)); line != nil {
+				out = append(out, strings.TrimSuffix(string(line), "\n"))
+			}
+		}
+		if strings.Join(out, "\n") != strings.Join(table.expected, "\n") {
+			t.Errorf("%q expected: %q, got: %q", table.sentences, table.expected, out)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package pool
+
+import (
+	"gitlab.com/postmarketOS/gnss-share/internal/nmea"
+)
+
+// lastFix keeps the sentences of the given types from the most recent fix
+// cycle, so that they can be replayed to new clients
+type lastFix struct {
+	types  map[string]bool
+	cycles nmea.CycleDetector
+	// sentences seen so far in the current cycle
+	pending [][]byte
+	seen    map[string]bool
+	// sentences from the last cycle, replaced as a whole
+	cached [][]byte
+}
+
+func newLastFix(types []string) *lastFix {
+	l := &lastFix{
+		types: make(map[string]bool),
+		seen:  make(map[string]bool),
+	}
+	for _, t := range types {
+		l.types[t] = true
+	}
+
+	return l
+}
+
+// add adds a message broadcast by the pool, and the line that was sent to
+// clients for it
+func (l *lastFix) add(msg []byte, line []byte) {
+	if l.cycles.Start(msg) {
+		l.commit()
+	}
+
+	s, err := nmea.Parse(string(msg))
+	if err != nil || !l.types[s.Type] || l.seen[s.Type] {
+		return
+	}
+	l.pending = append(l.pending, line)
+	l.seen[s.Type] = true
+
+	// no need to wait for the next cycle once all types have been seen
+	if len(l.seen) == len(l.types) {
+		l.commit()
+	}
+}
+
+func (l *lastFix) commit() {
+	if len(l.pending) > 0 {
+		l.cached = l.pending
+	}
+	l.pending = nil
+	l.seen = make(map[string]bool)
+}
+
+// clear forgets the cached cycle, e.g. when the device is stopped
+func (l *lastFix) clear() {
+	l.cycles.Reset()
+	l.pending = nil
+	l.seen = make(map[string]bool)
+	l.cached = nil
+}
@@ -6,11 +6,67 @@ package pool
 import (
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/nmea"
 )
 
 type Client struct {
-	Send chan []byte
-	Conn *net.Conn
+	Send   chan []byte
+	Conn   *net.Conn
+	format int32
+	// interval between fix cycles sent to the client, in nanoseconds, not
+	// limited if 0
+	rateInterval int64
+	// rate limiter for the messages from each source, by tag, only used by
+	// the pool's broadcast loop
+	rates map[string]*rateLimiter
+}
+
+// SetRate limits the messages sent to the client to at most hz fix cycles per
+// second, by skipping whole fix cycles, in addition to the limit of the pool.
+// The rate is not limited if hz is 0. It applies to FormatNMEA and FormatJSON,
+// events are always sent.
+func (c *Client) SetRate(hz float64) {
+	var interval int64
+	if hz > 0 {
+		interval = int64(float64(time.Second) / hz)
+	}
+	atomic.StoreInt64(&c.rateInterval, interval)
+}
+
+// allow returns true if the message from the source with the given tag should
+// be sent to the client because of its rate, start is set if the message starts
+// a new fix cycle of the source. Once the rate is set, messages are only sent
+// from the start of the next cycle. The rate applies to each source.
+func (c *Client) allow(tag string, start bool, now time.Time) bool {
+	interval := time.Duration(atomic.LoadInt64(&c.rateInterval))
+	if interval == 0 {
+		c.rates = nil
+		return true
+	}
+
+	r := c.rates[tag]
+	if r == nil {
+		if c.rates == nil {
+			c.rates = make(map[string]*rateLimiter)
+		}
+		r = &rateLimiter{}
+		c.rates[tag] = r
+	}
+	r.interval = interval
+	return r.allowCycle(start, now)
+}
+
+// SetFormat sets the format of the messages sent to the client
+func (c *Client) SetFormat(f Format) {
+	atomic.StoreInt32(&c.format, int32(f))
+}
+
+// Format returns the format of the messages sent to the client
+func (c *Client) Format() Format {
+	return Format(atomic.LoadInt32(&c.format))
 }
 
 type Pool struct {
@@ -19,6 +75,29 @@ type Pool struct {
 	Clients    map[*Client]bool
 	Broadcast  chan []byte
 	mu         sync.Mutex
+	observers  []func(msg []byte)
+	limiter    *rateLimiter
+	lastFix    *lastFix
+	clearFix   chan struct{}
+	done       chan struct{}
+	stopOnce   sync.Once
+	// messages from sources created with Source
+	tagged chan taggedMsg
+	// detects the start of fix cycles for clients with a rate set, for each
+	// source by tag, since the cycles of sources are interleaved
+	cycles map[string]*nmea.CycleDetector
+	fixes  fixEncoder
+	events fixEvents
+	// appended to each sentence sent to clients using FormatNMEA
+	lineEnding string
+	// the most recent fix sent to clients using FormatJSON
+	lastJSON []byte
+	// number of clients disconnected for being too slow, updated atomically
+	dropped uint64
+	// quality of the most recent fix, and when the most recent valid fix
+	// was broadcast in Unix nanoseconds, updated atomically
+	fixQuality  int32
+	lastFixTime int64
 }
 
 func New() *Pool {
@@ -27,29 +106,239 @@ func New() *Pool {
 		Unregister: make(chan *Client),
 		Clients:    make(map[*Client]bool),
 		Broadcast:  make(chan []byte),
+		clearFix:   make(chan struct{}),
+		done:       make(chan struct{}),
+		tagged:     make(chan taggedMsg),
+		lineEnding: "\n",
+	}
+}
+
+// taggedMsg is a message from a source with a tag
+type taggedMsg struct {
+	msg []byte
+	tag string
+}
+
+// Source returns a channel to broadcast messages on like Broadcast, which are
+// sent to clients using FormatNMEA prefixed with "[tag] ", so that clients can
+// tell where each message came from. Messages are not tagged if tag is empty.
+func (p *Pool) Source(tag string) chan<- []byte {
+	ch := make(chan []byte)
+	go func() {
+		for {
+			select {
+			case msg := <-ch:
+				select {
+				case p.tagged <- taggedMsg{msg: msg, tag: tag}:
+				case <-p.done:
+					return
+				}
+			case <-p.done:
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+// Stop stops the pool, which closes the Send channel of each registered
+// client. Sending to Register, Unregister or Broadcast blocks once the pool is
+// stopped, so senders should also wait for Done.
+func (p *Pool) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.done)
+	})
+}
+
+// Done returns a channel that is closed when the pool is stopped
+func (p *Pool) Done() <-chan struct{} {
+	return p.done
+}
+
+// Observe registers a function that is called with every message broadcast by
+// the pool, before it is sent to clients. It is called from the broadcast loop
+// so it must not block. Observers must be registered before calling Start.
+func (p *Pool) Observe(fn func(msg []byte)) {
+	p.observers = append(p.observers, fn)
+}
+
+// LimitRate limits the broadcast to at most hz fix cycles per second, by
+// dropping whole fix cycles. It must be called before calling Start.
+func (p *Pool) LimitRate(hz float64) {
+	p.limiter = newRateLimiter(hz)
+}
+
+// SetLineEnding sets what is appended to each sentence sent to clients using
+// FormatNMEA, e.g. "\r\n" for clients that require CRLF like NMEA 0183 says.
+// The default is "\n". It must be called before calling Start.
+func (p *Pool) SetLineEnding(ending string) {
+	p.lineEnding = ending
+}
+
+// ReplayLastFix makes the pool send the sentences of the given types (e.g.
+// "GGA", "RMC") from the most recent fix cycle to each new client, before any
+// new sentences are sent. Clients using FormatJSON are sent the most recent
+// fix instead. It must be called before calling Start.
+func (p *Pool) ReplayLastFix(types []string) {
+	p.lastFix = newLastFix(types)
+}
+
+// ClearLastFix forgets the most recent fix cycle, e.g. because the device was
+// stopped and it is out of date.
+func (p *Pool) ClearLastFix() {
+	select {
+	case p.clearFix <- struct{}{}:
+	case <-p.done:
 	}
 }
 
+// Start handles clients being registered and unregistered, and broadcasts
+// messages to them, until Stop is called.
 func (p *Pool) Start() {
 	for {
 		select {
+		case <-p.done:
+			p.mu.Lock()
+			for c := range p.Clients {
+				close(c.Send)
+				delete(p.Clients, c)
+			}
+			p.mu.Unlock()
+			return
 		case c := <-p.Register:
 			p.mu.Lock()
 			p.Clients[c] = true
 			p.mu.Unlock()
+			switch {
+			case c.Format() == FormatEvents:
+				if event := p.events.current(); event != nil {
+					c.Send <- event
+				}
+			case p.lastFix == nil:
+			case c.Format() == FormatJSON:
+				if p.lastJSON != nil {
+					c.Send <- p.lastJSON
+				}
+			default:
+				for _, msg := range p.lastFix.cached {
+					c.Send <- msg
+				}
+			}
 		case c := <-p.Unregister:
 			p.mu.Lock()
 			delete(p.Clients, c)
 			p.mu.Unlock()
 		case msg := <-p.Broadcast:
-			msg = append(msg, byte('\n'))
-			for c := range p.Clients {
-				c.Send <- msg
+			p.broadcast(msg, "")
+		case m := <-p.tagged:
+			p.broadcast(m.msg, m.tag)
+		case <-p.clearFix:
+			if p.lastFix != nil {
+				p.lastFix.clear()
+			}
+			p.fixes.reset()
+			p.cycles = nil
+			p.lastJSON = nil
+			atomic.StoreInt32(&p.fixQuality, int32(nmea.FixInvalid))
+			if event := p.events.reset(); event != nil {
+				p.sendEvent(event)
 			}
 		}
 	}
 }
 
+// broadcast sends the message to all clients, prefixed with the tag if set
+func (p *Pool) broadcast(msg []byte, tag string) {
+	now := time.Now()
+	if p.limiter != nil && !p.limiter.allow(msg, now) {
+		return
+	}
+	for _, fn := range p.observers {
+		fn(msg)
+	}
+	// the message is sent to clients with the line ending, in a new buffer
+	// so that the sender's buffer is not modified
+	line := make([]byte, 0, len(tag)+len(msg)+len(p.lineEnding)+3)
+	if tag != "" {
+		line = append(line, "["+tag+"] "...)
+	}
+	line = append(line, msg...)
+	line = append(line, p.lineEnding...)
+	if p.lastFix != nil {
+		p.lastFix.add(msg, line)
+	}
+	fix := p.fixes.add(msg)
+	if fix != nil {
+		p.lastJSON = fix
+	}
+	event := p.events.add(msg)
+	if p.events.gga {
+		atomic.StoreInt32(&p.fixQuality, int32(p.events.quality))
+		if p.events.quality != nmea.FixInvalid {
+			atomic.StoreInt64(&p.lastFixTime, now.UnixNano())
+		}
+	}
+	cycles := p.cycles[tag]
+	if cycles == nil {
+		if p.cycles == nil {
+			p.cycles = make(map[string]*nmea.CycleDetector)
+		}
+		cycles = &nmea.CycleDetector{}
+		p.cycles[tag] = cycles
+	}
+	start := cycles.Start(msg)
+	for c := range p.Clients {
+		allowed := c.allow(tag, start, now)
+		switch c.Format() {
+		case FormatJSON:
+			if fix != nil && allowed {
+				c.Send <- fix
+			}
+		case FormatEvents:
+			if event != nil {
+				c.Send <- event
+			}
+		default:
+			if allowed {
+				c.Send <- line
+			}
+		}
+	}
+}
+
+// sendEvent sends the event line to all clients using FormatEvents
+func (p *Pool) sendEvent(event []byte) {
+	for c := range p.Clients {
+		if c.Format() == FormatEvents {
+			c.Send <- event
+		}
+	}
+}
+
+// ClientDropped counts a client that was disconnected because it was too slow
+// to receive messages
+func (p *Pool) ClientDropped() {
+	atomic.AddUint64(&p.dropped, 1)
+}
+
+// Dropped returns the number of clients that were disconnected because they
+// were too slow to receive messages
+func (p *Pool) Dropped() uint64 {
+	return atomic.LoadUint64(&p.dropped)
+}
+
+// LastFix returns the fix quality from the most recent GGA sentence broadcast,
+// and when the most recent one with a valid fix was broadcast, which is zero if
+// there was none. The quality is invalid once ClearLastFix is called.
+func (p *Pool) LastFix() (quality nmea.FixQuality, at time.Time) {
+	quality = nmea.FixQuality(atomic.LoadInt32(&p.fixQuality))
+	if nanos := atomic.LoadInt64(&p.lastFixTime); nanos != 0 {
+		at = time.Unix(0, nanos)
+	}
+	return
+}
+
 func (p *Pool) Count() (count int) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -0,0 +1,357 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package pool
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/nmea"
+)
+
+// how long to wait for the pool before a test fails, instead of deadlocking
+const testTimeout = 5 * time.Second
+
+// startPool starts a new pool, which is stopped when the test ends
+func startPool(t *testing.T) *Pool {
+	p := New()
+	stopped := make(chan struct{})
+	go func() {
+		p.Start()
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		p.Stop()
+		<-stopped
+	})
+
+	return p
+}
+
+// receive returns the next message sent to the client
+func receive(t *testing.T, c *Client) string {
+	t.Helper()
+	select {
+	case msg := <-c.Send:
+		return string(msg)
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for message")
+		return ""
+	}
+}
+
+// Test that every registered client receives every message with a newline
+func TestBroadcast(t *testing.T) {
+	p := startPool(t)
+
+	var clients []*Client
+	for i := 0; i < 5; i++ {
+		c := &Client{Send: make(chan []byte, 10)}
+		p.Register <- c
+		clients = append(clients, c)
+	}
+
+	// with spare capacity, so that appending to it would modify the
+	// backing array
+	msg := make([]byte, 0, 100)
+	msg = append(msg, "$GPGGA,*7A"...)
+	for i := 0; i < 3; i++ {
+		p.Broadcast <- msg
+	}
+
+	for i, c := range clients {
+		for j := 0; j < 3; j++ {
+			if got := receive(t, c); got != "$GPGGA,*7A\n" {
+				t.Errorf("client %d, message %d: expected: %q, got: %q", i, j, "$GPGGA,*7A\n", got)
+			}
+		}
+	}
+	if string(msg[:cap(msg)][len(msg):len(msg)+1]) == "\n" {
+		t.Errorf("sender's buffer was modified")
+	}
+	if p.Count() != len(clients) {
+		t.Errorf("expected %d clients, got: %d", len(clients), p.Count())
+	}
+}
+
+// Test that messages from a tagged source are prefixed with the tag
+func TestSourceTag(t *testing.T) {
+	p := startPool(t)
+
+	c := &Client{Send: make(chan []byte, 10)}
+	p.Register <- c
+
+	p.Source("rover") <- []byte("$GPGGA,*7A")
+	p.Source("") <- []byte("$GPRMC,*67")
+	for _, expected := range []string{"[rover] $GPGGA,*7A\n", "$GPRMC,*67\n"} {
+		if got := receive(t, c); got != expected {
+			t.Errorf("expected: %q, got: %q", expected, got)
+		}
+	}
+}
+
+// Test that sentences are sent with the configured line ending
+func TestLineEnding(t *testing.T) {
+	p := New()
+	p.SetLineEnding("\r\n")
+	go p.Start()
+	defer p.Stop()
+
+	c := &Client{Send: make(chan []byte, 10)}
+	p.Register <- c
+	p.Broadcast <- []byte("$GPGGA,*7A")
+	if got := receive(t, c); got != "$GPGGA,*7A\r\n" {
+		t.Errorf("expected: %q, got: %q", "$GPGGA,*7A\r\n", got)
+	}
+}
+
+// Test that a client can be unregistered while messages are broadcast, without
+// blocking the other clients
+func TestUnregister(t *testing.T) {
+	p := startPool(t)
+
+	const messages = 20
+	var wg sync.WaitGroup
+	received := make([][]string, 3)
+	for i := range received {
+		c := &Client{Send: make(chan []byte)}
+		p.Register <- c
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// the first client leaves after a few messages
+			limit := messages
+			if i == 0 {
+				limit = 5
+			}
+			for len(received[i]) < limit {
+				received[i] = append(received[i], string(<-c.Send))
+			}
+			if i != 0 {
+				return
+			}
+
+			// like the server, keep receiving until unregistered, since
+			// the pool may be sending to this client
+			unregistered := make(chan struct{})
+			go func() {
+				for {
+					select {
+					case <-c.Send:
+					case <-unregistered:
+						return
+					}
+				}
+			}()
+			p.Unregister <- c
+			close(unregistered)
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < messages; i++ {
+			p.Broadcast <- []byte(fmt.Sprintf("$GPGGA,%d", i))
+		}
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("timed out broadcasting messages")
+	}
+
+	if p.Count() != 2 {
+		t.Errorf("expected 2 clients, got: %d", p.Count())
+	}
+	for i, msgs := range received[1:] {
+		if len(msgs) != messages || msgs[messages-1] != fmt.Sprintf("$GPGGA,%d\n", messages-1) {
+			t.Errorf("client %d: expected %d messages, got: %q", i+1, messages, msgs)
+		}
+	}
+}
+
+// Test that the most recent fix cycle is sent to new clients
+func TestReplayLastFix(t *testing.T) {
+	p := New()
+	p.ReplayLastFix([]string{"GGA", "RMC"})
+	go p.Start()
+	defer p.Stop()
+
+	for _, msg := range []string{"$GPGGA,*7A", "$GPGSV,1,1,00*79", "$GPRMC,*67", "$GPGGA,*7A"} {
+		p.Broadcast <- []byte(msg)
+	}
+
+	c := &Client{Send: make(chan []byte, 10)}
+	p.Register <- c
+	got := []string{receive(t, c), receive(t, c)}
+	if expected := "$GPGGA,*7A\n$GPRMC,*67\n"; strings.Join(got, "") != expected {
+		t.Errorf("expected: %q, got: %q", expected, got)
+	}
+
+	// not replayed once cleared
+	p.ClearLastFix()
+	c = &Client{Send: make(chan []byte, 10)}
+	p.Register <- c
+	p.Broadcast <- []byte("$GPGSV,1,1,00*79")
+	if got := receive(t, c); got != "$GPGSV,1,1,00*79\n" {
+		t.Errorf("expected only new messages after clearing, got: %q", got)
+	}
+}
+
+// Test that stopping the pool closes the clients' channels
+func TestStop(t *testing.T) {
+	p := New()
+	stopped := make(chan struct{})
+	go func() {
+		p.Start()
+		close(stopped)
+	}()
+
+	c := &Client{Send: make(chan []byte, 1)}
+	p.Register <- c
+	p.Stop()
+
+	select {
+	case <-stopped:
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for the pool to stop")
+	}
+	if _, ok := <-c.Send; ok {
+		t.Errorf("expected the client's channel to be closed")
+	}
+	// safe to call again
+	p.Stop()
+}
+
+// Test that clients with a rate set skip whole fix cycles
+func TestClientRate(t *testing.T) {
+	tables := []struct {
+		hz float64
+		// whether each cycle, one per second, is sent
+		expected []bool
+	}{
+		{0, []bool{true, true, true, true, true}},
+		{1, []bool{true, true, true, true, true}},
+		{0.5, []bool{true, false, true, false, true}},
+		{0.2, []bool{true, false, false, false, false}},
+		{5, []bool{true, true, true, true, true}},
+	}
+
+	start := time.Now()
+	for _, table := range tables {
+		c := &Client{}
+		c.SetRate(table.hz)
+		for i, expected := range table.expected {
+			now := start.Add(time.Duration(i) * time.Second)
+			// the start of the cycle, and another sentence in it
+			first := c.allow("", true, now)
+			second := c.allow("", false, now.Add(100*time.Millisecond))
+			if first != expected || second != expected {
+				t.Errorf("%v Hz cycle %d: expected sent: %t, got: %t, %t", table.hz, i, expected, first, second)
+			}
+		}
+	}
+
+	// sentences before the first cycle are not sent once the rate is set
+	c := &Client{}
+	c.SetRate(1)
+	if c.allow("", false, start) {
+		t.Errorf("expected sentence before the first cycle to be skipped")
+	}
+}
+
+// Test that the rate of a client applies to the fix cycles of each source,
+// when the sentences of several sources are interleaved
+func TestRateTagged(t *testing.T) {
+	p := New()
+	go p.Start()
+	defer p.Stop()
+
+	c := &Client{Send: make(chan []byte, 100)}
+	c.SetRate(1)
+	p.Register <- c
+	// receives all messages, to know when they were all broadcast
+	all := &Client{Send: make(chan []byte, 100)}
+	p.Register <- all
+
+	gga := "$GPGGA,123519.000,4830.000,N,01130.000,E,1,08,0.9,545.4,M,46.9,M,,*57"
+	rmc := "$GNRMC,123519.000,A,4830.000,N,01130.000,E,0.0,0.0,010621,,,A*6D"
+	a, b := p.Source("a"), p.Source("b")
+	// two cycles from each source, the second ones are within the interval
+	for i := 0; i < 2; i++ {
+		a <- []byte(gga)
+		b <- []byte(rmc)
+		a <- []byte("$GPGSV,1,1,00*79")
+		b <- []byte("$GPGSV,1,1,00*79")
+	}
+	for i := 0; i < 8; i++ {
+		select {
+		case <-all.Send:
+		case <-time.After(testTimeout):
+			t.Fatal("timed out waiting for messages")
+		}
+	}
+
+	// sources are not ordered relative to each other
+	got := map[string][]string{}
+	for len(c.Send) > 0 {
+		msg := strings.TrimSpace(string(<-c.Send))
+		got[msg[:3]] = append(got[msg[:3]], msg)
+	}
+	expected := map[string][]string{
+		"[a]": {"[a] " + gga, "[a] $GPGSV,1,1,00*79"},
+		"[b]": {"[b] " + rmc, "[b] $GPGSV,1,1,00*79"},
+	}
+	for tag, lines := range expected {
+		if strings.Join(got[tag], "\n") != strings.Join(lines, "\n") {
+			t.Errorf("%s: expected: %q, got: %q", tag, lines, got[tag])
+		}
+	}
+}
+
+// Test that the quality of the most recent fix, and when the last valid one was
+// broadcast, are kept
+func TestLastFix(t *testing.T) {
+	fix := "$GPGGA,123519.000,4830.000,N,01130.000,E,1,08,0.9,545.4,M,46.9,M,,*57"
+	noFix := "$GPGGA,123520.000,,,,,0,00,,,M,,M,,*7F"
+	p := startPool(t)
+	// handled once the previous messages have been broadcast
+	handled := func() {
+		c := &Client{Send: make(chan []byte, 10)}
+		p.Register <- c
+		p.Unregister <- c
+	}
+
+	if quality, at := p.LastFix(); quality != nmea.FixInvalid || !at.IsZero() {
+		t.Errorf("expected no fix, got: %v at %s", quality, at)
+	}
+
+	before := time.Now()
+	p.Broadcast <- []byte(fix)
+	p.Broadcast <- []byte("$GPGSV,1,1,00*79")
+	handled()
+	quality, fixed := p.LastFix()
+	if quality != nmea.FixGPS || fixed.Before(before) {
+		t.Errorf("expected GPS fix after %s, got: %v at %s", before, quality, fixed)
+	}
+
+	p.Broadcast <- []byte(noFix)
+	handled()
+	if quality, at := p.LastFix(); quality != nmea.FixInvalid || !at.Equal(fixed) {
+		t.Errorf("expected fix lost after %s, got: %v at %s", fixed, quality, at)
+	}
+
+	p.Broadcast <- []byte(fix)
+	p.ClearLastFix()
+	handled()
+	if quality, at := p.LastFix(); quality != nmea.FixInvalid || at.Before(fixed) {
+		t.Errorf("expected fix cleared, got: %v at %s", quality, at)
+	}
+}
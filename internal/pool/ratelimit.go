@@ -0,0 +1,46 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package pool
+
+import (
+	"time"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/nmea"
+)
+
+// rateLimiter drops whole fix cycles, so that at most one fix cycle is passed
+// through per interval
+type rateLimiter struct {
+	interval time.Duration
+	cycles   nmea.CycleDetector
+	last     time.Time
+	passing  bool
+}
+
+func newRateLimiter(hz float64) *rateLimiter {
+	return &rateLimiter{
+		interval: time.Duration(float64(time.Second) / hz),
+	}
+}
+
+// allow returns true if the message is part of a fix cycle that should be
+// passed through. Messages before the start of the first cycle are dropped.
+func (r *rateLimiter) allow(msg []byte, now time.Time) bool {
+	return r.allowCycle(r.cycles.Start(msg), now)
+}
+
+// allowCycle is like allow, for a message that was already checked for
+// whether it starts a new fix cycle
+func (r *rateLimiter) allowCycle(start bool, now time.Time) bool {
+	if start {
+		// allow some slack, since cycles from the module are not sent at
+		// exactly the same interval
+		r.passing = now.Sub(r.last) >= r.interval-r.interval/10
+		if r.passing {
+			r.last = now
+		}
+	}
+
+	return r.passing
+}
@@ -4,121 +4,682 @@
 package server
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"os"
 	"os/user"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"gitlab.com/postmarketOS/gnss-share/internal/pool"
+	"golang.org/x/sys/unix"
 )
 
+// ErrAlreadyRunning is returned by Start if another server is listening on one
+// of the sockets
+var ErrAlreadyRunning = errors.New("another server is already running")
+
+// Listener is a unix socket, or a TCP address, that clients can connect to
+type Listener struct {
+	Socket string
+	// TCP address (host:port) to listen on instead of Socket. The socket
+	// settings are not used for it.
+	Address string
+	// Group to set as the owner of the socket, not changed if empty
+	Group string
+	Mode  os.FileMode
+	// Clients connected to a control socket can also run control commands
+	Control bool
+}
+
 type Server struct {
-	socket    string
-	sockGroup string
+	listeners []Listener
 	connPool  *pool.Pool
-	sock      net.Listener
-	startChan chan<- bool
-	stopChan  chan<- bool
+	start     func()
+	stop      func()
+	commands  map[string]CommandHandler
+	// commands that can only be run from control sockets
+	controlCommands map[string]ControlHandler
+	// writes to clients that take longer than this fail, 0 means no limit
+	writeTimeout time.Duration
+	// format of messages sent to clients that don't ask for another one
+	format pool.Format
+	// networks that clients connecting over TCP must be in, all are
+	// allowed if empty
+	allowed []*net.IPNet
+	// users and groups that clients connecting to sockets must run as, all
+	// are allowed if both are empty
+	allowedUids []int
+	allowedGids []int
+	// called once all sockets are listening
+	onListening func()
+	// clientMu protects clients, the number of connected clients, which is
+	// used to check whether the first client has connected or the last
+	// client has disconnected. The pool's count can't be used for this, since
+	// it is only updated once the pool has handled the (un)registration.
+	clientMu sync.Mutex
+	clients  int
+	// sockMu protects socks and stopped
+	sockMu  sync.Mutex
+	socks   []net.Listener
+	stopped bool
 }
 
-// Create a new Server. The server will send 'true' to startChan when the first
-// client connects, and 'true' to stopChan when the last client disconnects.
-// Messages received from the connPool are forwarded to the connected clients.
-func New(socket string, sockGroup string, startChan chan<- bool, stopChan chan<- bool, connPool *pool.Pool) (s *Server) {
+// CommandHandler is run when a client sends the command it is registered for,
+// with any arguments that followed the command. The client is told whether the
+// handler returned an error or not.
+type CommandHandler func(args []string) error
+
+// Create a new Server, accepting connections on all of the given listeners.
+// The server will call start when the first client is registered for messages,
+// and stop when the last one disconnects. Messages received from the connPool are forwarded
+// to the connected clients.
+func New(listeners []Listener, start func(), stop func(), connPool *pool.Pool) (s *Server) {
 	s = &Server{
-		socket:    socket,
-		sockGroup: sockGroup,
-		startChan: startChan,
-		stopChan:  stopChan,
-		connPool:  connPool,
+		listeners:       listeners,
+		start:           start,
+		stop:            stop,
+		connPool:        connPool,
+		commands:        make(map[string]CommandHandler),
+		controlCommands: make(map[string]ControlHandler),
 	}
 
 	return
 }
 
-func (s *Server) Start() (err error) {
-	if err := os.RemoveAll(s.socket); err != nil {
-		return fmt.Errorf("startServer(): %w", err)
+// ControlHandler is run when a client connected to a control socket sends the
+// command it is registered for. Each line of output is sent to the client
+// before it is told whether the handler returned an error or not.
+type ControlHandler func(args []string) (out []string, err error)
+
+// HandleCommand registers a handler for the given command. Clients run the
+// command by sending it on a line by itself, optionally followed by arguments
+// separated by spaces, and receive a line with either "OK <command>" or
+// "ERROR <command>: <reason>" in response. Commands are not case sensitive.
+// Only clients connected to a socket can run them, not clients over TCP.
+func (s *Server) HandleCommand(cmd string, handler CommandHandler) {
+	s.commands[strings.ToUpper(cmd)] = handler
+}
+
+// HandleControlCommand registers a handler for a command that can only be run
+// by clients connected to a control socket. The output of the command is sent
+// to the client as lines of "OUTPUT <command>: <line>", followed by the same
+// response as for other commands.
+func (s *Server) HandleControlCommand(cmd string, handler ControlHandler) {
+	s.controlCommands[strings.ToUpper(cmd)] = handler
+}
+
+// SetWriteTimeout sets how long writing a message to a client can take. Clients
+// that are too slow to receive messages are disconnected, so that they don't
+// hold up sending messages to other clients. Writes are not limited if timeout
+// is 0.
+func (s *Server) SetWriteTimeout(timeout time.Duration) {
+	s.writeTimeout = timeout
+}
+
+// AllowOnly only accepts connections to TCP listeners from clients in the
+// given CIDR ranges (e.g. "192.168.0.0/24" or "fe80::/10") or with the given
+// addresses. Connections from other clients are closed immediately. All
+// clients are allowed if the list is empty.
+func (s *Server) AllowOnly(cidrs []string) error {
+	s.allowed = nil
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return fmt.Errorf("server.AllowOnly: invalid address: %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			s.allowed = append(s.allowed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("server.AllowOnly: %w", err)
+		}
+		s.allowed = append(s.allowed, ipNet)
 	}
 
-	s.sock, err = net.Listen("unix", s.socket)
+	return nil
+}
+
+// isAllowed returns true if the client connected from addr can connect
+func (s *Server) isAllowed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || len(s.allowed) == 0 {
+		return true
+	}
+
+	for _, ipNet := range s.allowed {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowPeers only accepts connections to sockets from processes running as one
+// of the given users, or with one of the given groups as their primary group,
+// as reported by SO_PEERCRED. Connections from other processes are closed
+// immediately. All processes are allowed if both lists are empty.
+func (s *Server) AllowPeers(uids []int, gids []int) {
+	s.allowedUids = uids
+	s.allowedGids = gids
+}
+
+// peerCred returns the credentials of the process connected to a socket, or
+// nil for other connections, e.g. over TCP
+func peerCred(conn net.Conn) (cred *syscall.Ucred, err error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return
+	}
+
+	raw, err := unixConn.SyscallConn()
 	if err != nil {
-		return fmt.Errorf("startServer(): %w", err)
+		return
+	}
+	cerr := raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = cerr
 	}
-	defer s.sock.Close()
 
-	if err := os.Chmod(s.socket, 0660); err != nil {
-		return fmt.Errorf("startServer(): %w", err)
+	return
+}
+
+// peerClosed returns true if the client connected to a socket closed the
+// connection completely, rather than only for writing. Clients connected over
+// TCP can't be told apart, so false is returned for them.
+func peerClosed(conn net.Conn) bool {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return false
 	}
 
-	group, err := user.LookupGroup(s.sockGroup)
+	raw, err := unixConn.SyscallConn()
 	if err != nil {
-		return fmt.Errorf("startServer(): %w", err)
+		return true
+	}
+	// the socket is hung up once neither side can send anything
+	hup := true
+	raw.Control(func(fd uintptr) {
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		if _, err := unix.Poll(fds, 0); err == nil {
+			hup = fds[0].Revents&unix.POLLHUP != 0
+		}
+	})
+
+	return hup
+}
+
+// isPeerAllowed returns true if the process with the given credentials can
+// connect
+func (s *Server) isPeerAllowed(cred *syscall.Ucred) bool {
+	if len(s.allowedUids) == 0 && len(s.allowedGids) == 0 {
+		return true
+	}
+
+	for _, uid := range s.allowedUids {
+		if uint32(uid) == cred.Uid {
+			return true
+		}
+	}
+	for _, gid := range s.allowedGids {
+		if uint32(gid) == cred.Gid {
+			return true
+		}
 	}
+	return false
+}
 
-	gid, err := strconv.ParseInt(group.Gid, 10, 16)
+// SetFormat sets the format of messages sent to clients, unless they ask for
+// another format with the FORMAT command.
+func (s *Server) SetFormat(f pool.Format) {
+	s.format = f
+}
+
+// OnListening sets a function that is called by Start once all sockets are
+// accepting connections.
+func (s *Server) OnListening(fn func()) {
+	s.onListening = fn
+}
+
+// Start listens on all sockets, and accepts connections until Stop is called
+// or accepting connections on any socket fails.
+func (s *Server) Start() (err error) {
+	s.sockMu.Lock()
+	for _, l := range s.listeners {
+		var sock net.Listener
+		sock, err = listen(l)
+		if err != nil {
+			s.sockMu.Unlock()
+			s.Stop()
+			return fmt.Errorf("startServer(): %w", err)
+		}
+		s.socks = append(s.socks, sock)
+	}
+
+	errChan := make(chan error, len(s.socks))
+	for i, sock := range s.socks {
+		fmt.Printf("Starting GNSS server, accepting connections at: %s\n", sock.Addr())
+		go func(sock net.Listener, control bool) {
+			errChan <- s.connectionHandler(sock, control)
+		}(sock, s.listeners[i].Control)
+	}
+	s.sockMu.Unlock()
+
+	if s.onListening != nil {
+		s.onListening()
+	}
+
+	err = <-errChan
+	s.sockMu.Lock()
+	stopped := s.stopped
+	s.sockMu.Unlock()
+	if stopped {
+		return nil
+	}
+
+	s.Stop()
+	return err
+}
+
+// Stop closes all sockets, which also removes them from the filesystem
+func (s *Server) Stop() {
+	s.sockMu.Lock()
+	defer s.sockMu.Unlock()
+
+	s.stopped = true
+	for _, sock := range s.socks {
+		sock.Close()
+	}
+	s.socks = nil
+}
+
+func listen(l Listener) (sock net.Listener, err error) {
+	if l.Address != "" {
+		return net.Listen("tcp", l.Address)
+	}
+
+	// only remove the socket if it is stale, so that the socket of another
+	// server using the same config is not removed from under it
+	if info, serr := os.Stat(l.Socket); serr == nil && info.Mode()&os.ModeSocket == 0 {
+		err = fmt.Errorf("%q exists and is not a socket", l.Socket)
+		return
+	}
+	if conn, derr := net.DialTimeout("unix", l.Socket, time.Second); derr == nil {
+		conn.Close()
+		err = fmt.Errorf("%w, listening on %q", ErrAlreadyRunning, l.Socket)
+		return
+	}
+	if err = os.RemoveAll(l.Socket); err != nil {
+		return
+	}
+
+	sock, err = net.Listen("unix", l.Socket)
 	if err != nil {
-		return fmt.Errorf("startServer(): %w", err)
+		return
 	}
 
-	if err := os.Chown(s.socket, -1, int(gid)); err != nil {
-		return fmt.Errorf("startServer(): %w", err)
+	if err = os.Chmod(l.Socket, l.Mode); err != nil {
+		sock.Close()
+		return
 	}
 
-	// connection handler
-	fmt.Printf("Starting GNSS server, accepting connections at: %s\n", s.socket)
-	go s.connectionHandler()
+	if err = chownSocket(l.Socket, l.Group); err != nil {
+		sock.Close()
+		return
+	}
 
-	s.connectionHandler()
-	return nil
+	return
 }
 
-func (s *Server) connectionHandler() error {
+// chownSocket sets the group owner of the socket. This is skipped if no group
+// is given, or if the group does not exist.
+func chownSocket(socket string, sockGroup string) error {
+	if sockGroup == "" {
+		return nil
+	}
+
+	group, err := user.LookupGroup(sockGroup)
+	if err != nil {
+		var unknownGroup user.UnknownGroupError
+		if errors.As(err, &unknownGroup) {
+			fmt.Printf("Warning: group %q not found, not changing the group owner of %q\n", sockGroup, socket)
+			return nil
+		}
+		return err
+	}
+
+	gid, err := strconv.ParseInt(group.Gid, 10, 32)
+	if err != nil {
+		return err
+	}
+
+	return os.Chown(socket, -1, int(gid))
+}
+
+func (s *Server) connectionHandler(sock net.Listener, control bool) error {
 	for {
-		conn, err := (s.sock).Accept()
+		conn, err := sock.Accept()
 		if err != nil {
 			return fmt.Errorf("server.connectionHandler: %w", err)
 		}
-
-		client := pool.Client{
-			Conn: &conn,
-			Send: make(chan []byte, 1),
+		if !s.isAllowed(conn.RemoteAddr()) {
+			fmt.Printf("Rejected connection from %s, address is not allowed\n", conn.RemoteAddr())
+			conn.Close()
+			continue
 		}
-
-		if s.connPool.Count() == 0 {
-			// client is first one in the connPool
-			s.startChan <- true
+		if len(s.allowedUids) > 0 || len(s.allowedGids) > 0 {
+			cred, err := peerCred(conn)
+			if err != nil {
+				fmt.Printf("Rejected connection to %q, unable to get the credentials of the client: %s\n", sock.Addr(), err)
+				conn.Close()
+				continue
+			}
+			if cred != nil && !s.isPeerAllowed(cred) {
+				fmt.Printf("Rejected connection to %q from pid %d, uid %d and gid %d are not allowed\n", sock.Addr(), cred.Pid, cred.Uid, cred.Gid)
+				conn.Close()
+				continue
+			}
 		}
 
-		s.connPool.Register <- &client
+		c := &clientConn{
+			Client: &pool.Client{
+				Conn: &conn,
+				Send: make(chan []byte, 1),
+			},
+		}
+		c.SetFormat(s.format)
+		s.registerLater(c)
 
-		go s.clientConnection(&client)
+		// only clients on the device can change its state
+		local := sock.Addr().Network() == "unix"
+		go s.clientCommands(c, control, local)
 
 		fmt.Println("New client connected")
 
 	}
 }
 
+// How long a client has to stay connected without sending a command before it
+// is registered for messages, so that connections that only run commands, or
+// check that the server is running, don't start the device
+const registerDelay = 250 * time.Millisecond
+
+// clientConn is a client connection, which is only registered in the pool once
+// the client is expected to read messages
+type clientConn struct {
+	*pool.Client
+	// mu protects the fields below
+	mu    sync.Mutex
+	timer *time.Timer
+	// set once the client is registered, or once it disconnected before
+	// being registered
+	registered bool
+	closed     bool
+	// set once the client ran a command that does not register it
+	ranCommand bool
+}
+
+// register registers the client in the pool, which starts the device if it is
+// the first one, unless it is already registered or disconnected. It returns
+// true if the client was registered now.
+func (s *Server) register(c *clientConn) bool {
+	c.mu.Lock()
+	if c.registered || c.closed {
+		c.mu.Unlock()
+		return false
+	}
+	c.registered = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.mu.Unlock()
+
+	s.clientMu.Lock()
+	if s.clients == 0 {
+		// client is first one in the connPool
+		s.start()
+	}
+	s.clients++
+
+	select {
+	case s.connPool.Register <- c.Client:
+	case <-s.connPool.Done():
+		// nothing is sent to clients once the pool is stopped
+		close(c.Send)
+	}
+	s.clientMu.Unlock()
+
+	go s.clientConnection(c.Client)
+	return true
+}
+
+// registerLater registers the client once it has not sent a command for
+// registerDelay
+func (s *Server) registerLater(c *clientConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.registered || c.closed {
+		return
+	}
+	if c.timer == nil {
+		c.timer = time.AfterFunc(registerDelay, func() { s.register(c) })
+	} else {
+		c.timer.Reset(registerDelay)
+	}
+}
+
+// holdRegistration stops the client from being registered while it runs a
+// command
+func (c *clientConn) holdRegistration() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ranCommand = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+// disconnected is called once the client stopped sending. A client that was
+// not registered yet is registered now if it only closed the connection for
+// writing, e.g. "nc -U <socket> </dev/null", so that it still receives
+// messages. Otherwise the connection is closed if the client was never
+// registered, e.g. if it only ran commands or checked that the server is
+// running, and closed once writing to it fails if it was.
+func (s *Server) disconnected(c *clientConn) {
+	c.mu.Lock()
+	if c.registered {
+		c.mu.Unlock()
+		return
+	}
+	if !c.ranCommand && !peerClosed(*c.Conn) {
+		c.mu.Unlock()
+		s.register(c)
+		return
+	}
+	defer c.mu.Unlock()
+
+	c.closed = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	(*c.Conn).Close()
+	fmt.Println("Client disconnected")
+}
+
 // Routine run for each client connection
 func (s *Server) clientConnection(c *pool.Client) {
-	defer func() {
-		s.connPool.Unregister <- c
-		(*c.Conn).Close()
-	}()
+	defer (*c.Conn).Close()
 
 	for {
-		msg := <-c.Send
+		// closed when the pool is stopped
+		msg, ok := <-c.Send
+		if !ok {
+			break
+		}
+		if s.writeTimeout > 0 {
+			(*c.Conn).SetWriteDeadline(time.Now().Add(s.writeTimeout))
+		}
 		if _, err := (*c.Conn).Write(msg); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				fmt.Println("Timed out writing to client, disconnecting it")
+				s.connPool.ClientDropped()
+			}
 			break
 		}
 	}
 
+	// the pool may be blocked sending a message to this client, so keep
+	// receiving them until it has been unregistered. This has to start
+	// before waiting for clientMu, since a new client being registered
+	// waits for the pool while holding it.
+	unregistered := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case _, ok := <-c.Send:
+				if !ok {
+					return
+				}
+			case <-unregistered:
+				return
+			}
+		}
+	}()
+
 	// client disconnected
 	fmt.Println("Client disconnected")
-	if s.connPool.Count() == 1 {
+	s.clientMu.Lock()
+	s.clients--
+	if s.clients == 0 {
 		// client is last one in the pool
 		fmt.Println("No clients connected, closing GNSS")
-		s.stopChan <- true
+		s.stop()
+	}
+	select {
+	case s.connPool.Unregister <- c:
+	case <-s.connPool.Done():
+	}
+	s.clientMu.Unlock()
+	close(unregistered)
+}
+
+// setFormat sets the format of messages sent to the client, from the arguments
+// of a FORMAT command
+func setFormat(c *pool.Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a format: nmea, json or events")
+	}
+	f, err := pool.ParseFormat(args[0])
+	if err != nil {
+		return err
+	}
+	c.SetFormat(f)
+	return nil
+}
+
+// setRate sets how many fix cycles per second are sent to the client, from the
+// arguments of a RATE command. 0 sends every fix cycle.
+func setRate(c *pool.Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a rate in Hz")
+	}
+	hz, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || hz < 0 || math.IsInf(hz, 0) || math.IsNaN(hz) {
+		return fmt.Errorf("invalid rate %q, must be a number of Hz, or 0 for every fix", args[0])
+	}
+	c.SetRate(hz)
+	return nil
+}
+
+// Routine run for each client connection to handle commands sent by the
+// client. Commands that change the messages sent to the client register it
+// right away, other commands delay registering it. Commands registered with
+// HandleCommand can only be run by clients connected to a socket (local).
+func (s *Server) clientCommands(c *clientConn, control bool, local bool) {
+	defer s.disconnected(c)
+
+	scanner := bufio.NewScanner(*c.Conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		cmd := strings.ToUpper(fields[0])
+		args := fields[1:]
+
+		var resp string
+		var err error
+		if cmd == "FORMAT" || cmd == "EVENTS" {
+			// handled here since it changes the format for this client only
+			if cmd == "EVENTS" {
+				args = []string{"events"}
+			}
+			err = setFormat(c.Client, args)
+			if !s.register(c) && err == nil && c.Format() == pool.FormatEvents {
+				// registered again, so that the pool sends the
+				// current fix state
+				select {
+				case s.connPool.Register <- c.Client:
+				case <-s.connPool.Done():
+				}
+			}
+		} else if cmd == "RATE" {
+			// handled here since it changes the rate for this client only
+			err = setRate(c.Client, args)
+			s.register(c)
+		} else if _, ok := s.commands[cmd]; ok && !local {
+			resp = fmt.Sprintf("ERROR %s: not allowed over TCP\n", cmd)
+			if _, err := (*c.Conn).Write([]byte(resp)); err != nil {
+				return
+			}
+			continue
+		} else if handler, ok := s.commands[cmd]; ok {
+			c.holdRegistration()
+			err = handler(args)
+			s.registerLater(c)
+		} else if handler, ok := s.controlCommands[cmd]; ok && control {
+			c.holdRegistration()
+			var out []string
+			out, err = handler(args)
+			for _, l := range out {
+				resp += fmt.Sprintf("OUTPUT %s: %s\n", cmd, l)
+			}
+			s.registerLater(c)
+		} else {
+			resp = fmt.Sprintf("ERROR %s: unknown command\n", cmd)
+			if _, err := (*c.Conn).Write([]byte(resp)); err != nil {
+				return
+			}
+			continue
+		}
+
+		if err != nil {
+			fmt.Printf("error running command %q: %s\n", cmd, err)
+			resp += fmt.Sprintf("ERROR %s: %s\n", cmd, err)
+		} else {
+			resp += fmt.Sprintf("OK %s\n", cmd)
+		}
+
+		if _, err := (*c.Conn).Write([]byte(resp)); err != nil {
+			return
+		}
 	}
 }
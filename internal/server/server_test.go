@@ -0,0 +1,567 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/pool"
+)
+
+// Test that clients rapidly connecting and disconnecting while sentences are
+// broadcast don't deadlock the server, and that the device is stopped once
+// they are all gone
+func TestConnectDisconnect(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "gnss-share.sock")
+
+	var mu sync.Mutex
+	running := false
+	starts := 0
+	start := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if running {
+			t.Error("started while already running")
+		}
+		running = true
+		starts++
+	}
+	stop := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !running {
+			t.Error("stopped while not running")
+		}
+		running = false
+	}
+
+	connPool := pool.New()
+	go connPool.Start()
+	defer connPool.Stop()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case connPool.Broadcast <- []byte("$GPGGA,*7A"):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	s := New([]Listener{{Socket: socket, Mode: 0600}}, start, stop, connPool)
+	s.SetWriteTimeout(time.Second)
+	listening := make(chan struct{})
+	s.OnListening(func() { close(listening) })
+	go s.Start()
+	defer s.Stop()
+	<-listening
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				conn, err := net.Dial("unix", socket)
+				if err != nil {
+					t.Errorf("connecting: %s", err)
+					return
+				}
+				// some clients disconnect without reading anything
+				if (i+j)%2 == 0 {
+					bufio.NewReader(conn).ReadString('\n')
+				}
+				conn.Close()
+			}
+		}(i)
+	}
+
+	clientsDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(clientsDone)
+	}()
+	select {
+	case <-clientsDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out connecting and disconnecting clients")
+	}
+
+	// the server notices that clients are gone when writing to them fails
+	deadline := time.Now().Add(10 * time.Second)
+	for connPool.Count() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for clients to be unregistered, %d left", connPool.Count())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if running {
+		t.Error("device still running with no clients connected")
+	}
+	if starts == 0 {
+		t.Error("device was never started")
+	}
+}
+
+// Test checking the addresses of clients connecting over TCP
+func TestAllowOnly(t *testing.T) {
+	allowed := []string{"192.168.0.0/24", "fe80::/10", "10.0.0.1", "::1"}
+	tables := []struct {
+		addr     net.Addr
+		expected bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.168.0.42")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.42")}, false},
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.2")}, false},
+		// IPv4 clients connecting to an IPv6 listener
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:192.168.0.42")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::1")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1")}, false},
+		// sockets are not restricted
+		{&net.UnixAddr{Name: "@", Net: "unix"}, true},
+	}
+
+	s := New(nil, nil, nil, nil)
+	if err := s.AllowOnly(allowed); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, table := range tables {
+		if got := s.isAllowed(table.addr); got != table.expected {
+			t.Errorf("%s: expected: %t, got: %t", table.addr, table.expected, got)
+		}
+	}
+
+	if err := s.AllowOnly([]string{"192.168.0.0/33"}); err == nil {
+		t.Errorf("expected error for invalid CIDR range")
+	}
+}
+
+// Test that a server does not start on a socket that another server is
+// listening on, but replaces a stale socket
+func TestAlreadyRunning(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "gnss-share.sock")
+
+	// stale socket, e.g. left behind by a server that was killed
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	connPool := pool.New()
+	go connPool.Start()
+	defer connPool.Stop()
+
+	var mu sync.Mutex
+	starts := 0
+	start := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		starts++
+	}
+	s := New([]Listener{{Socket: socket, Mode: 0600}}, start, func() {}, connPool)
+	listening := make(chan struct{})
+	s.OnListening(func() { close(listening) })
+	go s.Start()
+	defer s.Stop()
+	select {
+	case <-listening:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for server to replace stale socket")
+	}
+
+	second := New([]Listener{{Socket: socket, Mode: 0600}}, func() {}, func() {}, connPool)
+	if err := second.Start(); !errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("expected error: %v, got: %v", ErrAlreadyRunning, err)
+	}
+	// checking for the running server must not start its device
+	time.Sleep(2 * registerDelay)
+	mu.Lock()
+	if starts != 0 {
+		t.Errorf("device of the running server was started %d time(s)", starts)
+	}
+	mu.Unlock()
+
+	if _, err := os.Stat(socket); err != nil {
+		t.Errorf("socket of the running server was removed: %s", err)
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("connecting to the running server: %s", err)
+	}
+	conn.Close()
+}
+
+// Test that a file that is not a socket is not replaced
+func TestListenNotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gnss-share.sock")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := listen(Listener{Socket: path, Mode: 0600}); err == nil {
+		t.Errorf("expected error listening on a regular file")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "data" {
+		t.Errorf("file was replaced: %q, %v", data, err)
+	}
+}
+
+// Test that clients connecting to a socket are only accepted if they run as
+// an allowed user or group
+func TestAllowPeers(t *testing.T) {
+	uid, gid := os.Getuid(), os.Getgid()
+	tables := []struct {
+		uids     []int
+		gids     []int
+		expected bool
+	}{
+		{nil, nil, true},
+		{[]int{uid}, nil, true},
+		{[]int{uid + 1}, nil, false},
+		{nil, []int{gid}, true},
+		{[]int{uid + 1}, []int{gid + 1, gid}, true},
+		{[]int{uid + 1}, []int{gid + 1}, false},
+	}
+
+	connPool := pool.New()
+	go connPool.Start()
+	defer connPool.Stop()
+
+	for _, table := range tables {
+		socket := filepath.Join(t.TempDir(), "gnss-share.sock")
+		s := New([]Listener{{Socket: socket, Mode: 0600}}, func() {}, func() {}, connPool)
+		s.AllowPeers(table.uids, table.gids)
+		listening := make(chan struct{})
+		s.OnListening(func() { close(listening) })
+		go s.Start()
+		<-listening
+
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			t.Fatalf("connecting: %s", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("FORMAT nmea\n"))
+		_, err = bufio.NewReader(conn).ReadString('\n')
+		if got := err == nil; got != table.expected {
+			t.Errorf("uids %v, gids %v: expected allowed: %t, got: %t (%v)", table.uids, table.gids, table.expected, got, err)
+		}
+
+		conn.Close()
+		s.Stop()
+	}
+}
+
+// Test that connections that only check that the server is running, or run
+// commands, don't start the device, while clients reading messages do
+func TestRegisterClients(t *testing.T) {
+	tables := []struct {
+		name string
+		// sent after connecting, the client disconnects after reading
+		// the response if set
+		cmd string
+		// the client stays connected without sending anything if set
+		stay bool
+		// the client only closes the connection for writing if set
+		halfClose bool
+		expected  int
+	}{
+		{"ping", "", false, false, 0},
+		{"command", "NOOP", false, false, 0},
+		{"format", "FORMAT nmea", false, false, 1},
+		{"rate", "RATE 1", false, false, 1},
+		{"reader", "", true, false, 1},
+		{"read-only reader", "", false, true, 1},
+		{"command half-closed", "NOOP", false, true, 0},
+	}
+
+	for _, table := range tables {
+		socket := filepath.Join(t.TempDir(), "gnss-share.sock")
+		var mu sync.Mutex
+		starts := 0
+		start := func() {
+			mu.Lock()
+			defer mu.Unlock()
+			starts++
+		}
+
+		connPool := pool.New()
+		go connPool.Start()
+		s := New([]Listener{{Socket: socket, Mode: 0600}}, start, func() {}, connPool)
+		s.HandleCommand("NOOP", func(args []string) error { return nil })
+		listening := make(chan struct{})
+		s.OnListening(func() { close(listening) })
+		go s.Start()
+		<-listening
+
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			t.Fatalf("connecting: %s", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if table.cmd != "" {
+			conn.Write([]byte(table.cmd + "\n"))
+			if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+				t.Errorf("%s: reading response: %s", table.name, err)
+			}
+		}
+		if table.halfClose {
+			conn.(*net.UnixConn).CloseWrite()
+		} else if !table.stay {
+			conn.Close()
+		}
+
+		time.Sleep(2 * registerDelay)
+		mu.Lock()
+		if starts != table.expected {
+			t.Errorf("%s: expected %d start(s), got: %d", table.name, table.expected, starts)
+		}
+		mu.Unlock()
+
+		conn.Close()
+		s.Stop()
+		connPool.Stop()
+	}
+}
+
+// Test that a client that closes the connection for writing right away, e.g.
+// "nc -U <socket> </dev/null", still receives sentences
+func TestHalfClosedClient(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "gnss-share.sock")
+	connPool := pool.New()
+	go connPool.Start()
+	defer connPool.Stop()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case connPool.Broadcast <- []byte("$GPGGA,*7A"):
+			case <-done:
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	s := New([]Listener{{Socket: socket, Mode: 0600}}, func() {}, func() {}, connPool)
+	listening := make(chan struct{})
+	s.OnListening(func() { close(listening) })
+	go s.Start()
+	defer s.Stop()
+	<-listening
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("connecting: %s", err)
+	}
+	defer conn.Close()
+	if err := conn.(*net.UnixConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading sentence: %s", err)
+	}
+	if strings.TrimSpace(line) != "$GPGGA,*7A" {
+		t.Errorf("expected sentence, got: %q", line)
+	}
+}
+
+// Test that commands can only be run by clients connected to a socket, not
+// over TCP
+func TestCommandsLocal(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "gnss-share.sock")
+	connPool := pool.New()
+	go connPool.Start()
+	defer connPool.Stop()
+
+	var mu sync.Mutex
+	runs := 0
+	s := New([]Listener{{Socket: socket, Mode: 0600}, {Address: "127.0.0.1:0"}}, func() {}, func() {}, connPool)
+	s.HandleCommand("STORE", func(args []string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		runs++
+		return nil
+	})
+	listening := make(chan struct{})
+	s.OnListening(func() { close(listening) })
+	go s.Start()
+	defer s.Stop()
+	<-listening
+
+	s.sockMu.Lock()
+	address := s.socks[1].Addr().String()
+	s.sockMu.Unlock()
+
+	tables := []struct {
+		network  string
+		address  string
+		expected string
+	}{
+		{"unix", socket, "OK STORE"},
+		{"tcp", address, "ERROR STORE: not allowed over TCP"},
+	}
+
+	for _, table := range tables {
+		conn, err := net.Dial(table.network, table.address)
+		if err != nil {
+			t.Fatalf("%s: connecting: %s", table.network, err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("store\n"))
+		resp, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Errorf("%s: reading response: %s", table.network, err)
+		}
+		if strings.TrimSpace(resp) != table.expected {
+			t.Errorf("%s: expected response: %q, got: %q", table.network, table.expected, resp)
+		}
+		conn.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if runs != 1 {
+		t.Errorf("expected the command to run once, ran: %d time(s)", runs)
+	}
+}
+
+// Test that the rate sent by a client with RATE is applied to the fix cycles
+// sent to it
+func TestRate(t *testing.T) {
+	gga := "$GPGGA,123519.000,4830.000,N,01130.000,E,1,08,0.9,545.4,M,46.9,M,,*57"
+	gsv := "$GPGSV,1,1,00*79"
+	tables := []struct {
+		cmd  string
+		resp string
+		// sentences received from two fix cycles sent right after
+		// each other
+		expected []string
+	}{
+		{"RATE 1", "OK RATE", []string{gga, gsv}},
+		{"rate 0.5", "OK RATE", []string{gga, gsv}},
+		{"RATE 0", "OK RATE", []string{gga, gsv, gga, gsv}},
+		{"RATE x", "ERROR RATE", []string{gga, gsv, gga, gsv}},
+		{"RATE", "ERROR RATE", []string{gga, gsv, gga, gsv}},
+	}
+
+	for _, table := range tables {
+		socket := filepath.Join(t.TempDir(), "gnss-share.sock")
+		connPool := pool.New()
+		go connPool.Start()
+		s := New([]Listener{{Socket: socket, Mode: 0600}}, func() {}, func() {}, connPool)
+		listening := make(chan struct{})
+		s.OnListening(func() { close(listening) })
+		go s.Start()
+		<-listening
+
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			t.Fatalf("connecting: %s", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		conn.Write([]byte(table.cmd + "\n"))
+		resp, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%s: reading response: %s", table.cmd, err)
+		}
+		if !strings.HasPrefix(resp, table.resp) {
+			t.Errorf("%s: expected response: %q, got: %q", table.cmd, table.resp, resp)
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for connPool.Count() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: timed out waiting for the client to be registered", table.cmd)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		for _, msg := range []string{gga, gsv, gga, gsv} {
+			connPool.Broadcast <- []byte(msg)
+		}
+
+		// everything that is sent arrives well before the deadline
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		var got []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			got = append(got, strings.TrimSpace(line))
+		}
+		if strings.Join(got, "\n") != strings.Join(table.expected, "\n") {
+			t.Errorf("%s: expected: %q, got: %q", table.cmd, table.expected, got)
+		}
+
+		conn.Close()
+		s.Stop()
+		connPool.Stop()
+	}
+}
+
+// Test that clients that are too slow to receive messages are disconnected and
+// counted
+func TestDropSlowClient(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "gnss-share.sock")
+
+	connPool := pool.New()
+	go connPool.Start()
+	defer connPool.Stop()
+
+	s := New([]Listener{{Socket: socket, Mode: 0600}}, func() {}, func() {}, connPool)
+	s.SetWriteTimeout(50 * time.Millisecond)
+	listening := make(chan struct{})
+	s.OnListening(func() { close(listening) })
+	go s.Start()
+	defer s.Stop()
+	<-listening
+
+	// never reads anything
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("connecting: %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("FORMAT nmea\n"))
+
+	msg := []byte("$GPTXT," + strings.Repeat("x", 4096) + "*00")
+	deadline := time.Now().Add(10 * time.Second)
+	for connPool.Dropped() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the client to be dropped")
+		}
+		select {
+		case connPool.Broadcast <- msg:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if dropped := connPool.Dropped(); dropped != 1 {
+		t.Errorf("expected 1 dropped client, got: %d", dropped)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// UDPBroadcaster sends messages as UDP datagrams to an address, which can be a
+// broadcast address. Sending is fire-and-forget, errors are only logged.
+type UDPBroadcaster struct {
+	conn    *net.UDPConn
+	failing bool
+}
+
+func NewUDPBroadcaster(addr string) (*UDPBroadcaster, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("server.NewUDPBroadcaster: %w", err)
+	}
+
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("server.NewUDPBroadcaster: %w", err)
+	}
+
+	return &UDPBroadcaster{conn: conn}, nil
+}
+
+// Send sends the message, terminated with CRLF, in a single datagram. It is
+// meant to be used as a pool observer, so it never blocks for long.
+func (u *UDPBroadcaster) Send(msg []byte) {
+	datagram := make([]byte, 0, len(msg)+2)
+	datagram = append(datagram, msg...)
+	datagram = append(datagram, '\r', '\n')
+
+	u.conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := u.conn.Write(datagram)
+	// only log when sending starts or stops failing, to avoid flooding the
+	// log with the same error for every sentence
+	if err != nil && !u.failing {
+		fmt.Printf("error sending UDP broadcast to %s: %s\n", u.conn.RemoteAddr(), err)
+	} else if err == nil && u.failing {
+		fmt.Printf("UDP broadcast to %s resumed\n", u.conn.RemoteAddr())
+	}
+	u.failing = err != nil
+}
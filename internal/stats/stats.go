@@ -0,0 +1,92 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/nmea"
+	"gitlab.com/postmarketOS/gnss-share/internal/pool"
+)
+
+// Stats collects operational statistics about the sentences broadcast by a
+// pool, and serves them over HTTP as JSON
+type Stats struct {
+	sentences uint64
+	connPool  *pool.Pool
+	ttff      *TTFF
+}
+
+type response struct {
+	Clients int `json:"clients"`
+	// clients disconnected for being too slow to receive messages
+	DroppedClients uint64          `json:"dropped_clients"`
+	Sentences      uint64          `json:"sentences"`
+	LastFix        *time.Time      `json:"last_fix"`
+	FixQuality     nmea.FixQuality `json:"fix_quality"`
+	// time to first fix after the device was last started, in seconds
+	TTFF *float64 `json:"ttff_seconds,omitempty"`
+}
+
+// New creates a new Stats, which observes messages broadcast by connPool
+func New(connPool *pool.Pool) *Stats {
+	s := &Stats{
+		connPool: connPool,
+	}
+	connPool.Observe(s.observe)
+
+	return s
+}
+
+// ReportTTFF includes the time to first fix measured by t in the stats
+func (s *Stats) ReportTTFF(t *TTFF) {
+	s.ttff = t
+}
+
+// observe counts the messages broadcast by the pool. It runs in the pool's
+// broadcast loop, so the fix is taken from the pool when serving the stats
+// instead of parsing sentences here.
+func (s *Stats) observe(msg []byte) {
+	atomic.AddUint64(&s.sentences, 1)
+}
+
+func (s *Stats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	resp := response{
+		Clients:        s.connPool.Count(),
+		DroppedClients: s.connPool.Dropped(),
+		Sentences:      atomic.LoadUint64(&s.sentences),
+	}
+
+	quality, lastFix := s.connPool.LastFix()
+	resp.FixQuality = quality
+	if !lastFix.IsZero() {
+		resp.LastFix = &lastFix
+	}
+
+	if s.ttff != nil {
+		if ttff, ok := s.ttff.Last(); ok {
+			seconds := ttff.Seconds()
+			resp.TTFF = &seconds
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		fmt.Printf("stats: error sending response: %s\n", err)
+	}
+}
+
+// Serve serves the stats as JSON over HTTP at the given address
+func (s *Stats) Serve(addr string) error {
+	fmt.Printf("Serving stats at: http://%s\n", addr)
+	if err := http.ListenAndServe(addr, s); err != nil {
+		return fmt.Errorf("stats.Serve: %w", err)
+	}
+
+	return nil
+}
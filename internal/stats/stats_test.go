@@ -0,0 +1,75 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package stats
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/nmea"
+	"gitlab.com/postmarketOS/gnss-share/internal/pool"
+)
+
+// Test the stats served over HTTP
+func TestServeHTTP(t *testing.T) {
+	fix := "$GPGGA,123519.000,4830.000,N,01130.000,E,1,08,0.9,545.4,M,46.9,M,,*57"
+	noFix := "$GPGGA,123520.000,,,,,0,00,,,M,,M,,*7F"
+
+	tables := []struct {
+		sentences []string
+		dropped   int
+		quality   nmea.FixQuality
+		hasFix    bool
+	}{
+		{nil, 0, nmea.FixInvalid, false},
+		{[]string{noFix, "$GPRMC,,V,,,,,,,,,,N*53"}, 0, nmea.FixInvalid, false},
+		{[]string{noFix, fix}, 2, nmea.FixGPS, true},
+		// the last fix is kept when it is lost
+		{[]string{fix, noFix}, 1, nmea.FixInvalid, true},
+	}
+
+	for _, table := range tables {
+		connPool := pool.New()
+		s := New(connPool)
+		go connPool.Start()
+		for _, sentence := range table.sentences {
+			connPool.Broadcast <- []byte(sentence)
+		}
+		// handled once the sentences have been broadcast
+		c := &pool.Client{Send: make(chan []byte, 10)}
+		connPool.Register <- c
+		connPool.Unregister <- c
+		for i := 0; i < table.dropped; i++ {
+			connPool.ClientDropped()
+		}
+
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%q: expected content type: application/json, got: %q", table.sentences, ct)
+		}
+
+		var resp response
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("%q: unexpected error: %s", table.sentences, err)
+		}
+		if resp.Sentences != uint64(len(table.sentences)) {
+			t.Errorf("%q: expected sentences: %d, got: %d", table.sentences, len(table.sentences), resp.Sentences)
+		}
+		if resp.DroppedClients != uint64(table.dropped) {
+			t.Errorf("%q: expected dropped clients: %d, got: %d", table.sentences, table.dropped, resp.DroppedClients)
+		}
+		if resp.FixQuality != table.quality {
+			t.Errorf("%q: expected fix quality: %v, got: %v", table.sentences, table.quality, resp.FixQuality)
+		}
+		if (resp.LastFix != nil) != table.hasFix {
+			t.Errorf("%q: expected last fix: %t, got: %v", table.sentences, table.hasFix, resp.LastFix)
+		}
+		if resp.TTFF != nil {
+			t.Errorf("%q: expected no TTFF, got: %v", table.sentences, *resp.TTFF)
+		}
+		connPool.Stop()
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package stats
+
+import (
+	"sync"
+	"time"
+
+	"gitlab.com/postmarketOS/gnss-share/internal/nmea"
+)
+
+// Number of consecutive valid fixes needed before the first fix is counted, so
+// that fixes flapping between valid and invalid are not counted too early
+const ttffValidFixes = 2
+
+// TTFF measures the time to first fix after the device is started, from the
+// sentences broadcast by a pool. A fix is valid if the GGA fix quality is
+// valid, and if the device sends GSA sentences, the fix mode is 3D.
+type TTFF struct {
+	mu        sync.Mutex
+	started   time.Time
+	measuring bool
+	// fix mode from the most recent GSA sentence, 0 if none were received
+	mode nmea.FixMode
+	// time of the first valid fix of the current run of valid fixes, and
+	// the number of valid fixes in it
+	firstValid time.Time
+	valid      int
+	// the most recent measurement, kept while measuring again
+	ttff    time.Duration
+	hasTTFF bool
+	onFix   func(ttff time.Duration)
+}
+
+// NewTTFF creates a new TTFF, which calls onFix (if set) each time the time to
+// first fix has been measured after the device was started
+func NewTTFF(onFix func(ttff time.Duration)) *TTFF {
+	return &TTFF{onFix: onFix}
+}
+
+// Start starts measuring the time to first fix, e.g. when the device is started
+func (t *TTFF) Start(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.started = now
+	t.measuring = true
+	t.mode = 0
+	t.valid = 0
+}
+
+// Observe is called with every message broadcast by the pool
+func (t *TTFF) Observe(msg []byte) {
+	if ttff, ok := t.observe(msg, time.Now()); ok && t.onFix != nil {
+		t.onFix(ttff)
+	}
+}
+
+// observe returns the time to first fix once it has been measured
+func (t *TTFF) observe(msg []byte, now time.Time) (ttff time.Duration, ok bool) {
+	// only GGA and GSA sentences are parsed, to keep the broadcast path cheap
+	if len(msg) < 6 || (string(msg[3:6]) != "GGA" && string(msg[3:6]) != "GSA") {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.measuring {
+		return
+	}
+
+	sentence, err := nmea.Parse(string(msg))
+	if err != nil {
+		return
+	}
+	if sentence.Type == "GSA" {
+		if dop, err := sentence.DOP(); err == nil {
+			t.mode = dop.Mode
+		}
+		return
+	}
+
+	pos, err := sentence.Position()
+	if err != nil {
+		return
+	}
+	if pos.Quality == nmea.FixInvalid || (t.mode != 0 && t.mode != nmea.FixMode3D) {
+		t.valid = 0
+		return
+	}
+
+	if t.valid == 0 {
+		t.firstValid = now
+	}
+	t.valid++
+	if t.valid < ttffValidFixes {
+		return
+	}
+
+	t.measuring = false
+	t.ttff = t.firstValid.Sub(t.started)
+	t.hasTTFF = true
+	return t.ttff, true
+}
+
+// Last returns the most recently measured time to first fix, ok is false if it
+// was never measured
+func (t *TTFF) Last() (ttff time.Duration, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.ttff, t.hasTTFF
+}
@@ -0,0 +1,45 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+// Test measuring the time to first fix, with sentences received one second
+// apart after starting
+func TestTTFF(t *testing.T) {
+	fix := "$GPGGA,123519.000,4830.000,N,01130.000,E,1,08,0.9,545.4,M,46.9,M,,*57"
+	noFix := "$GPGGA,123520.000,,,,,0,00,,,M,,M,,*7F"
+	mode2D := "$GPGSA,A,2,04,05,09,12,,,,,,,,,2.5,1.3,2.1*3E"
+	mode3D := "$GPGSA,A,3,04,05,09,12,,,,,,,,,2.5,1.3,2.1*3F"
+
+	tables := []struct {
+		sentences []string
+		expected  time.Duration
+		ok        bool
+	}{
+		{[]string{noFix, noFix, fix, fix, fix}, 3 * time.Second, true},
+		// flapping fixes are not counted
+		{[]string{fix, noFix, fix, noFix, fix, fix}, 5 * time.Second, true},
+		{[]string{noFix, fix}, 0, false},
+		// 2D fixes are not counted if GSA sentences are received
+		{[]string{mode2D, fix, fix, mode3D, fix, fix}, 5 * time.Second, true},
+	}
+
+	for _, table := range tables {
+		ttff := NewTTFF(nil)
+		start := time.Now()
+		ttff.Start(start)
+		for i, s := range table.sentences {
+			ttff.observe([]byte(s), start.Add(time.Duration(i+1)*time.Second))
+		}
+
+		got, ok := ttff.Last()
+		if ok != table.ok || got != table.expected {
+			t.Errorf("%q expected: %s, %t, got: %s, %t", table.sentences, table.expected, table.ok, got, ok)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notify sends the given state, e.g. "READY=1", to the service manager. It does
+// nothing if the service manager did not ask to be notified, i.e. NOTIFY_SOCKET
+// is not set.
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("systemd.Notify: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("systemd.Notify: %w", err)
+	}
+
+	return nil
+}
+
+// WatchdogInterval returns how often the service manager expects to receive
+// "WATCHDOG=1", or 0 if the watchdog is not enabled for this process.
+func WatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	usec, err := strconv.ParseUint(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
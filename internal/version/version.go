@@ -0,0 +1,21 @@
+// Copyright 2021 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// These are set at build time, e.g.:
+// go build -ldflags "-X gitlab.com/postmarketOS/gnss-share/internal/version.Version=1.0 -X gitlab.com/postmarketOS/gnss-share/internal/version.Commit=$(git rev-parse --short HEAD)"
+var (
+	Version = "unknown"
+	Commit  = "unknown"
+)
+
+// String returns the version information for the named application
+func String(name string) string {
+	return fmt.Sprintf("%s version %s (commit: %s, %s)", name, Version, Commit, runtime.Version())
+}